@@ -2,7 +2,9 @@ package bpm
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"runtime"
 
 	"github.com/blobcache/bpm/internal/dbutil"
@@ -184,6 +186,30 @@ func putLabelSet(tx *sqlx.Tx, aid uint64, labels LabelSet) error {
 	return nil
 }
 
+// verification is what Pull checked about the file for an asset, independent of the labels from its source.
+type verification struct {
+	// SHA256 is the sum which the file was checked against, or "" if it was not checked.
+	SHA256 string `db:"sha256"`
+	// SignedBy is the key which made a verified signature on the file, written as <kind>:<id>, or "" if there was none.
+	SignedBy string `db:"signed_by"`
+}
+
+// getVerification returns the verification for an asset, which is zero if it was never pulled.
+func getVerification(tx *sqlx.Tx, aid uint64) (verification, error) {
+	var v verification
+	err := tx.Get(&v, `SELECT sha256, signed_by FROM asset_verifications WHERE asset_id = ?`, aid)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return v, err
+}
+
+// putVerification replaces the verification for an asset, with the result of the latest pull.
+func putVerification(tx *sqlx.Tx, aid uint64, v verification) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO asset_verifications (asset_id, sha256, signed_by) VALUES (?, ?, ?)`, aid, v.SHA256, v.SignedBy)
+	return err
+}
+
 func lookupAssetByRoot(tx *sqlx.Tx, root glfs.Ref) (uint64, error) {
 	data, err := json.Marshal(root)
 	if err != nil {
@@ -193,3 +219,15 @@ func lookupAssetByRoot(tx *sqlx.Tx, root glfs.Ref) (uint64, error) {
 	err = tx.Get(&aid, `SELECT id FROM assets WHERE root = ?`, data)
 	return aid, err
 }
+
+// lookupAssetsByRoot returns all the assets with root.
+// The same content may have been pulled from more than one upstream, or also be local.
+func lookupAssetsByRoot(tx *sqlx.Tx, root glfs.Ref) ([]uint64, error) {
+	data, err := json.Marshal(root)
+	if err != nil {
+		return nil, err
+	}
+	var aids []uint64
+	err = tx.Select(&aids, `SELECT id FROM assets WHERE root = ?`, data)
+	return aids, err
+}
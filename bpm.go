@@ -44,4 +44,21 @@ type Manifest map[string]DeploySpec
 type DeploySpec struct {
 	Source sources.URL `json:"source"`
 	Query  string      `json:"query"`
+
+	// CID, if set, is the expected glfs root of the asset.
+	CID cadata.ID `json:"cid,omitempty"`
+	// SHA256, if set, is the expected hex encoded sha256 of the file for the asset, before it is unpacked.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// PullOptions returns the options for Pull which check the pins in the spec
+func (s DeploySpec) PullOptions() []PullOption {
+	var opts []PullOption
+	if !s.CID.IsZero() {
+		opts = append(opts, ExpectCID(s.CID))
+	}
+	if s.SHA256 != "" {
+		opts = append(opts, ExpectSHA256(s.SHA256))
+	}
+	return opts
 }
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/blobcache/bpm/sources"
+	"github.com/blobcache/bpm"
 	"github.com/blobcache/glfs"
 	"github.com/spf13/cobra"
 )
@@ -14,23 +14,37 @@ func newInstallCmd(ctx context.Context) *cobra.Command {
 	c := &cobra.Command{
 		Use:   "install <name> <source> <query>",
 		Short: "install takes a source and query, resolves it to a package and then deploys it",
-		Args:  cobra.ExactArgs(2),
+		Args:  cobra.RangeArgs(2, 3),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			p := getRepoPath()
 			return loadRepo(ctx, p)
 		},
 	}
 	idstr := c.Flags().String("id", "", "--id=remote-asset-id-1234")
+	cidstr := c.Flags().String("cid", "", "the expected glfs root of the asset, the install fails if it differs")
+	sha256 := c.Flags().String("sha256", "", "the expected sha256 of the file for the asset, before it is unpacked")
 	c.RunE = func(cmd *cobra.Command, args []string) error {
 		path := args[0]
-		sourceURL, err := sources.ParseURL(args[1])
+		sourceURL, err := repo.ParseSourceURL(args[1])
 		if err != nil {
 			return err
 		}
-		if *idstr == "" {
-			return errors.New("must provide --id flag")
+		spec := bpm.DeploySpec{Source: *sourceURL, SHA256: *sha256}
+		if *cidstr != "" {
+			if err := spec.CID.UnmarshalBase64([]byte(*cidstr)); err != nil {
+				return fmt.Errorf("parsing --cid: %w", err)
+			}
+		}
+		var assetID uint64
+		switch {
+		case *idstr != "":
+			assetID, err = repo.Pull(ctx, *sourceURL, *idstr, spec.PullOptions()...)
+		case len(args) > 2:
+			spec.Query = args[2]
+			assetID, err = repo.Resolve(ctx, spec)
+		default:
+			return errors.New("must provide a query or the --id flag")
 		}
-		assetID, err := repo.Pull(ctx, *sourceURL, *idstr)
 		if err != nil {
 			return err
 		}
@@ -11,11 +11,11 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/blobcache/bpm"
-	"github.com/blobcache/bpm/sources"
 )
 
 var (
-	repo *bpm.Repo
+	repo    *bpm.Repo
+	offline bool
 )
 
 // NewCmd creates a new root command
@@ -24,11 +24,13 @@ func NewCmd(ctx context.Context) *cobra.Command {
 		Use:   "bpm",
 		Short: "bpm is a package manager",
 	}
+	c.PersistentFlags().BoolVar(&offline, "offline", false, "--offline disables all network access, only metadata and assets already in the repo are used")
 	for _, child := range []*cobra.Command{
 		// repo
 		newInitCmd(ctx),
 		newStatusCmd(ctx),
 
+		newSourcesCmd(ctx),
 		newFetchCmd(ctx),
 		newFetchAllCmd(ctx),
 		newSearchCmd(ctx),
@@ -96,7 +98,7 @@ func newGetCmd(ctx context.Context) *cobra.Command {
 			return loadRepo(ctx, p)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			sourceURL, err := sources.ParseURL(args[0])
+			sourceURL, err := repo.ParseSourceURL(args[0])
 			if err != nil {
 				return err
 			}
@@ -112,7 +114,7 @@ func newGetCmd(ctx context.Context) *cobra.Command {
 }
 
 func loadRepo(ctx context.Context, p string) error {
-	r, err := bpm.Open(p)
+	r, err := bpm.Open(p, bpm.WithOffline(offline))
 	if err != nil {
 		return err
 	}
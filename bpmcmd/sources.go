@@ -4,9 +4,15 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/blobcache/bpm/sources"
+	"github.com/blobcache/bpm"
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/sources/execsource"
 	"github.com/brendoncarroll/stdctx/logctx"
 	"github.com/itchyny/gojq"
 	"github.com/spf13/cobra"
@@ -18,12 +24,15 @@ func newSearchCmd(ctx context.Context) *cobra.Command {
 		Short: "search a source for a package",
 		Args:  cobra.MinimumNArgs(1),
 	}
-	shouldFetch := c.Flags().Bool("fetch", false, "--fetch")
+	shouldFetch := c.Flags().Bool("fetch", false, "--fetch fetches the source, even if its metadata is not stale")
+	sortBy := c.Flags().String("sort", "", "--sort=<label> sorts by a label, or --sort=-<label> for descending order")
+	limit := c.Flags().Int("limit", 0, "--limit=<n> prints at most n assets")
+	includeGone := c.Flags().Bool("include-gone", false, "--include-gone includes assets which are gone upstream")
 	c.RunE = func(cmd *cobra.Command, args []string) error {
 		if err := loadRepo(ctx, getRepoPath()); err != nil {
 			return err
 		}
-		srcURL, err := sources.ParseURL(args[0])
+		srcURL, err := repo.ParseSourceURL(args[0])
 		if err != nil {
 			return err
 		}
@@ -32,6 +41,8 @@ func newSearchCmd(ctx context.Context) *cobra.Command {
 			if err := repo.Fetch(ctx, *srcURL); err != nil {
 				return err
 			}
+		} else if err := repo.EnsureFresh(ctx, *srcURL); err != nil {
+			return err
 		}
 		// where clause
 		jqpred, err := gojq.Parse("true")
@@ -49,10 +60,27 @@ func newSearchCmd(ctx context.Context) *cobra.Command {
 			return err
 		}
 
-		assets, err := repo.ListAssetsBySource(ctx, srcURL, jqcode)
+		var listOpts []bpm.ListOption
+		if *includeGone {
+			listOpts = append(listOpts, bpm.IncludeGone())
+		}
+		assets, err := repo.ListAssetsBySource(ctx, srcURL, jqcode, listOpts...)
 		if err != nil {
 			return err
 		}
+		if *sortBy != "" {
+			k, desc := strings.CutPrefix(*sortBy, "-")
+			sort.SliceStable(assets, func(i, j int) bool {
+				c := bpmmd.CompareValues(assets[i].Labels[k], assets[j].Labels[k])
+				if desc {
+					return c > 0
+				}
+				return c < 0
+			})
+		}
+		if *limit > 0 && len(assets) > *limit {
+			assets = assets[:*limit]
+		}
 		bufw := bufio.NewWriter(cmd.OutOrStdout())
 		fmtStr := "%-3s %-25s %s\n"
 		fmt.Fprintf(bufw, fmtStr, "#", "ID", "LABELS")
@@ -72,21 +100,24 @@ func newSearchCmd(ctx context.Context) *cobra.Command {
 }
 
 func newFetchCmd(ctx context.Context) *cobra.Command {
-	return &cobra.Command{
+	var opts map[string]string
+	c := &cobra.Command{
 		Use:   "fetch",
 		Short: "download asset metadata from a source",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			u, err := sources.ParseURL(args[0])
-			if err != nil {
+			if err := loadRepo(ctx, getRepoPath()); err != nil {
 				return err
 			}
-			if err := loadRepo(ctx, getRepoPath()); err != nil {
+			u, err := repo.ParseSourceURL(args[0])
+			if err != nil {
 				return err
 			}
-			return repo.Fetch(ctx, *u)
+			return repo.FetchWithOptions(ctx, *u, opts)
 		},
 	}
+	c.Flags().StringToStringVar(&opts, "opt", nil, "source specific options, as key=value")
+	return c
 }
 
 func newFetchAllCmd(ctx context.Context) *cobra.Command {
@@ -97,7 +128,80 @@ func newFetchAllCmd(ctx context.Context) *cobra.Command {
 			if err := loadRepo(ctx, getRepoPath()); err != nil {
 				return err
 			}
-			return repo.FetchAll(ctx)
+			statuses, err := repo.FetchAll(ctx)
+			if err2 := printSourceStatus(cmd.OutOrStdout(), statuses); err2 != nil {
+				return err2
+			}
+			return err
 		},
 	}
 }
+
+func newSourcesCmd(ctx context.Context) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "sources",
+		Short: "lists the sources which have been fetched, and the outcome of their last fetch",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadRepo(ctx, getRepoPath()); err != nil {
+				return err
+			}
+			statuses, err := repo.ListSourceStatus(ctx)
+			if err != nil {
+				return err
+			}
+			return printSourceStatus(cmd.OutOrStdout(), statuses)
+		},
+	}
+	c.AddCommand(newSchemesCmd(ctx))
+	return c
+}
+
+func newSchemesCmd(ctx context.Context) *cobra.Command {
+	return &cobra.Command{
+		Use:   "schemes",
+		Short: "lists the available source schemes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadRepo(ctx, getRepoPath()); err != nil {
+				return err
+			}
+			bufw := bufio.NewWriter(cmd.OutOrStdout())
+			fmtStr := "%-12s %s\n"
+			fmt.Fprintf(bufw, fmtStr, "SCHEME", "PROVIDER")
+			registered := map[string]bool{}
+			for _, scheme := range repo.Sources().Schemes() {
+				registered[scheme] = true
+				fmt.Fprintf(bufw, fmtStr, scheme, "registered")
+			}
+			programs := execsource.ListPrograms()
+			var schemes []string
+			for scheme := range programs {
+				if !registered[scheme] {
+					schemes = append(schemes, scheme)
+				}
+			}
+			sort.Strings(schemes)
+			for _, scheme := range schemes {
+				fmt.Fprintf(bufw, fmtStr, scheme, programs[scheme])
+			}
+			return bufw.Flush()
+		},
+	}
+}
+
+func printSourceStatus(w io.Writer, statuses []bpm.SourceStatus) error {
+	bufw := bufio.NewWriter(w)
+	fmtStr := "%-40s %-20s %-20s %-7s %s\n"
+	fmt.Fprintf(bufw, fmtStr, "SOURCE", "LAST ATTEMPT", "LAST SUCCESS", "ASSETS", "ERROR")
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+	for _, st := range statuses {
+		fmt.Fprintf(bufw, fmtStr, st.URL.String(), formatTime(st.LastAttempt), formatTime(st.LastSuccess), strconv.Itoa(st.AssetCount), st.LastError)
+	}
+	return bufw.Flush()
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/brendoncarroll/go-tai64"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
+	"golang.org/x/mod/semver"
 )
 
 type Label struct {
@@ -47,6 +49,28 @@ func (l Label) SemVer() (*SemVer, error) {
 	return ParseSemVer(l.Value)
 }
 
+// CompareValues orders two label values.
+// Integers, including TAI64 timestamps, are compared numerically, and semantic versions are compared by precedence.
+// Anything else is compared as a string.
+func CompareValues(a, b string) int {
+	if x, err := strconv.ParseUint(a, 10, 64); err == nil {
+		if y, err := strconv.ParseUint(b, 10, 64); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	if semver.IsValid(a) && semver.IsValid(b) {
+		return semver.Compare(a, b)
+	}
+	return strings.Compare(a, b)
+}
+
 func (l Label) String() string {
 	return fmt.Sprintf("(%s: %s)", l.Key, l.Value)
 }
@@ -61,6 +85,11 @@ func (s LabelSet) Put(x Label) {
 	s[x.Key] = s[x.Value]
 }
 
+// PutTAI64 sets k to the time t, formatted so that it can be read with Label.TAI64
+func (s LabelSet) PutTAI64(k string, t time.Time) {
+	s[k] = strconv.FormatUint(uint64(tai64.FromGoTime(t).TAI64()), 10)
+}
+
 func (s LabelSet) String() string {
 	sb := strings.Builder{}
 	sb.WriteString("{")
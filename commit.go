@@ -59,7 +59,16 @@ func (r *Repo) ListCommits(ctx context.Context) ([]Commit, error) {
 }
 
 // Deploy creates a new commit, and deploys the snapshot to the filesystem
+// Every asset in the snapshot is checked against the policies for its source first,
+// and no commit is made if any of them fail, see Policy.
 func (r *Repo) Deploy(ctx context.Context, id SnapshotID) (*Commit, error) {
+	snap, err := r.GetSnapshot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkPolicies(ctx, snap.TLDs); err != nil {
+		return nil, err
+	}
 	next, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (*Commit, error) {
 		sIntID, err := lookupSnapshotIntID(tx, id)
 		if err != nil {
@@ -74,10 +83,6 @@ func (r *Repo) Deploy(ctx context.Context, id SnapshotID) (*Commit, error) {
 	if err != nil {
 		return nil, err
 	}
-	snap, err := r.GetSnapshot(ctx, next.Snapshot)
-	if err != nil {
-		return nil, err
-	}
 	if err := r.actualize(ctx, snap.TLDs); err != nil {
 		return nil, err
 	}
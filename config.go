@@ -0,0 +1,178 @@
+package bpm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+// configPath is the path of the config file, relative to the repo
+const configPath = bpmPath + "/config.json"
+
+// Config is the configuration for a repo, stored in .bpm/config.json
+type Config struct {
+	// Sources are named sources, the names can be used in place of a URL.
+	Sources map[string]SourceConfig `json:"sources,omitempty"`
+	// MetadataTTL is the default metadata TTL for all sources, as parsed by time.ParseDuration.
+	MetadataTTL string `json:"metadata_ttl,omitempty"`
+	// Policies apply to every source with a scheme, by scheme e.g. "github".
+	// They are checked along with the policy for each source.
+	Policies map[string]Policy `json:"policies,omitempty"`
+}
+
+// SourceConfig configures a named source
+type SourceConfig struct {
+	URL string `json:"url"`
+	// Options are passed to the source, see sources.Params.
+	Options map[string]string `json:"options,omitempty"`
+	// MetadataTTL overrides the TTL from the Config, as parsed by time.ParseDuration.
+	MetadataTTL string `json:"metadata_ttl,omitempty"`
+	// Mirrors are tried in order when pulling, before the source itself.
+	// See WithMirrors.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// TrustedKeys are the keys which may sign assets from the source.
+	// Each is a minisign, SSH or armored OpenPGP public key, or the absolute path of a file containing one.
+	TrustedKeys []string `json:"trusted_keys,omitempty"`
+	// RequireSignature rejects assets which are not signed by one of the TrustedKeys.
+	RequireSignature bool `json:"require_signature,omitempty"`
+	// Policy is checked for every asset from the source when it is deployed.
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// LoadConfig reads the config for the repo in the directory at p.
+// If there is no config file, the zero Config is returned.
+func LoadConfig(p string) (*Config, error) {
+	data, err := os.ReadFile(filepath.Join(p, configPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate returns an error if the config is invalid
+func (c *Config) Validate() error {
+	if c.MetadataTTL != "" {
+		if _, err := time.ParseDuration(c.MetadataTTL); err != nil {
+			return fmt.Errorf("config: metadata_ttl: %w", err)
+		}
+	}
+	for scheme, p := range c.Policies {
+		if scheme == "" || strings.Contains(scheme, ":") {
+			return fmt.Errorf("config: invalid scheme %q in policies", scheme)
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("config: policy for %q: %w", scheme, err)
+		}
+	}
+	seen := map[sources.URL]string{}
+	for name, sc := range c.Sources {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("config: invalid source name %q, names cannot contain ':'", name)
+		}
+		u, err := sources.ParseURL(sc.URL)
+		if err != nil {
+			return fmt.Errorf("config: source %q: %w", name, err)
+		}
+		if other, exists := seen[*u]; exists {
+			return fmt.Errorf("config: sources %q and %q are both %v", other, name, u)
+		}
+		seen[*u] = name
+		if sc.MetadataTTL != "" {
+			if _, err := time.ParseDuration(sc.MetadataTTL); err != nil {
+				return fmt.Errorf("config: source %q: metadata_ttl: %w", name, err)
+			}
+		}
+		for _, m := range sc.Mirrors {
+			if err := validateMirror(m); err != nil {
+				return fmt.Errorf("config: source %q: %w", name, err)
+			}
+		}
+		if _, err := parseTrustedKeys(sc.TrustedKeys); err != nil {
+			return fmt.Errorf("config: source %q: trusted_keys: %w", name, err)
+		}
+		if sc.RequireSignature && len(sc.TrustedKeys) == 0 {
+			return fmt.Errorf("config: source %q: require_signature needs trusted_keys", name)
+		}
+		if sc.Policy != nil {
+			if err := sc.Policy.Validate(); err != nil {
+				return fmt.Errorf("config: source %q: policy: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WithConfig configures the Repo from c, which must be valid.
+// The sources in c can be referred to by name with ParseSourceURL, and their options are used whenever they are made.
+// Options after WithConfig override the TTLs, mirrors, trusted keys and policies from c.
+func WithConfig(c *Config) Option {
+	return func(r *Repo) {
+		r.config = c
+		if d, err := time.ParseDuration(c.MetadataTTL); err == nil {
+			r.ttl = d
+		}
+		for _, sc := range c.Sources {
+			u, err := sources.ParseURL(sc.URL)
+			if err != nil {
+				continue
+			}
+			r.sourceOpts[*u] = sc.Options
+			if len(sc.Mirrors) > 0 {
+				r.sourceMirrors[*u] = sc.Mirrors
+			}
+			if d, err := time.ParseDuration(sc.MetadataTTL); err == nil {
+				r.sourceTTLs[*u] = d
+			}
+			if keys, err := parseTrustedKeys(sc.TrustedKeys); err == nil && len(keys) > 0 {
+				r.sigPolicies[*u] = sigPolicy{keys: keys, require: sc.RequireSignature}
+			}
+			if sc.Policy != nil {
+				r.sourcePolicies[*u] = *sc.Policy
+			}
+		}
+	}
+}
+
+// ParseSourceURL parses x as the name of a source in the config, or as a source URL.
+// URLs always contain ':', and names never do.
+func (r *Repo) ParseSourceURL(x string) (*sources.URL, error) {
+	if strings.Contains(x, ":") {
+		return sources.ParseURL(x)
+	}
+	sc, ok := r.config.Sources[x]
+	if !ok {
+		return nil, fmt.Errorf("no source named %q in %s", x, configPath)
+	}
+	return sources.ParseURL(sc.URL)
+}
+
+// mergeSourceOptions returns the options for the source at u from the config, overridden by opts.
+func (r *Repo) mergeSourceOptions(u sources.URL, opts map[string]string) map[string]string {
+	fromConfig := r.sourceOpts[u]
+	if len(fromConfig) == 0 {
+		return opts
+	}
+	ret := make(map[string]string, len(fromConfig)+len(opts))
+	for k, v := range fromConfig {
+		ret[k] = v
+	}
+	for k, v := range opts {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,131 @@
+// Package checksum parses published checksum files, and verifies content against them.
+package checksum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ErrMismatch is returned when content does not have the expected hash
+var ErrMismatch = errors.New("checksum: sha256 mismatch")
+
+// MaxFileSize limits the size of a checksum file
+const MaxFileSize = 1 << 20
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// IsSHA256 returns true if x is a hex encoded sha256 hash
+func IsSHA256(x string) bool {
+	return sha256Regexp.MatchString(x)
+}
+
+// IsSumsFile returns true if name looks like a file with checksums for other files,
+// such as SHA256SUMS or checksums.txt
+func IsSumsFile(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range []string{"sha256sums", "sha256sums.txt", "checksums.txt", "checksums.sha256"} {
+		if name == suffix || strings.HasSuffix(name, "_"+suffix) || strings.HasSuffix(name, "-"+suffix) || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SidecarTarget returns the name of the file which a per-file checksum, such as tool.tar.gz.sha256, is for.
+func SidecarTarget(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".sha256", ".sha256sum"} {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)], true
+		}
+	}
+	return "", false
+}
+
+// Parse parses sha256 checksums in the format written by sha256sum, or in the BSD format written by shasum --tag.
+// The hashes are returned by filename, in lower case.
+// A line with only a hash, as in some per-file checksums, has the empty filename.
+// Lines with other kinds of hashes are ignored.
+func Parse(data []byte) map[string]string {
+	ret := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// BSD format: SHA256 (name) = hash
+		if rest, ok := strings.CutPrefix(line, "SHA256 ("); ok {
+			name, sum, ok := strings.Cut(rest, ") = ")
+			if ok && IsSHA256(sum) {
+				ret[name] = strings.ToLower(sum)
+			}
+			continue
+		}
+		sum, name, _ := strings.Cut(line, " ")
+		if !IsSHA256(sum) {
+			continue
+		}
+		// a '*' marks binary mode
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		name = strings.TrimPrefix(name, "./")
+		ret[name] = strings.ToLower(sum)
+	}
+	return ret
+}
+
+// Verify reads all of r into a temporary file, and checks that it has the sha256 hash want.
+// If want is empty, the content is not checked.
+// The returned file is positioned at the start, and is removed when it is closed.
+// If the hash does not match, an error wrapping ErrMismatch is returned.
+func Verify(r io.Reader, want string) (io.ReadSeekCloser, error) {
+	f, err := os.CreateTemp("", "bpm-verify-*")
+	if err != nil {
+		return nil, err
+	}
+	tf := &tempFile{File: f}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	if have := hex.EncodeToString(h.Sum(nil)); want != "" && !strings.EqualFold(have, want) {
+		tf.Close()
+		return nil, fmt.Errorf("%w: have %s, expected %s", ErrMismatch, have, want)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	return tf, nil
+}
+
+// SHA256 returns the hex encoded sha256 hash of everything in r
+func SHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tempFile is removed when it is closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if err2 := os.Remove(f.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("B", 64)
+	c := strings.Repeat("c", 64)
+	data := "# comment\n" +
+		a + "  tool-linux-amd64.tar.gz\n" +
+		b + " *./tool-darwin-arm64.zip\n" +
+		"SHA256 (tool.exe) = " + c + "\n" +
+		strings.Repeat("d", 40) + "  sha1-only\n"
+	require.Equal(t, map[string]string{
+		"tool-linux-amd64.tar.gz": a,
+		"tool-darwin-arm64.zip":   strings.ToLower(b),
+		"tool.exe":                c,
+	}, Parse([]byte(data)))
+
+	// a per-file checksum may be only the hash
+	require.Equal(t, map[string]string{"": a}, Parse([]byte(a+"\n")))
+}
+
+func TestNames(t *testing.T) {
+	for _, name := range []string{"SHA256SUMS", "sha256sums.txt", "checksums.txt", "tool_1.0.0_checksums.txt", "tool-1.0.0-SHA256SUMS"} {
+		require.True(t, IsSumsFile(name), name)
+	}
+	for _, name := range []string{"tool.tar.gz", "checksums.txt.sig", "mychecksums.txt"} {
+		require.False(t, IsSumsFile(name), name)
+	}
+	target, ok := SidecarTarget("tool.tar.gz.sha256")
+	require.True(t, ok)
+	require.Equal(t, "tool.tar.gz", target)
+	_, ok = SidecarTarget("tool.tar.gz")
+	require.False(t, ok)
+}
+
+func TestVerify(t *testing.T) {
+	sum := sha256.Sum256([]byte("content"))
+	rc, err := Verify(strings.NewReader("content"), hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+	require.NoError(t, rc.Close())
+
+	_, err = Verify(strings.NewReader("tampered"), hex.EncodeToString(sum[:]))
+	require.ErrorIs(t, err, ErrMismatch)
+}
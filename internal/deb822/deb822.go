@@ -0,0 +1,57 @@
+// Package deb822 parses the control file format used by Debian packages and repositories.
+package deb822
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Paragraph is a single stanza of a deb822 control file.
+// Keys are stored as they appear in the file.
+type Paragraph map[string]string
+
+// ReadParagraphs calls fn for each paragraph in r.
+// Continuation lines are joined to their field with newlines.
+func ReadParagraphs(r io.Reader, fn func(Paragraph) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 1<<16), 1<<24)
+	para := Paragraph{}
+	var lastKey string
+	flush := func() error {
+		if len(para) == 0 {
+			return nil
+		}
+		err := fn(para)
+		para = Paragraph{}
+		lastKey = ""
+		return err
+	}
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if err := flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if lastKey == "" {
+				return fmt.Errorf("deb822: continuation line without field: %q", line)
+			}
+			para[lastKey] += "\n" + strings.TrimSpace(line)
+		default:
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				return fmt.Errorf("deb822: malformed field %q", line)
+			}
+			lastKey = k
+			para[k] = strings.TrimSpace(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,44 @@
+package deb822
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadParagraphs(t *testing.T) {
+	const x = `# a comment
+Package: hello
+Version: 2.10-3
+Description: example package
+ The GNU hello program.
+ .
+ It is an example.
+
+
+Package: sl
+Version:5.02-1
+`
+	var ps []Paragraph
+	require.NoError(t, ReadParagraphs(strings.NewReader(x), func(p Paragraph) error {
+		ps = append(ps, p)
+		return nil
+	}))
+	require.Equal(t, []Paragraph{
+		{
+			"Package":     "hello",
+			"Version":     "2.10-3",
+			"Description": "example package\nThe GNU hello program.\n.\nIt is an example.",
+		},
+		{
+			"Package": "sl",
+			"Version": "5.02-1",
+		},
+	}, ps)
+
+	for _, bad := range []string{" continued\n", "Package hello\n"} {
+		err := ReadParagraphs(strings.NewReader(bad), func(p Paragraph) error { return nil })
+		require.Error(t, err, bad)
+	}
+}
@@ -2,9 +2,12 @@ package porting
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/blobcache/glfs"
@@ -14,6 +17,9 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
+// ErrUnsafe is returned when a tree cannot be exported without writing outside of where it is exported to
+var ErrUnsafe = errors.New("porting: unsafe tree entry")
+
 type CacheEntry struct {
 	Ref        glfs.Ref
 	ModifiedAt time.Time
@@ -30,7 +36,7 @@ func (c NullCache) Get(ctx context.Context, p string) (*CacheEntry, error) {
 	return nil, nil
 }
 
-func (c NullCache) Put(ctx context.Context, p string, ent *CacheEntry) error {
+func (c NullCache) Put(ctx context.Context, p string, ent CacheEntry) error {
 	return nil
 }
 
@@ -54,14 +60,21 @@ func NewExporter(fs posixfs.FS, cache Cache, overwrite bool) *Exporter {
 	}
 }
 
+// Export writes the tree or blob at ref to p.
+// Entries are checked before they are written, and Export fails with ErrUnsafe for names which are not a single path component,
+// device nodes, and symlinks.
+// Only the permission bits of file modes are used, so setuid, setgid and sticky bits are never set on disk.
 func (e *Exporter) Export(ctx context.Context, s cadata.Store, p string, ref glfs.Ref) error {
+	if err := checkRoot(p); err != nil {
+		return err
+	}
 	if err := e.sem.Acquire(ctx, 1); err != nil {
 		return err
 	}
 	defer e.sem.Release(1)
 	switch ref.Type {
 	case glfs.TypeTree:
-		return e.exportTree(ctx, s, p, ref, 0o755)
+		return e.exportTree(ctx, s, p, "", ref, 0o755)
 	case glfs.TypeBlob:
 		return e.exportBlob(ctx, s, p, ref, 0o644)
 	default:
@@ -69,12 +82,19 @@ func (e *Exporter) Export(ctx context.Context, s cadata.Store, p string, ref glf
 	}
 }
 
-func (e *Exporter) exportTree(ctx context.Context, s cadata.Store, p string, ref glfs.Ref, mode posixfs.FileMode) error {
+// exportTree exports the tree at ref to path.Join(root, rel)
+func (e *Exporter) exportTree(ctx context.Context, s cadata.Store, root, rel string, ref glfs.Ref, mode posixfs.FileMode) error {
 	tree, err := e.fsop.GetTree(ctx, s, ref)
 	if err != nil {
 		return err
 	}
-	if err := posixfs.MkdirAll(e.fs, p, mode); err != nil {
+	for _, ent := range tree.Entries {
+		if err := e.checkEntry(rel, ent); err != nil {
+			return err
+		}
+	}
+	p := path.Join(root, rel)
+	if err := posixfs.MkdirAll(e.fs, p, mode.Perm()); err != nil {
 		return err
 	}
 	ctx, cf := context.WithCancel(ctx)
@@ -87,7 +107,7 @@ func (e *Exporter) exportTree(ctx context.Context, s cadata.Store, p string, ref
 			p2 := path.Join(p, ent.Name)
 			switch ent.Ref.Type {
 			case glfs.TypeTree:
-				return e.exportTree(ctx, s, p2, ent.Ref, ent.FileMode)
+				return e.exportTree(ctx, s, root, path.Join(rel, ent.Name), ent.Ref, ent.FileMode)
 			case glfs.TypeBlob:
 				return e.exportBlob(ctx, s, p2, ent.Ref, ent.FileMode)
 			default:
@@ -134,7 +154,7 @@ func (e *Exporter) exportBlob(ctx context.Context, s cadata.Store, p string, ref
 	} else {
 		flags |= posixfs.O_EXCL
 	}
-	f, err := e.fs.OpenFile(p, flags, mode)
+	f, err := e.fs.OpenFile(p, flags, mode.Perm())
 	if err != nil {
 		return err
 	}
@@ -154,6 +174,30 @@ func (e *Exporter) exportBlob(ctx context.Context, s cadata.Store, p string, ref
 	return e.cache.Put(ctx, p, CacheEntry{Ref: ref, ModifiedAt: finfo.ModTime()})
 }
 
+// checkRoot returns an error if p is not a relative path without any .. components
+func checkRoot(p string) error {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("%w: cannot export to %q", ErrUnsafe, p)
+	}
+	return nil
+}
+
+// checkEntry returns an error if ent, in the directory rel below the root of an export, is unsafe to write.
+func (e *Exporter) checkEntry(rel string, ent glfs.TreeEntry) error {
+	p := path.Join(rel, ent.Name)
+	if !glfs.IsValidName(ent.Name) || ent.Name == "." || ent.Name == ".." || strings.ContainsRune(ent.Name, 0) {
+		return fmt.Errorf("%w: invalid name %q in %q", ErrUnsafe, ent.Name, rel)
+	}
+	if ent.FileMode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		return fmt.Errorf("%w: %q is not a regular file", ErrUnsafe, p)
+	}
+	// the filesystem cannot create symlinks, and writing the target as a regular file would not be what the tree means
+	if ent.FileMode&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %q is a symlink, which cannot be exported", ErrUnsafe, p)
+	}
+	return nil
+}
+
 func deleteAll(ctx context.Context, fs posixfs.FS, p string) error {
 	finfo, err := fs.Stat(p)
 	if err != nil {
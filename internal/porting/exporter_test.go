@@ -0,0 +1,79 @@
+package porting
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/go-state/posixfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportUnsafe(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	blob := func(x string) glfs.Ref {
+		ref, err := op.PostBlob(ctx, s, strings.NewReader(x))
+		require.NoError(t, err)
+		return *ref
+	}
+	tree := func(ents ...glfs.TreeEntry) glfs.Ref {
+		ref, err := op.PostTree(ctx, s, glfs.Tree{Entries: ents})
+		require.NoError(t, err)
+		return *ref
+	}
+	tcs := []struct {
+		Name string
+		Root glfs.Ref
+	}{
+		{"parent", tree(glfs.TreeEntry{Name: "..", FileMode: 0o644, Ref: blob("x")})},
+		{"symlink parent", tree(glfs.TreeEntry{Name: "link", FileMode: os.ModeSymlink | 0o777, Ref: blob("../x")})},
+		{"nested symlink parent", tree(glfs.TreeEntry{Name: "dir", FileMode: os.ModeDir | 0o755, Ref: tree(
+			glfs.TreeEntry{Name: "link", FileMode: os.ModeSymlink | 0o777, Ref: blob("../../x")},
+		)})},
+		{"absolute symlink", tree(glfs.TreeEntry{Name: "link", FileMode: os.ModeSymlink | 0o777, Ref: blob("/etc/passwd")})},
+		{"symlink chain", tree(
+			glfs.TreeEntry{Name: "d", FileMode: os.ModeDir | 0o755, Ref: tree(
+				glfs.TreeEntry{Name: "up", FileMode: os.ModeSymlink | 0o777, Ref: blob("..")},
+			)},
+			glfs.TreeEntry{Name: "esc", FileMode: os.ModeSymlink | 0o777, Ref: blob("d/up/..")},
+		)},
+		{"symlink", tree(glfs.TreeEntry{Name: "link", FileMode: os.ModeSymlink | 0o777, Ref: blob("tool")})},
+		{"device", tree(glfs.TreeEntry{Name: "null", FileMode: os.ModeDevice | os.ModeCharDevice | 0o666, Ref: blob("")})},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			exp := NewExporter(posixfs.NewDirFS(dir), NullCache{}, true)
+			err := exp.Export(ctx, s, "tld", tc.Root)
+			require.ErrorIs(t, err, ErrUnsafe)
+		})
+	}
+
+	exp := NewExporter(posixfs.NewDirFS(t.TempDir()), NullCache{}, true)
+	require.ErrorIs(t, exp.Export(ctx, s, "../tld", tree()), ErrUnsafe)
+	require.ErrorIs(t, exp.Export(ctx, s, "/tld", tree()), ErrUnsafe)
+}
+
+func TestExportMode(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	ref, err := op.PostBlob(ctx, s, strings.NewReader("tool"))
+	require.NoError(t, err)
+	root, err := op.PostTree(ctx, s, glfs.Tree{Entries: []glfs.TreeEntry{
+		{Name: "tool", FileMode: os.ModeSetuid | os.ModeSetgid | 0o755, Ref: *ref},
+	}})
+	require.NoError(t, err)
+	dir := t.TempDir()
+	exp := NewExporter(posixfs.NewDirFS(dir), NullCache{}, true)
+	require.NoError(t, exp.Export(ctx, s, "tld", *root))
+	finfo, err := os.Stat(dir + "/tld/tool")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), finfo.Mode())
+}
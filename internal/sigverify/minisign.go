@@ -0,0 +1,105 @@
+package sigverify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign signature algorithms
+const (
+	minisignLegacy    = "Ed"
+	minisignPrehashed = "ED"
+)
+
+type minisignKey struct {
+	id  [8]byte
+	pub ed25519.PublicKey
+}
+
+func (k *minisignKey) Kind() Kind { return Minisign }
+
+// ID returns the key ID, as minisign prints it
+func (k *minisignKey) ID() string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(k.id[:]))
+}
+
+func parseMinisignKey(s string) (*minisignKey, error) {
+	lines := strings.Split(s, "\n")
+	if strings.HasPrefix(lines[0], "untrusted comment:") {
+		if len(lines) < 2 {
+			return nil, fmt.Errorf("sigverify: minisign key is missing")
+		}
+		lines = lines[1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("sigverify: parsing minisign key: %w", err)
+	}
+	if len(data) != 2+8+ed25519.PublicKeySize || string(data[:2]) != minisignLegacy {
+		return nil, fmt.Errorf("sigverify: invalid minisign key")
+	}
+	k := &minisignKey{pub: ed25519.PublicKey(data[10:])}
+	copy(k.id[:], data[2:10])
+	return k, nil
+}
+
+// verifyMinisign verifies a minisign signature, including the global signature over the trusted comment.
+func verifyMinisign(keys []Key, msg io.Reader, sig []byte) (Key, error) {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return nil, fmt.Errorf("%w: minisign signature is truncated", ErrBadSignature)
+	}
+	sigData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigData) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: malformed minisign signature", ErrBadSignature)
+	}
+	trustedComment, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return nil, fmt.Errorf("%w: minisign signature has no trusted comment", ErrBadSignature)
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: malformed minisign global signature", ErrBadSignature)
+	}
+	var key *minisignKey
+	for _, k := range keys {
+		mk := k.(*minisignKey)
+		if bytes.Equal(mk.id[:], sigData[2:10]) {
+			key = mk
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: signed by minisign key %016X", ErrUntrusted, binary.LittleEndian.Uint64(sigData[2:10]))
+	}
+
+	var signed []byte
+	switch alg := string(sigData[:2]); alg {
+	case minisignPrehashed:
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, msg); err != nil {
+			return nil, err
+		}
+		signed = h.Sum(nil)
+	case minisignLegacy:
+		if signed, err = io.ReadAll(msg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown minisign algorithm %q", ErrBadSignature, alg)
+	}
+	if !ed25519.Verify(key.pub, signed, sigData[10:]) {
+		return nil, ErrBadSignature
+	}
+	if !ed25519.Verify(key.pub, append(sigData[10:], trustedComment...), globalSig) {
+		return nil, fmt.Errorf("%w: trusted comment does not match", ErrBadSignature)
+	}
+	return key, nil
+}
@@ -0,0 +1,56 @@
+package sigverify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+type pgpKey struct {
+	entity *openpgp.Entity
+}
+
+func (k *pgpKey) Kind() Kind { return PGP }
+
+func (k *pgpKey) ID() string {
+	return fmt.Sprintf("%X", k.entity.PrimaryKey.Fingerprint)
+}
+
+func parsePGPKey(data []byte) (*pgpKey, error) {
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("sigverify: parsing OpenPGP key: %w", err)
+	}
+	if len(el) != 1 {
+		return nil, fmt.Errorf("sigverify: OpenPGP key block must contain exactly one key, have %d", len(el))
+	}
+	return &pgpKey{entity: el[0]}, nil
+}
+
+// verifyPGP verifies an armored or binary OpenPGP detached signature
+func verifyPGP(keys []Key, msg io.Reader, sig []byte) (Key, error) {
+	var ring openpgp.EntityList
+	for _, k := range keys {
+		ring = append(ring, k.(*pgpKey).entity)
+	}
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	signer, err := check(ring, msg, bytes.NewReader(sig), nil)
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return nil, fmt.Errorf("%w: no trusted OpenPGP key issued the signature", ErrUntrusted)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	for _, k := range keys {
+		if k.(*pgpKey).entity == signer {
+			return k, nil
+		}
+	}
+	return nil, ErrUntrusted
+}
@@ -0,0 +1,105 @@
+// Package sigverify verifies detached signatures made with minisign, SSH keys, or OpenPGP keys.
+package sigverify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrBadSignature is returned when a signature is malformed, or does not match the content.
+	ErrBadSignature = errors.New("sigverify: bad signature")
+	// ErrUntrusted is returned when a signature was not made by any of the trusted keys.
+	ErrUntrusted = errors.New("sigverify: signature is not from a trusted key")
+)
+
+// MaxSignatureSize limits the size of a detached signature
+const MaxSignatureSize = 64 << 10
+
+// Kind is a kind of key and signature
+type Kind string
+
+const (
+	Minisign = Kind("minisign")
+	SSH      = Kind("ssh")
+	PGP      = Kind("pgp")
+)
+
+// Key is a trusted public key
+type Key interface {
+	Kind() Kind
+	// ID identifies the key in labels and messages.
+	// It is the key ID for minisign, the SHA256 fingerprint for SSH, and the fingerprint for OpenPGP.
+	ID() string
+}
+
+// ParseKey parses a public key.
+// The kind of key is detected from its format:
+//   - a minisign public key, with or without the untrusted comment line
+//   - an SSH public key, as in authorized_keys
+//   - an armored OpenPGP public key block
+func ParseKey(data []byte) (Key, error) {
+	s := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(s, "-----BEGIN PGP PUBLIC KEY BLOCK-----"):
+		return parsePGPKey(data)
+	case strings.HasPrefix(s, "untrusted comment:"), strings.HasPrefix(s, "RW"):
+		return parseMinisignKey(s)
+	default:
+		return parseSSHKey(data)
+	}
+}
+
+// Verify checks that sig is a signature of msg by one of keys, and returns the key.
+// The kind of signature is detected from its format.
+// msg is read from the start.
+func Verify(keys []Key, msg io.ReadSeeker, sig []byte) (Key, error) {
+	if _, err := msg.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	kind := DetectKind(sig)
+	var trusted []Key
+	for _, k := range keys {
+		if k.Kind() == kind {
+			trusted = append(trusted, k)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%w: no %s keys are trusted", ErrUntrusted, kind)
+	}
+	switch kind {
+	case Minisign:
+		return verifyMinisign(trusted, msg, sig)
+	case SSH:
+		return verifySSH(trusted, msg, sig)
+	default:
+		return verifyPGP(trusted, msg, sig)
+	}
+}
+
+// DetectKind returns the kind of a detached signature from its format.
+// Anything which is not minisign or SSH is assumed to be OpenPGP, either armored or binary.
+func DetectKind(sig []byte) Kind {
+	sig = bytes.TrimSpace(sig)
+	switch {
+	case bytes.HasPrefix(sig, []byte("untrusted comment:")):
+		return Minisign
+	case bytes.HasPrefix(sig, []byte(sshSigArmorStart)):
+		return SSH
+	default:
+		return PGP
+	}
+}
+
+// IsSignatureFile returns the name of the file which a detached signature is for, if name looks like one.
+func IsSignatureFile(name string) (string, bool) {
+	for _, ext := range []string{".minisig", ".sig", ".asc"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,156 @@
+package sigverify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMinisign(t *testing.T) {
+	msg := []byte("release contents")
+	pub, sig := signMinisign(t, msg)
+	other, _ := signMinisign(t, msg)
+	key, err := ParseKey(pub)
+	require.NoError(t, err)
+	otherKey, err := ParseKey(other)
+	require.NoError(t, err)
+	require.Equal(t, Minisign, DetectKind(sig))
+
+	signer, err := Verify([]Key{otherKey, key}, bytes.NewReader(msg), sig)
+	require.NoError(t, err)
+	require.Equal(t, key.ID(), signer.ID())
+	require.Len(t, signer.ID(), 16)
+
+	_, err = Verify([]Key{key}, bytes.NewReader([]byte("tampered")), sig)
+	require.ErrorIs(t, err, ErrBadSignature)
+	_, err = Verify([]Key{otherKey}, bytes.NewReader(msg), sig)
+	require.ErrorIs(t, err, ErrUntrusted)
+}
+
+func TestSSH(t *testing.T) {
+	msg := []byte("release contents")
+	pub, sig := signSSH(t, msg)
+	key, err := ParseKey(pub)
+	require.NoError(t, err)
+	require.Equal(t, SSH, DetectKind(sig))
+
+	signer, err := Verify([]Key{key}, bytes.NewReader(msg), sig)
+	require.NoError(t, err)
+	require.Contains(t, signer.ID(), "SHA256:")
+
+	_, err = Verify([]Key{key}, bytes.NewReader([]byte("tampered")), sig)
+	require.ErrorIs(t, err, ErrBadSignature)
+	otherPub, _ := signSSH(t, msg)
+	otherKey, err := ParseKey(otherPub)
+	require.NoError(t, err)
+	_, err = Verify([]Key{otherKey}, bytes.NewReader(msg), sig)
+	require.ErrorIs(t, err, ErrUntrusted)
+}
+
+func TestPGP(t *testing.T) {
+	msg := []byte("release contents")
+	pub, sig := signPGP(t, msg)
+	key, err := ParseKey(pub)
+	require.NoError(t, err)
+	require.Equal(t, PGP, DetectKind(sig))
+
+	signer, err := Verify([]Key{key}, bytes.NewReader(msg), sig)
+	require.NoError(t, err)
+	require.Equal(t, key.ID(), signer.ID())
+
+	_, err = Verify([]Key{key}, bytes.NewReader([]byte("tampered")), sig)
+	require.ErrorIs(t, err, ErrBadSignature)
+	otherPub, _ := signPGP(t, msg)
+	otherKey, err := ParseKey(otherPub)
+	require.NoError(t, err)
+	_, err = Verify([]Key{otherKey}, bytes.NewReader(msg), sig)
+	require.ErrorIs(t, err, ErrUntrusted)
+}
+
+func TestNoKeysOfKind(t *testing.T) {
+	msg := []byte("release contents")
+	_, sig := signMinisign(t, msg)
+	sshPub, _ := signSSH(t, msg)
+	key, err := ParseKey(sshPub)
+	require.NoError(t, err)
+	_, err = Verify([]Key{key}, bytes.NewReader(msg), sig)
+	require.ErrorIs(t, err, ErrUntrusted)
+}
+
+func TestIsSignatureFile(t *testing.T) {
+	target, ok := IsSignatureFile("tool.tar.gz.minisig")
+	require.True(t, ok)
+	require.Equal(t, "tool.tar.gz", target)
+	_, ok = IsSignatureFile("tool.tar.gz")
+	require.False(t, ok)
+}
+
+// signMinisign returns a new minisign public key, and a prehashed signature of msg made with it.
+func signMinisign(t testing.TB, msg []byte) (pubFile, sigFile []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var id [8]byte
+	_, err = rand.Read(id[:])
+	require.NoError(t, err)
+	pubData := append(append([]byte(minisignLegacy), id[:]...), pub...)
+	pubFile = []byte("untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(pubData) + "\n")
+
+	h := blake2b.Sum512(msg)
+	sig := ed25519.Sign(priv, h[:])
+	sigData := append(append([]byte(minisignPrehashed), id[:]...), sig...)
+	comment := "timestamp:1700000000\tfile:tool"
+	global := ed25519.Sign(priv, append(sig, comment...))
+	sigFile = []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sigData), comment, base64.StdEncoding.EncodeToString(global)))
+	return pubFile, sigFile
+}
+
+// signSSH returns a new SSH public key, and a signature of msg made as ssh-keygen -Y sign -n file would.
+func signSSH(t testing.TB, msg []byte) (pubFile, sigFile []byte) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	h := sha512.Sum512(msg)
+	signed := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{sshSigNamespace, nil, "sha512", h[:]})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	require.NoError(t, err)
+	blob := append([]byte(sshSigMagic), ssh.Marshal(sshSignature{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	sigFile = []byte(sshSigArmorStart + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n" + sshSigArmorEnd + "\n")
+	return ssh.MarshalAuthorizedKey(signer.PublicKey()), sigFile
+}
+
+// signPGP returns a new armored OpenPGP public key, and an armored signature of msg made with it.
+func signPGP(t testing.TB, msg []byte) (pubFile, sigFile []byte) {
+	e, err := openpgp.NewEntity("releaser", "", "releaser@example.com", nil)
+	require.NoError(t, err)
+	var pub bytes.Buffer
+	w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, e.Serialize(w))
+	require.NoError(t, w.Close())
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.ArmoredDetachSign(&sig, e, bytes.NewReader(msg), nil))
+	return pub.Bytes(), sig.Bytes()
+}
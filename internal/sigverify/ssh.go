@@ -0,0 +1,124 @@
+package sigverify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSigArmorStart = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorEnd   = "-----END SSH SIGNATURE-----"
+	sshSigMagic      = "SSHSIG"
+	// sshSigNamespace is the namespace used by ssh-keygen -Y sign for files
+	sshSigNamespace = "file"
+)
+
+type sshKey struct {
+	pub ssh.PublicKey
+}
+
+func (k *sshKey) Kind() Kind { return SSH }
+
+func (k *sshKey) ID() string {
+	return ssh.FingerprintSHA256(k.pub)
+}
+
+func parseSSHKey(data []byte) (*sshKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("sigverify: parsing key: %w", err)
+	}
+	return &sshKey{pub: pub}, nil
+}
+
+// sshSignature is the blob in an armored SSH signature, as described in PROTOCOL.sshsig
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// verifySSH verifies a signature made with ssh-keygen -Y sign -n file
+func verifySSH(keys []Key, msg io.Reader, sig []byte) (Key, error) {
+	s := strings.TrimSpace(string(sig))
+	s = strings.TrimPrefix(s, sshSigArmorStart)
+	s, ok := strings.CutSuffix(s, sshSigArmorEnd)
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed SSH signature armor", ErrBadSignature)
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+		return nil, fmt.Errorf("%w: missing SSHSIG magic", ErrBadSignature)
+	}
+	var ss sshSignature
+	if err := ssh.Unmarshal(blob[len(sshSigMagic):], &ss); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if ss.Version != 1 {
+		return nil, fmt.Errorf("%w: unsupported SSH signature version %d", ErrBadSignature, ss.Version)
+	}
+	if ss.Namespace != sshSigNamespace {
+		return nil, fmt.Errorf("%w: SSH signature has namespace %q, expected %q", ErrBadSignature, ss.Namespace, sshSigNamespace)
+	}
+	var key *sshKey
+	for _, k := range keys {
+		sk := k.(*sshKey)
+		if bytes.Equal(sk.pub.Marshal(), ss.PublicKey) {
+			key = sk
+			break
+		}
+	}
+	if key == nil {
+		pub, err := ssh.ParsePublicKey(ss.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+		}
+		return nil, fmt.Errorf("%w: signed by SSH key %s", ErrUntrusted, ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch ss.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("%w: unsupported SSH signature hash %q", ErrBadSignature, ss.HashAlgorithm)
+	}
+	if _, err := io.Copy(h, msg); err != nil {
+		return nil, err
+	}
+	signed := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{ss.Namespace, ss.Reserved, ss.HashAlgorithm, h.Sum(nil)})...)
+
+	var wireSig struct {
+		Format string
+		Blob   []byte
+		Rest   []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(ss.Signature, &wireSig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if err := key.pub.Verify(signed, &ssh.Signature{Format: wireSig.Format, Blob: wireSig.Blob, Rest: wireSig.Rest}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return key, nil
+}
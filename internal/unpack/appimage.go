@@ -0,0 +1,40 @@
+package unpack
+
+import (
+	"context"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/sources"
+)
+
+// importAppImage imports an AppImage as a tree containing the executable.
+// An AppImage mounts its own filesystem when it is run, so it is kept whole, rather than extracted.
+func importAppImage(ctx context.Context, op *glfs.Operator, s cadata.Poster, filename string, header []byte, r io.Reader) (*sources.PullResult, error) {
+	name := path.Base(filename)
+	if filename == "" || name == "." || name == "/" {
+		name = "app.AppImage"
+	}
+	ref, err := op.PostBlob(ctx, s, r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := op.PostTreeFromEntries(ctx, s, []glfs.TreeEntry{
+		{Name: name, FileMode: 0o755, Ref: *ref},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sources.PullResult{
+		Root: *root,
+		Labels: bpmmd.LabelSet{
+			"package_format":   "appimage",
+			"appimage_version": strconv.Itoa(int(header[10])),
+		},
+	}, nil
+}
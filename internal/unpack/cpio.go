@@ -0,0 +1,163 @@
+package unpack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+)
+
+const (
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+	// maxCPIONameSize limits the length of a path in a cpio archive
+	maxCPIONameSize = 4096
+)
+
+// file types from the mode field of a cpio header
+const (
+	cpioTypeMask    = 0o170000
+	cpioTypeDir     = 0o040000
+	cpioTypeReg     = 0o100000
+	cpioTypeSymlink = 0o120000
+	cpioTypeChar    = 0o020000
+	cpioTypeBlock   = 0o060000
+)
+
+// cpioHeader is a header in the "newc" cpio format, which is used by rpm.
+type cpioHeader struct {
+	Ino      uint64
+	Mode     uint64
+	NLink    uint64
+	FileSize int64
+	DevMajor uint64
+	DevMinor uint64
+	Name     string
+}
+
+// importCPIO imports a cpio archive in the "newc" format.
+func (c *config) importCPIO(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*glfs.Ref, error) {
+	br := bufio.NewReader(r)
+	b := newBuilder()
+	// hard links are stored with the data on the last entry, so earlier links are filled in once it is reached
+	type inode struct{ dev, ino uint64 }
+	pending := map[inode][]string{}
+	for {
+		h, err := readCPIOHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		if h.Name == cpioTrailer {
+			break
+		}
+		data := io.LimitReader(br, h.FileSize)
+		p, err := c.path(h.Name)
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(h.Mode).Perm()
+		switch {
+		case p == "":
+		case h.Mode&cpioTypeMask == cpioTypeDir:
+			err = b.putDir(ctx, op, s, p, mode)
+		case h.Mode&cpioTypeMask == cpioTypeSymlink:
+			target, err2 := readLinkTarget(p, data)
+			if err2 != nil {
+				return nil, err2
+			}
+			err = b.putSymlink(ctx, op, s, p, mode, target)
+		case h.Mode&cpioTypeMask == cpioTypeChar, h.Mode&cpioTypeMask == cpioTypeBlock:
+			return nil, fmt.Errorf("%w: %q is a device", ErrUnsafe, h.Name)
+		case h.Mode&cpioTypeMask == cpioTypeReg:
+			key := inode{h.DevMajor<<32 | h.DevMinor, h.Ino}
+			if h.NLink > 1 && h.FileSize == 0 {
+				pending[key] = append(pending[key], p)
+				continue
+			}
+			if err = b.putFile(ctx, op, s, p, mode, data); err != nil {
+				return nil, err
+			}
+			for _, p2 := range pending[key] {
+				if err := b.putLink(p2, p); err != nil {
+					return nil, err
+				}
+			}
+			delete(pending, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// skip anything which was not read, and the padding to 4 bytes
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(int(pad4(h.FileSize))); err != nil {
+			return nil, err
+		}
+	}
+	// links without any data are empty files
+	for _, ps := range pending {
+		for _, p := range ps {
+			if err := b.putFile(ctx, op, s, p, 0o644, strings.NewReader("")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.finish(ctx, op, s)
+}
+
+func readCPIOHeader(br *bufio.Reader) (*cpioHeader, error) {
+	var raw [cpioHeaderSize]byte
+	if _, err := io.ReadFull(br, raw[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("unpack: truncated cpio archive")
+		}
+		return nil, err
+	}
+	switch magic := string(raw[:6]); magic {
+	case "070701", "070702":
+	default:
+		return nil, fmt.Errorf("unpack: unsupported cpio format %q", magic)
+	}
+	// the fields are 8 hex digits each
+	var fields [13]uint64
+	for i := range fields {
+		x, err := strconv.ParseUint(string(raw[6+i*8:6+(i+1)*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unpack: malformed cpio header: %w", err)
+		}
+		fields[i] = x
+	}
+	nameSize := int64(fields[11])
+	if nameSize == 0 || nameSize > maxCPIONameSize {
+		return nil, fmt.Errorf("unpack: cpio name size %d out of range", nameSize)
+	}
+	name := make([]byte, nameSize)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, err
+	}
+	if _, err := br.Discard(int(pad4(cpioHeaderSize + nameSize))); err != nil {
+		return nil, err
+	}
+	return &cpioHeader{
+		Ino:      fields[0],
+		Mode:     fields[1],
+		NLink:    fields[4],
+		FileSize: int64(fields[6]),
+		DevMajor: fields[7],
+		DevMinor: fields[8],
+		Name:     strings.TrimRight(string(name), "\x00"),
+	}, nil
+}
+
+// pad4 returns the number of bytes needed to pad n to a multiple of 4
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
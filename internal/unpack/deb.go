@@ -0,0 +1,171 @@
+package unpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/deb822"
+	"github.com/blobcache/bpm/sources"
+)
+
+const arMagic = "!<arch>\n"
+
+// maxControlSize is the largest control file which will be read from a package
+const maxControlSize = 1 << 20
+
+// arReader reads the members of a Unix ar archive, as used by .deb packages.
+type arReader struct {
+	r   *bufio.Reader
+	cur io.Reader
+	pad int64
+}
+
+func newARReader(r io.Reader) (*arReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != arMagic {
+		return nil, errors.New("unpack: not an ar archive")
+	}
+	return &arReader{r: br}, nil
+}
+
+// Next advances to the next member, and returns its name.
+func (ar *arReader) Next() (string, error) {
+	if ar.cur != nil {
+		if _, err := io.Copy(io.Discard, ar.cur); err != nil {
+			return "", err
+		}
+		if _, err := ar.r.Discard(int(ar.pad)); err != nil {
+			return "", err
+		}
+	}
+	var hdr [60]byte
+	if _, err := io.ReadFull(ar.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("unpack: truncated ar header")
+		}
+		return "", err
+	}
+	if string(hdr[58:60]) != "`\n" {
+		return "", errors.New("unpack: malformed ar header")
+	}
+	name := strings.TrimRight(strings.TrimSpace(string(hdr[0:16])), "/")
+	size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unpack: bad ar member size: %w", err)
+	}
+	ar.cur = io.LimitReader(ar.r, size)
+	ar.pad = size % 2
+	return name, nil
+}
+
+func (ar *arReader) Read(buf []byte) (int, error) {
+	if ar.cur == nil {
+		return 0, io.EOF
+	}
+	return ar.cur.Read(buf)
+}
+
+// importDeb imports the data.tar.* member of a .deb package, with labels from the control file in control.tar.*
+func (c *config) importDeb(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*sources.PullResult, error) {
+	ar, err := newARReader(r)
+	if err != nil {
+		return nil, err
+	}
+	labels := bpmmd.LabelSet{"package_format": "deb"}
+	for {
+		name, err := ar.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("unpack: package does not contain data.tar")
+			}
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(name, "control.tar"):
+			ctrl, err := readDebControl(ar)
+			if err != nil {
+				return nil, err
+			}
+			addDebLabels(labels, ctrl)
+		case strings.HasPrefix(name, "data.tar"):
+			res, err := c.importFile(ctx, op, s, name, ar)
+			if err != nil {
+				return nil, err
+			}
+			res.Labels = labels
+			return res, nil
+		}
+	}
+}
+
+// readDebControl reads the control file from a control.tar.* member
+func readDebControl(r io.Reader) (deb822.Paragraph, error) {
+	dr, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("unpack: control.tar does not contain control")
+			}
+			return nil, err
+		}
+		if glfs.CleanPath(th.Name) != "control" || th.Typeflag != tar.TypeReg {
+			continue
+		}
+		if th.Size > maxControlSize {
+			return nil, fmt.Errorf("unpack: control file exceeds maximum size %d", maxControlSize)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		var ret deb822.Paragraph
+		if err := deb822.ReadParagraphs(bytes.NewReader(data), func(p deb822.Paragraph) error {
+			if ret == nil {
+				ret = p
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+}
+
+func addDebLabels(l bpmmd.LabelSet, p deb822.Paragraph) {
+	for label, field := range map[string]string{
+		"package_name":       "Package",
+		"package_version":    "Version",
+		"package_arch":       "Architecture",
+		"package_depends":    "Depends",
+		"package_maintainer": "Maintainer",
+		"package_homepage":   "Homepage",
+	} {
+		if v, ok := p[field]; ok {
+			l[label] = v
+		}
+	}
+	if desc, ok := p["Description"]; ok {
+		l["package_description"], _, _ = strings.Cut(desc, "\n")
+	}
+}
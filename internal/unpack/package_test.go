@@ -0,0 +1,206 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportDeb(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	control := "Package: hello\nVersion: 2.10-3\nArchitecture: amd64\nDepends: libc6 (>= 2.34)\nDescription: example package\n which says hello\n"
+	deb := makeAR(t, []arMember{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", compressGzip(t, makeTar(t, map[string]string{"./control": control}))},
+		{"data.tar.xz", compressXZ(t, makeTar(t, map[string]string{"./usr/bin/hello": "hello world"}))},
+	})
+
+	// the filename is wrong, the package should be detected from its content
+	res, err := Import(ctx, &op, s, "hello.bin", bytes.NewReader(deb))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", readFile(t, &op, s, res.Root, "usr/bin/hello"))
+	require.Equal(t, "deb", res.Labels["package_format"])
+	require.Equal(t, "hello", res.Labels["package_name"])
+	require.Equal(t, "2.10-3", res.Labels["package_version"])
+	require.Equal(t, "amd64", res.Labels["package_arch"])
+	require.Equal(t, "libc6 (>= 2.34)", res.Labels["package_depends"])
+	require.Equal(t, "example package", res.Labels["package_description"])
+}
+
+func TestImportRPM(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	payload := makeCPIO(t, []cpioEntry{
+		{Name: "./usr", Mode: cpioTypeDir | 0o755},
+		{Name: "./usr/bin/hello", Mode: cpioTypeReg | 0o755, Data: "hello world"},
+		{Name: "./usr/bin/hi", Mode: cpioTypeSymlink | 0o777, Data: "hello"},
+		{Name: "./usr/share/a", Mode: cpioTypeReg | 0o644, Ino: 7, NLink: 2},
+		{Name: "./usr/share/b", Mode: cpioTypeReg | 0o644, Ino: 7, NLink: 2, Data: "linked"},
+		{Name: "./usr/share/empty", Mode: cpioTypeDir | 0o755},
+	})
+	rpm := makeRPM(t, []rpmTag{
+		{rpmTagName, rpmTypeString, "hello"},
+		{rpmTagVersion, rpmTypeString, "2.10"},
+		{rpmTagRelease, rpmTypeString, "3.fc38"},
+		{rpmTagEpoch, rpmTypeInt32, uint32(1)},
+		{rpmTagArch, rpmTypeString, "x86_64"},
+		{rpmTagSummary, rpmTypeI18NString, "example package"},
+		{rpmTagRequireName, rpmTypeStringArray, []string{"libc.so.6", "rpmlib(CompressedFileNames)"}},
+		{rpmTagPayloadFormat, rpmTypeString, "cpio"},
+	}, compressZstd(t, payload))
+
+	res, err := Import(ctx, &op, s, "hello.rpm", bytes.NewReader(rpm))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", readFile(t, &op, s, res.Root, "usr/bin/hello"))
+	require.Equal(t, "linked", readFile(t, &op, s, res.Root, "usr/share/a"))
+	require.Equal(t, "linked", readFile(t, &op, s, res.Root, "usr/share/b"))
+	binRef, err := op.GetAtPath(ctx, s, res.Root, "usr/bin")
+	require.NoError(t, err)
+	bin, err := op.GetTree(ctx, s, *binRef)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), bin.Lookup("hello").FileMode)
+	require.Equal(t, os.ModeSymlink, bin.Lookup("hi").FileMode.Type())
+	empty, err := op.GetAtPath(ctx, s, res.Root, "usr/share/empty")
+	require.NoError(t, err)
+	require.Equal(t, glfs.TypeTree, empty.Type)
+
+	require.Equal(t, "rpm", res.Labels["package_format"])
+	require.Equal(t, "hello", res.Labels["package_name"])
+	require.Equal(t, "2.10", res.Labels["package_version"])
+	require.Equal(t, "3.fc38", res.Labels["package_release"])
+	require.Equal(t, "1", res.Labels["package_epoch"])
+	require.Equal(t, "x86_64", res.Labels["package_arch"])
+	require.Equal(t, "example package", res.Labels["package_description"])
+	require.Equal(t, "libc.so.6", res.Labels["package_depends"])
+}
+
+func TestImportAppImage(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	data := append([]byte("\x7fELF\x02\x01\x01\x00AI\x02"), make([]byte, 1024)...)
+
+	res, err := Import(ctx, &op, s, "downloads/Tool-x86_64.AppImage", bytes.NewReader(data))
+	require.NoError(t, err)
+	tree, err := op.GetTree(ctx, s, res.Root)
+	require.NoError(t, err)
+	ent := tree.Lookup("Tool-x86_64.AppImage")
+	require.NotNil(t, ent)
+	require.Equal(t, os.FileMode(0o755), ent.FileMode)
+	require.Equal(t, "appimage", res.Labels["package_format"])
+	require.Equal(t, "2", res.Labels["appimage_version"])
+
+	// other ELF files are not AppImages
+	res, err = Import(ctx, &op, s, "tool", bytes.NewReader([]byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00")))
+	require.NoError(t, err)
+	require.Equal(t, glfs.TypeBlob, res.Root.Type)
+}
+
+type arMember struct {
+	Name string
+	Data []byte
+}
+
+func makeAR(t testing.TB, members []arMember) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(arMagic)
+	for _, m := range members {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.Name, 0, 0, 0, 0o644, len(m.Data))
+		buf.Write(m.Data)
+		if len(m.Data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+type cpioEntry struct {
+	Name  string
+	Mode  uint64
+	Ino   uint64
+	NLink uint64
+	Data  string
+}
+
+func makeCPIO(t testing.TB, ents []cpioEntry) []byte {
+	var buf bytes.Buffer
+	write := func(ent cpioEntry) {
+		if ent.NLink == 0 {
+			ent.NLink = 1
+		}
+		name := ent.Name + "\x00"
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ent.Ino, ent.Mode, 0, 0, ent.NLink, 0, len(ent.Data), 0, 0, 0, 0, len(name), 0)
+		buf.WriteString(name)
+		buf.Write(make([]byte, pad4(cpioHeaderSize+int64(len(name)))))
+		buf.WriteString(ent.Data)
+		buf.Write(make([]byte, pad4(int64(len(ent.Data)))))
+	}
+	for _, ent := range ents {
+		write(ent)
+	}
+	write(cpioEntry{Name: cpioTrailer})
+	return buf.Bytes()
+}
+
+type rpmTag struct {
+	Tag   int32
+	Type  uint32
+	Value any
+}
+
+func makeRPM(t testing.TB, tags []rpmTag, payload []byte) []byte {
+	var buf bytes.Buffer
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, rpmLeadMagic)
+	buf.Write(lead)
+	// the signature has an odd size, so that it must be padded
+	sig := makeRPMHeader(t, []rpmTag{{1000, rpmTypeString, "ab"}})
+	buf.Write(sig)
+	buf.Write(make([]byte, (8-len(sig)%8)%8))
+	buf.Write(makeRPMHeader(t, tags))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func makeRPMHeader(t testing.TB, tags []rpmTag) []byte {
+	var index, store bytes.Buffer
+	for _, tag := range tags {
+		var count int
+		offset := store.Len()
+		switch x := tag.Value.(type) {
+		case string:
+			store.WriteString(x + "\x00")
+			count = 1
+		case []string:
+			for _, s := range x {
+				store.WriteString(s + "\x00")
+			}
+			count = len(x)
+		case uint32:
+			// int32 values are aligned to 4 bytes
+			store.Write(make([]byte, pad4(int64(offset))))
+			offset = store.Len()
+			require.NoError(t, binary.Write(&store, binary.BigEndian, x))
+			count = 1
+		}
+		require.NoError(t, binary.Write(&index, binary.BigEndian, []uint32{uint32(tag.Tag), tag.Type, uint32(offset), uint32(count)}))
+	}
+	var buf bytes.Buffer
+	buf.Write(rpmHeaderMagic)
+	buf.Write(make([]byte, 4))
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, []uint32{uint32(len(tags)), uint32(store.Len())}))
+	buf.Write(index.Bytes())
+	buf.Write(store.Bytes())
+	return buf.Bytes()
+}
@@ -0,0 +1,194 @@
+package unpack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/sources"
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+const (
+	rpmLeadSize = 96
+	// maxRPMHeaderSize limits the size of the signature and main headers
+	maxRPMHeaderSize = 64 << 20
+)
+
+// rpm header tags
+const (
+	rpmTagName          = 1000
+	rpmTagVersion       = 1001
+	rpmTagRelease       = 1002
+	rpmTagEpoch         = 1003
+	rpmTagSummary       = 1004
+	rpmTagLicense       = 1014
+	rpmTagPackager      = 1015
+	rpmTagURL           = 1020
+	rpmTagArch          = 1022
+	rpmTagRequireName   = 1049
+	rpmTagPayloadFormat = 1124
+)
+
+// rpm header data types
+const (
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// rpmHeader is a parsed rpm header structure.
+// Only the string and int32 types are decoded.
+type rpmHeader struct {
+	strings map[int32][]string
+	ints    map[int32][]uint32
+}
+
+// importRPM imports the cpio payload of an rpm package, with labels from its header.
+func (c *config) importRPM(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*sources.PullResult, error) {
+	if _, err := io.CopyN(io.Discard, r, rpmLeadSize); err != nil {
+		return nil, err
+	}
+	// the signature header is padded to a multiple of 8 bytes
+	n, _, err := readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unpack: reading rpm signature: %w", err)
+	}
+	if pad := (8 - n%8) % 8; pad > 0 {
+		if _, err := io.CopyN(io.Discard, r, pad); err != nil {
+			return nil, err
+		}
+	}
+	_, hdr, err := readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unpack: reading rpm header: %w", err)
+	}
+	if f := hdr.getString(rpmTagPayloadFormat); f != "" && f != "cpio" {
+		return nil, fmt.Errorf("unpack: unsupported rpm payload format %q", f)
+	}
+	pr, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	ref, err := c.importCPIO(ctx, op, s, pr)
+	if err != nil {
+		return nil, err
+	}
+	return &sources.PullResult{Root: *ref, Labels: rpmLabels(hdr)}, nil
+}
+
+func rpmLabels(hdr *rpmHeader) bpmmd.LabelSet {
+	l := bpmmd.LabelSet{"package_format": "rpm"}
+	for label, tag := range map[string]int32{
+		"package_name":        rpmTagName,
+		"package_version":     rpmTagVersion,
+		"package_release":     rpmTagRelease,
+		"package_arch":        rpmTagArch,
+		"package_description": rpmTagSummary,
+		"package_license":     rpmTagLicense,
+		"package_maintainer":  rpmTagPackager,
+		"package_homepage":    rpmTagURL,
+	} {
+		if v := hdr.getString(tag); v != "" {
+			l[label] = v
+		}
+	}
+	if epoch, ok := hdr.ints[rpmTagEpoch]; ok && len(epoch) > 0 {
+		l["package_epoch"] = strconv.FormatUint(uint64(epoch[0]), 10)
+	}
+	var deps []string
+	for _, dep := range hdr.strings[rpmTagRequireName] {
+		// rpmlib() dependencies are features of rpm itself
+		if !strings.HasPrefix(dep, "rpmlib(") {
+			deps = append(deps, dep)
+		}
+	}
+	if len(deps) > 0 {
+		l["package_depends"] = strings.Join(deps, ", ")
+	}
+	return l
+}
+
+func (h *rpmHeader) getString(tag int32) string {
+	if xs := h.strings[tag]; len(xs) > 0 {
+		return xs[0]
+	}
+	return ""
+}
+
+// readRPMHeader reads a header structure from r, and returns the number of bytes read.
+func readRPMHeader(r io.Reader) (int64, *rpmHeader, error) {
+	var intro [16]byte
+	if _, err := io.ReadFull(r, intro[:]); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.HasPrefix(intro[:], rpmHeaderMagic) {
+		return 0, nil, errors.New("bad header magic")
+	}
+	nindex := int64(binary.BigEndian.Uint32(intro[8:12]))
+	hsize := int64(binary.BigEndian.Uint32(intro[12:16]))
+	if nindex*16+hsize > maxRPMHeaderSize {
+		return 0, nil, fmt.Errorf("header exceeds maximum size %d", maxRPMHeaderSize)
+	}
+	buf := make([]byte, nindex*16+hsize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	index, store := buf[:nindex*16], buf[nindex*16:]
+	hdr := &rpmHeader{
+		strings: make(map[int32][]string),
+		ints:    make(map[int32][]uint32),
+	}
+	for i := int64(0); i < nindex; i++ {
+		ent := index[i*16 : (i+1)*16]
+		tag := int32(binary.BigEndian.Uint32(ent[0:4]))
+		typ := binary.BigEndian.Uint32(ent[4:8])
+		offset := int64(binary.BigEndian.Uint32(ent[8:12]))
+		count := int64(binary.BigEndian.Uint32(ent[12:16]))
+		if offset > hsize {
+			return 0, nil, fmt.Errorf("tag %d has offset %d outside of header", tag, offset)
+		}
+		data := store[offset:]
+		switch typ {
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+			if typ == rpmTypeString {
+				count = 1
+			}
+			var xs []string
+			for j := int64(0); j < count; j++ {
+				end := bytes.IndexByte(data, 0)
+				if end < 0 {
+					return 0, nil, fmt.Errorf("tag %d has unterminated string", tag)
+				}
+				xs = append(xs, string(data[:end]))
+				data = data[end+1:]
+			}
+			hdr.strings[tag] = xs
+		case rpmTypeInt32:
+			if count*4 > int64(len(data)) {
+				return 0, nil, fmt.Errorf("tag %d has count %d outside of header", tag, count)
+			}
+			xs := make([]uint32, count)
+			for j := range xs {
+				xs[j] = binary.BigEndian.Uint32(data[j*4:])
+			}
+			hdr.ints[tag] = xs
+		}
+	}
+	return int64(len(intro)) + int64(len(buf)), hdr, nil
+}
@@ -0,0 +1,118 @@
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ErrUnsafe is returned for archive entries which could be written outside of the tree they are unpacked to,
+// or which should never be deployed, such as device nodes.
+var ErrUnsafe = errors.New("unpack: unsafe archive entry")
+
+// maxLinkTarget limits the length of a symlink target
+const maxLinkTarget = 4096
+
+// maxLinkHops limits how many symlinks are followed to resolve one, as the kernel does.
+const maxLinkHops = 40
+
+// CheckName returns an error if the name of an entry in an archive has a .. component.
+// Leading slashes are removed from names later, as tar does, so absolute names stay inside the tree.
+func CheckName(name string) error {
+	// zip archives made on Windows can use either separator
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("%w: %q has a .. component", ErrUnsafe, name)
+		}
+	}
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%w: %q contains a NUL byte", ErrUnsafe, name)
+	}
+	return nil
+}
+
+// LinkTarget returns the target for a symlink at p, which must resolve to somewhere inside the tree.
+// Absolute targets are made relative to the root of the tree, which is where a package would install them.
+func LinkTarget(p, target string) (string, error) {
+	if target == "" || len(target) > maxLinkTarget || strings.ContainsRune(target, 0) {
+		return "", fmt.Errorf("%w: symlink %q has an invalid target", ErrUnsafe, p)
+	}
+	if path.IsAbs(target) {
+		rel := strings.Repeat("../", strings.Count(p, "/"))
+		if clean := strings.TrimLeft(path.Clean(target), "/"); clean != "" {
+			rel += clean
+		}
+		if rel == "" {
+			rel = "."
+		}
+		target = strings.TrimSuffix(rel, "/")
+	}
+	resolved := path.Join(path.Dir(p), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", fmt.Errorf("%w: symlink %q -> %q points outside of the archive", ErrUnsafe, p, target)
+	}
+	return target, nil
+}
+
+// checkLinks returns an error if any symlink in links resolves to somewhere outside of the tree.
+// links maps the path of each symlink in the tree to its relative target.
+// Each step of a target is resolved through the other symlinks, as it would be on disk,
+// so a chain of symlinks which are each inside of the tree cannot be used to escape it.
+func checkLinks(links map[string]string) error {
+	ps := maps.Keys(links)
+	slices.Sort(ps)
+	for _, p := range ps {
+		var dir []string
+		if d := path.Dir(p); d != "." {
+			dir = strings.Split(d, "/")
+		}
+		hops := 0
+		if _, err := resolveLink(links, dir, links[p], &hops); err != nil {
+			return fmt.Errorf("%w: symlink %q -> %q %v", ErrUnsafe, p, links[p], err)
+		}
+	}
+	return nil
+}
+
+// resolveLink returns the path components of target, relative to the directory dir, following the symlinks in links.
+func resolveLink(links map[string]string, dir []string, target string, hops *int) ([]string, error) {
+	cur := slices.Clone(dir)
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(cur) == 0 {
+				return nil, errors.New("points outside of the archive")
+			}
+			cur = cur[:len(cur)-1]
+		default:
+			cur = append(cur, part)
+			next, isLink := links[strings.Join(cur, "/")]
+			if !isLink {
+				continue
+			}
+			if *hops++; *hops > maxLinkHops {
+				return nil, errors.New("has too many levels of symlinks")
+			}
+			var err error
+			if cur, err = resolveLink(links, cur[:len(cur)-1], next, hops); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cur, nil
+}
+
+// readLinkTarget reads the target of a symlink stored as the contents of an entry, as in zip and cpio archives.
+func readLinkTarget(p string, r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxLinkTarget+1))
+	if err != nil {
+		return "", err
+	}
+	return LinkTarget(p, string(data))
+}
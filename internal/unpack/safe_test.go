@@ -0,0 +1,145 @@
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnsafeArchives(t *testing.T) {
+	file := func(name string) tarEntry {
+		return tarEntry{Header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}, Data: "x"}
+	}
+	symlink := func(name, target string) tarEntry {
+		return tarEntry{Header: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0o777}}
+	}
+	tcs := []struct {
+		Name     string
+		Filename string
+		Data     []byte
+	}{
+		{"tar parent", "x.tar", makeTarEntries(t, file("../evil"))},
+		{"tar nested parent", "x.tar", makeTarEntries(t, file("pkg/../../evil"))},
+		{"tar symlink parent", "x.tar", makeTarEntries(t, symlink("pkg/link", "../../etc"))},
+		{"tar hard link parent", "x.tar", makeTarEntries(t, tarEntry{Header: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}})},
+		{"tar through symlink", "x.tar", makeTarEntries(t, symlink("link", "/etc"), file("link/passwd"))},
+		{"tar replaced dir", "x.tar", makeTarEntries(t, file("dir/a"), symlink("dir", "."), file("dir/b"))},
+		{"tar symlink chain", "x.tar", makeTarEntries(t, symlink("d/up", ".."), symlink("esc", "d/up/.."))},
+		{"tar symlink loop", "x.tar", makeTarEntries(t, symlink("a", "b"), symlink("b", "a/x"))},
+		{"tar char device", "x.tar", makeTarEntries(t, tarEntry{Header: tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}})},
+		{"tar block device", "x.tar", makeTarEntries(t, tarEntry{Header: tar.Header{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8}})},
+		{"zip parent", "x.zip", makeZip(t, map[string]string{"../evil": "x"})},
+		{"zip backslash parent", "x.zip", makeZip(t, map[string]string{`..\evil`: "x"})},
+		{"zip symlink parent", "x.zip", makeZipSymlink(t, "link", "../../etc")},
+		{"rpm parent", "x.rpm", makeRPM(t, nil, makeCPIO(t, []cpioEntry{
+			{Name: "./../evil", Mode: cpioTypeReg | 0o644, Data: "x"},
+		}))},
+		{"rpm symlink parent", "x.rpm", makeRPM(t, nil, makeCPIO(t, []cpioEntry{
+			{Name: "./usr/link", Mode: cpioTypeSymlink | 0o777, Data: "../../../etc"},
+		}))},
+		{"rpm device", "x.rpm", makeRPM(t, nil, makeCPIO(t, []cpioEntry{
+			{Name: "./dev/null", Mode: cpioTypeChar | 0o666},
+		}))},
+		{"deb parent", "x.deb", makeAR(t, []arMember{
+			{"debian-binary", []byte("2.0\n")},
+			{"control.tar", makeTar(t, map[string]string{"./control": "Package: x\n"})},
+			{"data.tar", makeTarEntries(t, file("./../evil"))},
+		})},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			op := glfs.NewOperator()
+			s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+			_, err := Import(ctx, &op, s, tc.Filename, bytes.NewReader(tc.Data))
+			require.ErrorIs(t, err, ErrUnsafe)
+		})
+	}
+}
+
+func TestSanitizedArchive(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	data := makeTarEntries(t,
+		tarEntry{Header: tar.Header{Name: "/usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0o4755}, Data: "tool"},
+		tarEntry{Header: tar.Header{Name: "usr/bin/alt", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/tool"}},
+		tarEntry{Header: tar.Header{Name: "usr/bin/rel", Typeflag: tar.TypeSymlink, Linkname: "../bin/./tool"}},
+		// a chain of symlinks which stays inside of the tree
+		tarEntry{Header: tar.Header{Name: "usr/lib/up", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+		tarEntry{Header: tar.Header{Name: "tool", Typeflag: tar.TypeSymlink, Linkname: "usr/lib/up/bin/alt"}},
+	)
+	res, err := Import(ctx, &op, s, "x.tar", bytes.NewReader(data))
+	require.NoError(t, err)
+	// absolute paths are made relative, and setuid is removed
+	binRef, err := op.GetAtPath(ctx, s, res.Root, "usr/bin")
+	require.NoError(t, err)
+	bin, err := op.GetTree(ctx, s, *binRef)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), bin.Lookup("tool").FileMode)
+	// absolute symlinks point to the same place inside the tree
+	require.Equal(t, "../../usr/bin/tool", readFile(t, &op, s, res.Root, "usr/bin/alt"))
+	require.Equal(t, "../bin/./tool", readFile(t, &op, s, res.Root, "usr/bin/rel"))
+}
+
+func TestLinkTarget(t *testing.T) {
+	tcs := []struct {
+		P, Target, Out string
+	}{
+		{"a", "b", "b"},
+		{"a/b", "../c", "../c"},
+		{"a", "/", "."},
+		{"a/b/c", "/etc/passwd", "../../etc/passwd"},
+		{"a", "/..", "."},
+	}
+	for _, tc := range tcs {
+		out, err := LinkTarget(tc.P, tc.Target)
+		require.NoError(t, err, tc)
+		require.Equal(t, tc.Out, out, tc)
+	}
+	for _, tc := range [][2]string{{"a", ".."}, {"a/b", "../../c"}, {"a", ""}, {"a", "b/../../c"}} {
+		_, err := LinkTarget(tc[0], tc[1])
+		require.ErrorIs(t, err, ErrUnsafe, tc)
+	}
+}
+
+type tarEntry struct {
+	Header tar.Header
+	Data   string
+}
+
+// makeTarEntries creates a tar archive with ents in order
+func makeTarEntries(t testing.TB, ents ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range ents {
+		h := ent.Header
+		h.Size = int64(len(ent.Data))
+		require.NoError(t, tw.WriteHeader(&h))
+		_, err := tw.Write([]byte(ent.Data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func makeZipSymlink(t testing.TB, name, target string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: name}
+	fh.SetMode(os.ModeSymlink | 0o777)
+	w, err := zw.CreateHeader(fh)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(target))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
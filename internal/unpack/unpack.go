@@ -0,0 +1,523 @@
+// Package unpack imports archives, packages and compressed files into glfs.
+//
+// The format of a file is detected from its first bytes, and its filename is only used when
+// the content is ambiguous, so mislabeled downloads are still unpacked correctly.
+//
+// Packages (.deb and .rpm) are unpacked to the files they would install,
+// and their metadata is returned as labels with the package_ prefix.
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+// Compression is a compression format for a single stream
+type Compression string
+
+const (
+	None  = Compression("")
+	Gzip  = Compression("gzip")
+	XZ    = Compression("xz")
+	Bzip2 = Compression("bzip2")
+	Zstd  = Compression("zstd")
+)
+
+// Format is the format of a file, after it has been decompressed
+type Format string
+
+const (
+	// Blob is a single file, which is not an archive
+	Blob = Format("blob")
+	Tar  = Format("tar")
+	Zip  = Format("zip")
+	// Deb is a Debian binary package
+	Deb = Format("deb")
+	// RPM is an RPM binary package
+	RPM = Format("rpm")
+	// AppImage is a self mounting executable
+	AppImage = Format("appimage")
+)
+
+// sniffLen is the number of bytes needed to detect any format
+const sniffLen = 512
+
+var magics = []struct {
+	Compression Compression
+	Magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b, 0x08}},
+	{XZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Bzip2, []byte("BZh")},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// DetectCompression returns the compression format of a stream starting with header
+func DetectCompression(header []byte) Compression {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.Magic) {
+			// bzip2 is followed by the block size from 1-9
+			if m.Compression == Bzip2 && (len(header) < 4 || header[3] < '1' || header[3] > '9') {
+				continue
+			}
+			return m.Compression
+		}
+	}
+	return None
+}
+
+// DetectFormat returns the format of an uncompressed file starting with header.
+// filename is used to recognize tar archives which predate the ustar header.
+func DetectFormat(header []byte, filename string) Format {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return Zip
+	case bytes.HasPrefix(header, []byte(arMagic+"debian-binary")):
+		return Deb
+	case bytes.HasPrefix(header, rpmLeadMagic):
+		return RPM
+	case bytes.HasPrefix(header, []byte("\x7fELF")) && len(header) >= 11 && string(header[8:10]) == "AI":
+		return AppImage
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return Tar
+	case strings.HasSuffix(filename, ".tar"):
+		return Tar
+	default:
+		return Blob
+	}
+}
+
+// Option configures Import
+type Option func(c *config)
+
+type config struct {
+	stripComponents int
+	stripPrefix     string
+}
+
+// StripComponents removes the first n components from each path in an archive.
+// Entries with n or fewer components are skipped.
+func StripComponents(n int) Option {
+	return func(c *config) {
+		c.stripComponents = n
+	}
+}
+
+// StripPrefix removes prefix from each path in an archive.
+// It is an error for an archive to contain paths outside of prefix.
+func StripPrefix(prefix string) Option {
+	return func(c *config) {
+		c.stripPrefix = glfs.CleanPath(prefix)
+	}
+}
+
+// Import imports the file in r, with name filename.
+// Compressed files are decompressed, archives and packages are unpacked into trees,
+// and anything else is imported as a single blob.
+//
+// Archives are rejected with ErrUnsafe if they have paths with .. components, device nodes,
+// symlinks which point outside of the tree, or entries inside of a symlink.
+// Only the permission bits of file modes are kept, so setuid, setgid and sticky bits are removed.
+func Import(ctx context.Context, op *glfs.Operator, s cadata.Poster, filename string, r io.Reader, opts ...Option) (*sources.PullResult, error) {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c.importFile(ctx, op, s, filename, r)
+}
+
+func (c *config) importFile(ctx context.Context, op *glfs.Operator, s cadata.Poster, filename string, r io.Reader) (*sources.PullResult, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if comp := DetectCompression(header); comp != None {
+		dr, err := newDecompressor(comp, br)
+		if err != nil {
+			return nil, err
+		}
+		defer dr.Close()
+		return c.importFile(ctx, op, s, TrimCompressionExt(filename), dr)
+	}
+	var ref *glfs.Ref
+	switch DetectFormat(header, filename) {
+	case Tar:
+		ref, err = c.importTar(ctx, op, s, tar.NewReader(br))
+	case Zip:
+		ref, err = c.importZip(ctx, op, s, br)
+	case Deb:
+		return c.importDeb(ctx, op, s, br)
+	case RPM:
+		return c.importRPM(ctx, op, s, br)
+	case AppImage:
+		return importAppImage(ctx, op, s, filename, header, br)
+	default:
+		ref, err = op.PostBlob(ctx, s, br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sources.PullResult{Root: *ref}, nil
+}
+
+// Decompress returns the decompressed contents of r, detecting the compression format from the first bytes.
+// If r is not compressed, the returned reader reads r unchanged.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	comp := DetectCompression(header)
+	if comp == None {
+		return io.NopCloser(br), nil
+	}
+	return newDecompressor(comp, br)
+}
+
+func newDecompressor(comp Compression, r io.Reader) (io.ReadCloser, error) {
+	switch comp {
+	case Gzip:
+		return gzip.NewReader(r)
+	case XZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case Bzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unpack: unsupported compression %q", comp)
+	}
+}
+
+// TrimCompressionExt returns the name of a file after it has been decompressed
+// e.g. x.tar.gz becomes x.tar, and x.tgz becomes x.tar
+func TrimCompressionExt(filename string) string {
+	for _, ext := range []string{".tgz", ".txz", ".tbz", ".tbz2", ".tzst"} {
+		if stem, ok := strings.CutSuffix(filename, ext); ok {
+			return stem + ".tar"
+		}
+	}
+	for _, ext := range []string{".gz", ".xz", ".bz2", ".zst"} {
+		if stem, ok := strings.CutSuffix(filename, ext); ok {
+			return stem
+		}
+	}
+	return filename
+}
+
+func (c *config) importTar(ctx context.Context, op *glfs.Operator, s cadata.Poster, tr *tar.Reader) (*glfs.Ref, error) {
+	b := newBuilder()
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		p, err := c.path(th.Name)
+		if err != nil {
+			return nil, err
+		}
+		if p == "" {
+			continue
+		}
+		mode := os.FileMode(th.Mode).Perm()
+		switch th.Typeflag {
+		case tar.TypeDir:
+			err = b.putDir(ctx, op, s, p, mode)
+		case tar.TypeReg:
+			err = b.putFile(ctx, op, s, p, mode, tr)
+		case tar.TypeSymlink:
+			target, err2 := LinkTarget(p, th.Linkname)
+			if err2 != nil {
+				return nil, err2
+			}
+			err = b.putSymlink(ctx, op, s, p, mode, target)
+		case tar.TypeLink:
+			target, err2 := c.path(th.Linkname)
+			if err2 != nil {
+				return nil, err2
+			}
+			err = b.putLink(p, target)
+		case tar.TypeChar, tar.TypeBlock:
+			return nil, fmt.Errorf("%w: %q is a device", ErrUnsafe, th.Name)
+		default:
+			// fifos etc. cannot be represented
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(ctx, op, s)
+}
+
+func (c *config) importZip(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*glfs.Ref, error) {
+	f, err := os.CreateTemp("", "bpm-unpack-zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+	b := newBuilder()
+	for _, zf := range zr.File {
+		p, err := c.path(zf.Name)
+		if err != nil {
+			return nil, err
+		}
+		if p == "" {
+			continue
+		}
+		zmode := zf.Mode()
+		mode := zmode.Perm()
+		switch {
+		case zmode.IsDir():
+			if mode == 0 {
+				mode = 0o755
+			}
+			err = b.putDir(ctx, op, s, p, mode)
+		case zmode&os.ModeSymlink != 0:
+			err = b.putZipSymlink(ctx, op, s, p, mode, zf)
+		case zmode&os.ModeDevice != 0:
+			return nil, fmt.Errorf("%w: %q is a device", ErrUnsafe, zf.Name)
+		case zmode.IsRegular():
+			if mode == 0 {
+				mode = 0o644
+			}
+			err = b.putZipFile(ctx, op, s, p, mode, zf)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(ctx, op, s)
+}
+
+// path returns the path for an entry in an archive, or "" if it should be skipped.
+func (c *config) path(name string) (string, error) {
+	if err := CheckName(name); err != nil {
+		return "", err
+	}
+	p := glfs.CleanPath(name)
+	if c.stripPrefix != "" {
+		if p == c.stripPrefix {
+			return "", nil
+		}
+		rest, ok := strings.CutPrefix(p, c.stripPrefix+"/")
+		if !ok {
+			return "", fmt.Errorf("unpack: %q is outside of %q", name, c.stripPrefix)
+		}
+		p = rest
+	}
+	if c.stripComponents > 0 {
+		parts := strings.SplitN(p, "/", c.stripComponents+1)
+		if len(parts) <= c.stripComponents {
+			return "", nil
+		}
+		p = parts[c.stripComponents]
+	}
+	return p, nil
+}
+
+// builder collects the entries of an archive.
+// Later entries replace earlier ones with the same path.
+type builder struct {
+	ents map[string]glfs.TreeEntry
+	// links holds the target of each symlink added to ents
+	links map[string]string
+}
+
+func newBuilder() *builder {
+	return &builder{
+		ents:  make(map[string]glfs.TreeEntry),
+		links: make(map[string]string),
+	}
+}
+
+func (b *builder) putFile(ctx context.Context, op *glfs.Operator, s cadata.Poster, p string, mode os.FileMode, r io.Reader) error {
+	ref, err := op.PostBlob(ctx, s, r)
+	if err != nil {
+		return err
+	}
+	b.ents[p] = glfs.TreeEntry{Name: p, FileMode: mode, Ref: *ref}
+	return nil
+}
+
+// putSymlink adds a symlink at p to target, which must already have been checked with LinkTarget
+func (b *builder) putSymlink(ctx context.Context, op *glfs.Operator, s cadata.Poster, p string, mode os.FileMode, target string) error {
+	if err := b.putFile(ctx, op, s, p, mode|os.ModeSymlink, strings.NewReader(target)); err != nil {
+		return err
+	}
+	b.links[p] = target
+	return nil
+}
+
+func (b *builder) putZipFile(ctx context.Context, op *glfs.Operator, s cadata.Poster, p string, mode os.FileMode, zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return b.putFile(ctx, op, s, p, mode, rc)
+}
+
+func (b *builder) putZipSymlink(ctx context.Context, op *glfs.Operator, s cadata.Poster, p string, mode os.FileMode, zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	target, err := readLinkTarget(p, rc)
+	if err != nil {
+		return err
+	}
+	return b.putSymlink(ctx, op, s, p, mode, target)
+}
+
+func (b *builder) putDir(ctx context.Context, op *glfs.Operator, s cadata.Poster, p string, mode os.FileMode) error {
+	if ent, exists := b.ents[p]; exists && ent.Ref.Type == glfs.TypeTree {
+		return nil
+	}
+	ref, err := op.PostTree(ctx, s, glfs.Tree{})
+	if err != nil {
+		return err
+	}
+	b.ents[p] = glfs.TreeEntry{Name: p, FileMode: mode | os.ModeDir, Ref: *ref}
+	return nil
+}
+
+// putLink adds a hard link at p to an earlier entry at target
+func (b *builder) putLink(p, target string) error {
+	ent, exists := b.ents[target]
+	if !exists || ent.Ref.Type != glfs.TypeBlob {
+		return fmt.Errorf("unpack: hard link %q to missing file %q", p, target)
+	}
+	b.ents[p] = glfs.TreeEntry{Name: p, FileMode: ent.FileMode, Ref: ent.Ref}
+	if ent.FileMode&os.ModeSymlink != 0 {
+		b.links[p] = b.links[target]
+	}
+	return nil
+}
+
+// TreeBuilder builds a tree from individual files, with the same checks which are made on archives.
+type TreeBuilder struct {
+	op *glfs.Operator
+	s  cadata.Poster
+	b  *builder
+}
+
+// NewTreeBuilder returns a TreeBuilder which posts the files and the tree to s.
+func NewTreeBuilder(op *glfs.Operator, s cadata.Poster) *TreeBuilder {
+	return &TreeBuilder{op: op, s: s, b: newBuilder()}
+}
+
+// PutFile adds a regular file at p, with the permission bits of mode.
+func (tb *TreeBuilder) PutFile(ctx context.Context, p string, mode os.FileMode, r io.Reader) error {
+	p, err := tb.path(p)
+	if err != nil {
+		return err
+	}
+	return tb.b.putFile(ctx, tb.op, tb.s, p, mode.Perm(), r)
+}
+
+// PutSymlink adds a symlink at p to target, which is checked with LinkTarget.
+func (tb *TreeBuilder) PutSymlink(ctx context.Context, p string, mode os.FileMode, target string) error {
+	p, err := tb.path(p)
+	if err != nil {
+		return err
+	}
+	if target, err = LinkTarget(p, target); err != nil {
+		return err
+	}
+	return tb.b.putSymlink(ctx, tb.op, tb.s, p, mode.Perm(), target)
+}
+
+// Finish posts the tree, and returns ErrUnsafe if a file is inside of a symlink, or a chain of symlinks points outside of the tree.
+func (tb *TreeBuilder) Finish(ctx context.Context) (*glfs.Ref, error) {
+	return tb.b.finish(ctx, tb.op, tb.s)
+}
+
+func (tb *TreeBuilder) path(name string) (string, error) {
+	var c config
+	p, err := c.path(name)
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", fmt.Errorf("%w: invalid path %q", ErrUnsafe, name)
+	}
+	return p, nil
+}
+
+func (b *builder) finish(ctx context.Context, op *glfs.Operator, s cadata.Poster) (*glfs.Ref, error) {
+	// directories are implied by their children, only keep the empty ones.
+	nonEmpty := map[string]struct{}{}
+	for k := range b.ents {
+		for dir := path.Dir(k); dir != "."; dir = path.Dir(dir) {
+			// an entry under a symlink would be written wherever the symlink points
+			if ent, exists := b.ents[dir]; exists && ent.Ref.Type != glfs.TypeTree {
+				return nil, fmt.Errorf("%w: %q is inside of %q, which is not a directory", ErrUnsafe, k, dir)
+			}
+			nonEmpty[dir] = struct{}{}
+		}
+	}
+	// only the symlinks which were not replaced by a later entry are in the tree
+	links := make(map[string]string, len(b.links))
+	for k, target := range b.links {
+		if b.ents[k].FileMode&os.ModeSymlink != 0 {
+			links[k] = target
+		}
+	}
+	if err := checkLinks(links); err != nil {
+		return nil, err
+	}
+	ents := make([]glfs.TreeEntry, 0, len(b.ents))
+	for k, ent := range b.ents {
+		if _, exists := nonEmpty[k]; exists {
+			continue
+		}
+		ents = append(ents, ent)
+	}
+	if len(ents) == 0 {
+		return op.PostTree(ctx, s, glfs.Tree{})
+	}
+	return op.PostTreeFromEntries(ctx, s, ents)
+}
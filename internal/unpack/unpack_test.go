@@ -0,0 +1,218 @@
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+// helloBzip2 is "hello bzip2\n" compressed with bzip2, which the standard library can only decompress.
+var helloBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xab, 0x6b, 0xa1, 0xf1, 0x00, 0x00,
+	0x02, 0xd9, 0x80, 0x00, 0x10, 0x40, 0x00, 0x10, 0x00, 0x12, 0x64, 0xc0, 0x10, 0x20, 0x00, 0x31,
+	0x00, 0xd3, 0x4d, 0x04, 0x00, 0x1e, 0xa3, 0xef, 0x4e, 0x51, 0xa2, 0x07, 0x8b, 0xb9, 0x22, 0x9c,
+	0x28, 0x48, 0x55, 0xb5, 0xd0, 0xf8, 0x80,
+}
+
+var testFiles = map[string]string{
+	"pkg-1.0/bin/hello":    "hello world",
+	"pkg-1.0/README":       "readme",
+	"pkg-1.0/share/empty/": "",
+}
+
+func TestImportArchives(t *testing.T) {
+	tarData := makeTar(t, testFiles)
+	tcs := []struct {
+		Name     string
+		Filename string
+		Data     []byte
+	}{
+		{"tar", "pkg.tar", tarData},
+		{"tar.gz", "pkg.tar.gz", compressGzip(t, tarData)},
+		{"tar.xz", "pkg.tar.xz", compressXZ(t, tarData)},
+		{"tar.zst", "pkg.tar.zst", compressZstd(t, tarData)},
+		{"zip", "pkg.zip", makeZip(t, testFiles)},
+		// GitHub serves most assets as application/octet-stream, and names are not always accurate.
+		{"mislabeled", "pkg.zip", compressGzip(t, tarData)},
+		{"no name", "", compressXZ(t, tarData)},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			op := glfs.NewOperator()
+			s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+			res, err := Import(ctx, &op, s, tc.Filename, bytes.NewReader(tc.Data))
+			require.NoError(t, err)
+			require.Equal(t, glfs.TypeTree, res.Root.Type)
+			require.Equal(t, "hello world", readFile(t, &op, s, res.Root, "pkg-1.0/bin/hello"))
+			require.Equal(t, "readme", readFile(t, &op, s, res.Root, "pkg-1.0/README"))
+			empty, err := op.GetAtPath(ctx, s, res.Root, "pkg-1.0/share/empty")
+			require.NoError(t, err)
+			require.Equal(t, glfs.TypeTree, empty.Type)
+		})
+	}
+}
+
+func TestImportBlob(t *testing.T) {
+	tcs := []struct {
+		Name     string
+		Filename string
+		Data     []byte
+	}{
+		{"plain", "hello.txt", []byte("hello bzip2\n")},
+		{"gzip", "hello.gz", compressGzip(t, []byte("hello bzip2\n"))},
+		{"bzip2", "hello.bz2", helloBzip2},
+		{"zstd", "hello", compressZstd(t, []byte("hello bzip2\n"))},
+		{"empty", "empty", nil},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			op := glfs.NewOperator()
+			s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+			res, err := Import(ctx, &op, s, tc.Filename, bytes.NewReader(tc.Data))
+			require.NoError(t, err)
+			require.Equal(t, glfs.TypeBlob, res.Root.Type)
+			data, err := op.GetBlobBytes(ctx, s, res.Root)
+			require.NoError(t, err)
+			if tc.Data == nil {
+				require.Empty(t, data)
+			} else {
+				require.Equal(t, "hello bzip2\n", string(data))
+			}
+		})
+	}
+}
+
+func TestStrip(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	data := compressGzip(t, makeTar(t, testFiles))
+
+	res, err := Import(ctx, &op, s, "pkg.tgz", bytes.NewReader(data), StripComponents(1))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", readFile(t, &op, s, res.Root, "bin/hello"))
+
+	res, err = Import(ctx, &op, s, "pkg.zip", bytes.NewReader(makeZip(t, testFiles)), StripPrefix("pkg-1.0/"))
+	require.NoError(t, err)
+	require.Equal(t, "readme", readFile(t, &op, s, res.Root, "README"))
+
+	_, err = Import(ctx, &op, s, "pkg.tgz", bytes.NewReader(data), StripPrefix("other/"))
+	require.Error(t, err)
+}
+
+func TestHardLink(t *testing.T) {
+	ctx := context.Background()
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0o755, Size: 1}))
+	_, err := tw.Write([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a"}))
+	require.NoError(t, tw.Close())
+
+	res, err := Import(ctx, &op, s, "", &buf)
+	require.NoError(t, err)
+	require.Equal(t, "a", readFile(t, &op, s, res.Root, "b"))
+	tree, err := op.GetTree(ctx, s, res.Root)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSymlink, tree.Lookup("c").FileMode.Type())
+}
+
+func TestTrimCompressionExt(t *testing.T) {
+	tcs := map[string]string{
+		"x.tar.gz":  "x.tar",
+		"x.tgz":     "x.tar",
+		"x.tar.zst": "x.tar",
+		"x.gz":      "x",
+		"x.zip":     "x.zip",
+	}
+	for in, out := range tcs {
+		require.Equal(t, out, TrimCompressionExt(in), in)
+	}
+}
+
+func readFile(t testing.TB, op *glfs.Operator, s cadata.Store, root glfs.Ref, p string) string {
+	ctx := context.Background()
+	ref, err := op.GetAtPath(ctx, s, root, p)
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// makeTar creates a tar archive from files. Names ending in / are directories.
+func makeTar(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range files {
+		h := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}
+		if name[len(name)-1] == '/' {
+			h = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+		}
+		require.NoError(t, tw.WriteHeader(h))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func makeZip(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func compressGzip(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	writeAll(t, w, data)
+	return buf.Bytes()
+}
+
+func compressXZ(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	writeAll(t, w, data)
+	return buf.Bytes()
+}
+
+func compressZstd(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	writeAll(t, w, data)
+	return buf.Bytes()
+}
+
+func writeAll(t testing.TB, w io.WriteCloser, data []byte) {
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
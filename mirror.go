@@ -0,0 +1,124 @@
+package bpm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/brendoncarroll/stdctx/logctx"
+
+	"github.com/blobcache/bpm/internal/checksum"
+	"github.com/blobcache/bpm/sources"
+)
+
+// WithMirrors sets the mirrors for the source at u, overriding any from the config.
+// Each mirror is an http(s) URL, a file:// URL, or an absolute path to a directory.
+// Pull tries the mirrors in order, before the source itself.
+func WithMirrors(u sources.URL, mirrors ...string) Option {
+	return func(r *Repo) {
+		r.sourceMirrors[u] = mirrors
+	}
+}
+
+// validateMirror returns an error if m is not a valid mirror location
+func validateMirror(m string) error {
+	if filepath.IsAbs(m) {
+		return nil
+	}
+	u, err := url.Parse(m)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		return nil
+	default:
+		return fmt.Errorf("mirror must be an http(s) URL, a file URL, or an absolute path, have %q", m)
+	}
+}
+
+// openFromMirrors opens the file for the asset id from the mirrors for u, trying them in order.
+// An asset is found at the mirror by mirrorPath, so assets without a filename label are never mirrored.
+// Mirrors are only used for assets with a sha256 label, which the content from a mirror must match,
+// so a mirror can never provide a file which the source would not.
+// The file and its path in the mirror are returned, or nil if no mirror had the asset.
+func (r *Repo) openFromMirrors(ctx context.Context, u sources.URL, id string, labels LabelSet) (io.ReadSeekCloser, string) {
+	mirrors := r.sourceMirrors[u]
+	if len(mirrors) == 0 || labels["sha256"] == "" {
+		return nil, ""
+	}
+	p := mirrorPath(u, id, labels["filename"])
+	if p == "" {
+		return nil, ""
+	}
+	for _, m := range mirrors {
+		f, err := openFromMirror(ctx, m, p, labels["sha256"])
+		if err != nil {
+			logctx.Warnf(ctx, "mirror %s: %v", m, err)
+			continue
+		}
+		logctx.Infof(ctx, "pulling %s from mirror %s", p, m)
+		return f, p
+	}
+	return nil, ""
+}
+
+// mirrorPath returns the path of the file for the asset id from u in a mirror: <scheme>/<path>/<id>/<filename>
+// The id is escaped to a single path element.
+// It returns "" if the asset has no filename, or the path would not be inside the mirror.
+func mirrorPath(u sources.URL, id, filename string) string {
+	filename = path.Base(path.Clean("/" + filename))
+	if filename == "/" || id == "" || id == "." || id == ".." {
+		return ""
+	}
+	// cleaning an absolute path removes any .. components
+	srcPath := path.Clean("/" + u.Path)[1:]
+	return path.Join(u.Scheme, srcPath, url.PathEscape(id), filename)
+}
+
+// openFromMirror copies the file at p in the mirror to a temporary file, and verifies it, before anything is imported.
+func openFromMirror(ctx context.Context, mirror, p, wantSHA256 string) (io.ReadSeekCloser, error) {
+	rc, err := openMirror(ctx, mirror, p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := checksum.Verify(rc, wantSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return f, nil
+}
+
+// openMirror opens the file at p in the mirror
+func openMirror(ctx context.Context, mirror, p string) (io.ReadCloser, error) {
+	if filepath.IsAbs(mirror) {
+		return os.Open(filepath.Join(mirror, filepath.FromSlash(p)))
+	}
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath(p)
+	if u.Scheme == "file" {
+		return os.Open(filepath.FromSlash(u.Path))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
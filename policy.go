@@ -0,0 +1,213 @@
+package bpm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/blobcache/bpm/internal/dbutil"
+	"github.com/blobcache/bpm/internal/sqlstores"
+	"github.com/blobcache/bpm/sources"
+)
+
+// ErrPolicy is returned by Deploy when an asset in the snapshot violates the policy for its source.
+var ErrPolicy = errors.New("bpm: policy violation")
+
+// Policy states what is required of an asset from a source before it can be deployed.
+// The zero Policy allows anything.
+type Policy struct {
+	// HTTPSOnly requires the source, and all of its mirrors, to use HTTPS.
+	// Mirrors on the local filesystem are allowed.
+	HTTPSOnly bool `json:"https_only,omitempty"`
+	// RequireChecksum requires the file for the asset to have been checked against a sha256 sum, from the source or a pin, when it was pulled.
+	RequireChecksum bool `json:"require_checksum,omitempty"`
+	// SignedBy requires the asset to have had a verified signature from one of these keys when it was pulled,
+	// written as in the signed_by label e.g. minisign:<id>
+	SignedBy []string `json:"signed_by,omitempty"`
+	// Labels limits the values of labels, a missing label has the empty value.
+	Labels map[string][]string `json:"labels,omitempty"`
+	// MaxSize is the largest total size of the files in the asset, in bytes.
+	MaxSize uint64 `json:"max_size,omitempty"`
+}
+
+// Validate returns an error if the policy is invalid
+func (p Policy) Validate() error {
+	for _, k := range p.SignedBy {
+		if !strings.Contains(k, ":") {
+			return fmt.Errorf("signed_by: %q must have the form <kind>:<id>", k)
+		}
+	}
+	for k, vs := range p.Labels {
+		if len(vs) == 0 {
+			return fmt.Errorf("labels: %q allows no values", k)
+		}
+	}
+	return nil
+}
+
+// WithPolicy sets the policy for the source at u, overriding any from the config.
+// Policies for the scheme of u from the config still apply.
+func WithPolicy(u sources.URL, p Policy) Option {
+	return func(r *Repo) {
+		r.sourcePolicies[u] = p
+	}
+}
+
+// scopedPolicy is a policy, and a description of where it came from for errors
+type scopedPolicy struct {
+	scope  string
+	policy Policy
+}
+
+// policiesFor returns the policies which apply to assets from u
+func (r *Repo) policiesFor(u sources.URL) []scopedPolicy {
+	var ret []scopedPolicy
+	if p, ok := r.config.Policies[u.Scheme]; ok {
+		ret = append(ret, scopedPolicy{scope: fmt.Sprintf("scheme %q", u.Scheme), policy: p})
+	}
+	if p, ok := r.sourcePolicies[u]; ok {
+		ret = append(ret, scopedPolicy{scope: fmt.Sprintf("source %v", u), policy: p})
+	}
+	return ret
+}
+
+// requiresChecksum returns true if a policy for u requires assets to be checked against a sha256 sum
+func (r *Repo) requiresChecksum(u sources.URL) bool {
+	for _, sp := range r.policiesFor(u) {
+		if sp.policy.RequireChecksum {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicies returns an error for each TLD in tlds with an asset which violates a policy.
+// The same content may be in more than one asset, and the policy for the upstream of each of them must allow it.
+// Assets which were not pulled from a source have no policy.
+func (r *Repo) checkPolicies(ctx context.Context, tlds map[string]glfs.Ref) error {
+	names := maps.Keys(tlds)
+	slices.Sort(names)
+	var errs []error
+	for _, name := range names {
+		ref := tlds[name]
+		aids, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) ([]uint64, error) { return lookupAssetsByRoot(tx, ref) })
+		if err != nil {
+			return err
+		}
+		for _, aid := range aids {
+			a, err := r.GetAsset(ctx, aid)
+			if err != nil {
+				return err
+			}
+			if a.Upstream == nil {
+				continue
+			}
+			v, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (verification, error) { return getVerification(tx, aid) })
+			if err != nil {
+				return err
+			}
+			for _, sp := range r.policiesFor(a.Upstream.URL) {
+				rule, reason, err := r.checkPolicy(ctx, sp.policy, &a, v)
+				if err != nil {
+					return err
+				}
+				if rule != "" {
+					errs = append(errs, fmt.Errorf("%w: %s (%v): rule %s of the policy for %s failed: %s", ErrPolicy, name, a.Upstream, rule, sp.scope, reason))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPolicy returns the first rule in p which a violates, and why, or "" if a is allowed.
+// Checksums and signatures are only trusted from v, which was recorded by Pull, never from the asset's labels.
+func (r *Repo) checkPolicy(ctx context.Context, p Policy, a *Asset, v verification) (rule, reason string, _ error) {
+	if p.HTTPSOnly {
+		if why := r.checkHTTPS(a.Upstream.URL); why != "" {
+			return "https_only", why, nil
+		}
+	}
+	if p.RequireChecksum && v.SHA256 == "" {
+		return "require_checksum", "the asset was not checked against a sha256 sum when it was pulled", nil
+	}
+	if len(p.SignedBy) > 0 {
+		if v.SignedBy == "" {
+			return "signed_by", "the asset does not have a verified signature", nil
+		}
+		if !slices.Contains(p.SignedBy, v.SignedBy) {
+			return "signed_by", fmt.Sprintf("the asset is signed by %s", v.SignedBy), nil
+		}
+	}
+	keys := maps.Keys(p.Labels)
+	slices.Sort(keys)
+	for _, k := range keys {
+		if v := a.Labels[k]; !slices.Contains(p.Labels[k], v) {
+			return "labels", fmt.Sprintf("%s=%q is not allowed", k, v), nil
+		}
+	}
+	if p.MaxSize > 0 {
+		size, err := r.assetSize(ctx, a)
+		if err != nil {
+			return "", "", err
+		}
+		if size > p.MaxSize {
+			return "max_size", fmt.Sprintf("the asset is %d bytes, more than %d", size, p.MaxSize), nil
+		}
+	}
+	return "", "", nil
+}
+
+// checkHTTPS returns why the source at u, or one of its mirrors, does not use HTTPS, or "" if they all do.
+func (r *Repo) checkHTTPS(u sources.URL) string {
+	src, err := r.makeSource(u, nil)
+	if err != nil {
+		return err.Error()
+	}
+	es, ok := src.(sources.EndpointSource)
+	if !ok {
+		return fmt.Sprintf("%s sources cannot report how they connect", u.Scheme)
+	}
+	if !isHTTPS(es.Endpoint()) {
+		return fmt.Sprintf("the source uses %s", es.Endpoint())
+	}
+	for _, m := range r.sourceMirrors[u] {
+		if !filepath.IsAbs(m) && !strings.HasPrefix(m, "file://") && !isHTTPS(m) {
+			return fmt.Sprintf("the mirror %s does not use HTTPS", m)
+		}
+	}
+	return ""
+}
+
+func isHTTPS(x string) bool {
+	u, err := url.Parse(x)
+	return err == nil && u.Scheme == "https"
+}
+
+// assetSize returns the total size of the files in a
+func (r *Repo) assetSize(ctx context.Context, a *Asset) (uint64, error) {
+	if a.Root.Type != glfs.TypeTree {
+		return a.Root.Size, nil
+	}
+	sid, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (uint64, error) { return getAssetStore(tx, a.ID) })
+	if err != nil {
+		return 0, err
+	}
+	s := sqlstores.NewStore(r.db, Hash, MaxBlobSize, sid)
+	var total uint64
+	err = r.glfsOp.WalkTree(ctx, s, a.Root, func(prefix string, ent glfs.TreeEntry) error {
+		if ent.Ref.Type == glfs.TypeBlob {
+			total += ent.Ref.Size
+		}
+		return nil
+	})
+	return total, err
+}
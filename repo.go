@@ -2,13 +2,16 @@ package bpm
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/blobcache/bpm/internal/dbutil"
 	"github.com/blobcache/bpm/internal/porting"
 	"github.com/blobcache/bpm/internal/sqlstores"
+	"github.com/blobcache/bpm/sources"
 	"github.com/blobcache/glfs"
 	"github.com/brendoncarroll/go-state/posixfs"
 	"github.com/brendoncarroll/stdctx/logctx"
@@ -17,19 +20,89 @@ import (
 
 const bpmPath = ".bpm"
 
+// DefaultMetadataTTL is how old the metadata from a source can be before it is fetched again automatically.
+const DefaultMetadataTTL = 24 * time.Hour
+
+// ErrOffline is returned by operations which need the network, when the Repo is offline.
+var ErrOffline = errors.New("bpm: network access is disabled")
+
+// ErrPinMismatch is returned when pulled content does not match the content it was pinned to.
+var ErrPinMismatch = errors.New("bpm: content does not match pin")
+
 type Repo struct {
-	db     *sqlx.DB
-	dir    posixfs.FS
-	glfsOp glfs.Operator
+	db      *sqlx.DB
+	dir     posixfs.FS
+	glfsOp  glfs.Operator
+	sources *sources.Registry
+
+	config     *Config
+	sourceOpts map[sources.URL]map[string]string
+	// sourceMirrors are tried in order by Pull
+	sourceMirrors map[sources.URL][]string
+	// sigPolicies are checked by Pull, see SourceConfig.TrustedKeys
+	sigPolicies map[sources.URL]sigPolicy
+	// sourcePolicies are checked by Deploy, see WithPolicy
+	sourcePolicies map[sources.URL]Policy
+	ttl            time.Duration
+	sourceTTLs     map[sources.URL]time.Duration
+	offline        bool
+}
+
+// Option configures a Repo
+type Option func(r *Repo)
+
+// WithSources sets the registry used to create sources from URLs.
+// The default is sources.DefaultRegistry
+func WithSources(reg *sources.Registry) Option {
+	return func(r *Repo) {
+		r.sources = reg
+	}
+}
+
+// WithMetadataTTL sets how old the metadata from a source can be before it is fetched again automatically.
+// A TTL of 0 disables automatic fetching.
+// The default is DefaultMetadataTTL.
+func WithMetadataTTL(d time.Duration) Option {
+	return func(r *Repo) {
+		r.ttl = d
+	}
+}
+
+// WithSourceTTL sets the metadata TTL for the source at u, overriding WithMetadataTTL.
+func WithSourceTTL(u sources.URL, d time.Duration) Option {
+	return func(r *Repo) {
+		r.sourceTTLs[u] = d
+	}
+}
+
+// WithOffline disables all network access.
+// Fetches fail with ErrOffline, and only assets which have already been pulled can be used.
+func WithOffline(offline bool) Option {
+	return func(r *Repo) {
+		r.offline = offline
+	}
 }
 
-func New(db *sqlx.DB, dir posixfs.FS) *Repo {
-	return &Repo{
+func New(db *sqlx.DB, dir posixfs.FS, opts ...Option) *Repo {
+	r := &Repo{
 		db:  db,
 		dir: dir,
 
-		glfsOp: glfs.NewOperator(),
+		glfsOp:  glfs.NewOperator(),
+		sources: sources.DefaultRegistry,
+
+		config:         &Config{},
+		sourceOpts:     make(map[sources.URL]map[string]string),
+		sourceMirrors:  make(map[sources.URL][]string),
+		sigPolicies:    make(map[sources.URL]sigPolicy),
+		sourcePolicies: make(map[sources.URL]Policy),
+		ttl:            DefaultMetadataTTL,
+		sourceTTLs:     make(map[sources.URL]time.Duration),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 // Init creates a new repo under the path p, which must be a directory
@@ -42,7 +115,7 @@ func Init(ctx context.Context, p string) error {
 }
 
 // Open opens the repo in the directory at p
-func Open(p string) (*Repo, error) {
+func Open(p string, opts ...Option) (*Repo, error) {
 	_, err := os.Stat(filepath.Join(p, bpmPath))
 	if err != nil {
 		return nil, err
@@ -55,7 +128,17 @@ func Open(p string) (*Repo, error) {
 	if err := setupDB(context.Background(), db); err != nil {
 		return nil, err
 	}
-	return New(db, posixfs.NewDirFS(p)), nil
+	config, err := LoadConfig(p)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithConfig(config)}, opts...)
+	return New(db, posixfs.NewDirFS(p), opts...), nil
+}
+
+// Sources returns the registry used to create sources from URLs
+func (r *Repo) Sources() *sources.Registry {
+	return r.sources
 }
 
 // DeploymentDir is the directory in the filesystem used for deployments
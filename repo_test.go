@@ -3,13 +3,40 @@ package bpm
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
 	"github.com/brendoncarroll/go-state"
+	"github.com/brendoncarroll/go-state/cadata"
 	"github.com/brendoncarroll/go-state/posixfs"
+	"github.com/itchyny/gojq"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/dbutil"
+	"github.com/blobcache/bpm/internal/sigverify"
+	"github.com/blobcache/bpm/internal/sqlstores"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
 )
 
 func TestInitRepo(t *testing.T) {
@@ -61,11 +88,11 @@ func TestModify(t *testing.T) {
 	require.Len(t, cs, 10)
 }
 
-func newTestRepo(t testing.TB) *Repo {
+func newTestRepo(t testing.TB, opts ...Option) *Repo {
 	ctx := context.Background()
 	p := t.TempDir()
 	require.NoError(t, Init(ctx, p))
-	r, err := Open(p)
+	r, err := Open(p, opts...)
 	require.NoError(t, err)
 	return r
 }
@@ -109,3 +136,624 @@ func mustListCommits(t testing.TB, r *Repo) []Commit {
 	require.NoError(t, err)
 	return cs
 }
+
+func TestCustomSource(t *testing.T) {
+	ctx := context.Background()
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return testSource{}, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	r, err := Open(p, WithSources(reg))
+	require.NoError(t, err)
+
+	u := sources.URL{Scheme: "test", Path: "a"}
+	require.NoError(t, r.Fetch(ctx, u))
+	assets, err := r.ListAssetsBySource(ctx, &u, mustCompileJQ(t, "true"))
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	require.Equal(t, "1.0", assets[0].Labels["version"])
+
+	aid, err := r.Pull(ctx, u, "1.0")
+	require.NoError(t, err)
+	require.Equal(t, assets[0].ID, aid)
+	a, err := r.GetAsset(ctx, aid)
+	require.NoError(t, err)
+	require.Equal(t, "1.0", a.Labels["version"])
+	require.Equal(t, "test", a.Labels["package_name"])
+
+	_, err = r.Pull(ctx, sources.URL{Scheme: "github", Path: "blobcache/bpm"}, "v1")
+	require.ErrorIs(t, err, sources.ErrUnknownScheme)
+}
+
+func TestFetchGone(t *testing.T) {
+	ctx := context.Background()
+	src := &listSource{assets: []sources.RemoteAsset{
+		{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}},
+		{ID: "2.0", Labels: bpmmd.LabelSet{"version": "2.0"}},
+	}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	r, err := Open(p, WithSources(reg))
+	require.NoError(t, err)
+	u := sources.URL{Scheme: "test", Path: "a"}
+	list := func(opts ...ListOption) []Asset {
+		assets, err := r.ListAssetsBySource(ctx, &u, mustCompileJQ(t, "true"), opts...)
+		require.NoError(t, err)
+		return assets
+	}
+
+	require.NoError(t, r.Fetch(ctx, u))
+	require.Len(t, list(), 2)
+
+	// 1.0 is removed upstream
+	src.assets = src.assets[1:]
+	require.NoError(t, r.Fetch(ctx, u))
+	require.Len(t, list(), 1)
+	all := list(IncludeGone())
+	require.Len(t, all, 2)
+	for _, a := range all {
+		if a.Upstream.ID == "1.0" {
+			require.Equal(t, "true", a.Labels["gone"])
+			require.NotEmpty(t, a.Labels["gone_at"])
+		} else {
+			require.NotContains(t, a.Labels, "gone")
+		}
+	}
+
+	// a partial fetch does not mark anything as gone
+	src.assets = nil
+	src.partial = true
+	require.NoError(t, r.Fetch(ctx, u))
+	require.Len(t, list(), 1)
+
+	// 1.0 comes back
+	src.assets = []sources.RemoteAsset{
+		{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}},
+		{ID: "2.0", Labels: bpmmd.LabelSet{"version": "2.0"}},
+	}
+	src.partial = false
+	require.NoError(t, r.Fetch(ctx, u))
+	assets := list()
+	require.Len(t, assets, 2)
+	for _, a := range assets {
+		require.NotContains(t, a.Labels, "gone")
+	}
+}
+
+func TestFetchPulledByID(t *testing.T) {
+	ctx := context.Background()
+	src := &listSource{assets: []sources.RemoteAsset{
+		{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}},
+	}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	r, err := Open(p, WithSources(reg))
+	require.NoError(t, err)
+	u := sources.URL{Scheme: "test", Path: "a"}
+
+	require.NoError(t, r.Fetch(ctx, u))
+	// commit-abcdef0 is never listed, but can be pulled by ID
+	aid, err := r.Pull(ctx, u, "commit-abcdef0")
+	require.NoError(t, err)
+	require.NoError(t, r.Fetch(ctx, u))
+
+	a, err := r.GetAsset(ctx, aid)
+	require.NoError(t, err)
+	require.NotContains(t, a.Labels, "gone")
+	require.NotContains(t, a.Labels, "gone_at")
+	assets, err := r.ListAssetsBySource(ctx, &u, mustCompileJQ(t, "true"))
+	require.NoError(t, err)
+	require.Len(t, assets, 2)
+}
+
+func TestFetchAll(t *testing.T) {
+	ctx := context.Background()
+	good := &listSource{assets: []sources.RemoteAsset{{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}}}}
+	bad := &listSource{assets: []sources.RemoteAsset{{ID: "2.0", Labels: bpmmd.LabelSet{"version": "2.0"}}}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		if params.URL.Path == "bad" {
+			return bad, nil
+		}
+		return good, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	r, err := Open(p, WithSources(reg))
+	require.NoError(t, err)
+	goodURL := sources.URL{Scheme: "test", Path: "good"}
+	badURL := sources.URL{Scheme: "test", Path: "bad"}
+	require.NoError(t, r.Fetch(ctx, goodURL))
+	require.NoError(t, r.Fetch(ctx, badURL))
+
+	bad.err = errors.New("upstream is down")
+	statuses, err := r.FetchAll(ctx)
+	require.ErrorContains(t, err, "upstream is down")
+	require.Len(t, statuses, 2)
+	// sorted by URL
+	require.Equal(t, badURL, statuses[0].URL)
+	require.Equal(t, "upstream is down", statuses[0].LastError)
+	require.False(t, statuses[0].LastSuccess.IsZero())
+	require.True(t, statuses[0].LastSuccess.Before(statuses[0].LastAttempt))
+	// a failed fetch does not mark anything as gone
+	require.Equal(t, 1, statuses[0].AssetCount)
+	require.Equal(t, goodURL, statuses[1].URL)
+	require.Empty(t, statuses[1].LastError)
+	require.Equal(t, 1, statuses[1].AssetCount)
+
+	listed, err := r.ListSourceStatus(ctx)
+	require.NoError(t, err)
+	require.Equal(t, statuses, listed)
+}
+
+func TestEnsureFresh(t *testing.T) {
+	ctx := context.Background()
+	src := &listSource{assets: []sources.RemoteAsset{
+		{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}},
+		{ID: "2.0", Labels: bpmmd.LabelSet{"version": "2.0"}},
+	}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	u := sources.URL{Scheme: "test", Path: "a"}
+	open := func(opts ...Option) *Repo {
+		r, err := Open(p, append([]Option{WithSources(reg)}, opts...)...)
+		require.NoError(t, err)
+		return r
+	}
+
+	r := open(WithMetadataTTL(time.Hour))
+	require.NoError(t, r.EnsureFresh(ctx, u))
+	require.Equal(t, 1, src.fetches)
+	require.NoError(t, r.EnsureFresh(ctx, u))
+	require.Equal(t, 1, src.fetches)
+
+	// stale metadata is used if the fetch fails
+	r = open(WithSourceTTL(u, time.Nanosecond))
+	src.err = errors.New("upstream is down")
+	require.NoError(t, r.EnsureFresh(ctx, u))
+	require.Equal(t, 2, src.fetches)
+	src.err = nil
+
+	aid, err := r.Resolve(ctx, DeploySpec{Source: u, Query: `.version == "2.0"`})
+	require.NoError(t, err)
+	require.Equal(t, 3, src.fetches)
+	_, err = r.Resolve(ctx, DeploySpec{Source: u, Query: `true`})
+	require.ErrorContains(t, err, "2 assets")
+	require.Equal(t, 4, src.fetches)
+
+	r = open(WithOffline(true), WithMetadataTTL(time.Nanosecond))
+	require.NoError(t, r.EnsureFresh(ctx, u))
+	require.ErrorIs(t, r.Fetch(ctx, u), ErrOffline)
+	require.Equal(t, 4, src.fetches)
+	aid2, err := r.Resolve(ctx, DeploySpec{Source: u, Query: `.version == "2.0"`})
+	require.NoError(t, err)
+	require.Equal(t, aid, aid2)
+	_, err = r.Pull(ctx, u, "1.0")
+	require.ErrorIs(t, err, ErrOffline)
+}
+
+func TestConfig(t *testing.T) {
+	ctx := context.Background()
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	config := `{
+		"metadata_ttl": "2h",
+		"sources": {
+			"tool": {
+				"url": "test:a",
+				"options": {"max_releases": "5", "token_env": "TOOL_TOKEN"},
+				"metadata_ttl": "1ns"
+			}
+		}
+	}`
+	require.NoError(t, os.WriteFile(filepath.Join(p, configPath), []byte(config), 0o644))
+
+	src := &listSource{assets: []sources.RemoteAsset{{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}}}}
+	var lastOpts map[string]string
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		lastOpts = params.Options
+		return src, nil
+	})
+	r, err := Open(p, WithSources(reg))
+	require.NoError(t, err)
+
+	u, err := r.ParseSourceURL("tool")
+	require.NoError(t, err)
+	require.Equal(t, sources.URL{Scheme: "test", Path: "a"}, *u)
+	_, err = r.ParseSourceURL("other")
+	require.Error(t, err)
+	u2, err := r.ParseSourceURL("test:b")
+	require.NoError(t, err)
+	require.Equal(t, sources.URL{Scheme: "test", Path: "b"}, *u2)
+
+	// options from the config are overridden by options passed to fetch
+	require.NoError(t, r.FetchWithOptions(ctx, *u, map[string]string{"max_releases": "1"}))
+	require.Equal(t, map[string]string{"max_releases": "1", "token_env": "TOOL_TOKEN"}, lastOpts)
+	require.NoError(t, r.Fetch(ctx, *u2))
+	require.Empty(t, lastOpts)
+
+	// the source has its own TTL, other sources use the TTL from the config
+	require.NoError(t, r.EnsureFresh(ctx, *u))
+	require.Equal(t, 3, src.fetches)
+	require.NoError(t, r.EnsureFresh(ctx, *u2))
+	require.Equal(t, 3, src.fetches)
+
+	// invalid configs are rejected when the repo is opened
+	for _, bad := range []string{
+		`{"sources": {"a:b": {"url": "test:a"}}}`,
+		`{"sources": {"a": {"url": "test:a"}, "b": {"url": "test:a"}}}`,
+		`{"sources": {"a": {"url": "test"}}}`,
+		`{"metadata_ttl": "1 day"}`,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(p, configPath), []byte(bad), 0o644))
+		_, err := Open(p)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestPullMirror(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("mirrored tool")
+	sum := sha256.Sum256(content)
+	src := &listSource{assets: []sources.RemoteAsset{
+		{ID: "tool", Labels: bpmmd.LabelSet{"filename": "tool-linux", "sha256": hex.EncodeToString(sum[:])}},
+		{ID: "other", Labels: bpmmd.LabelSet{"filename": "other-linux"}},
+	}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	empty := t.TempDir()
+	good := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(good, "test", "a", "tool"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(good, "test", "a", "tool", "tool-linux"), content, 0o644))
+	// a file with the same name, for a different asset, is never used
+	require.NoError(t, os.WriteFile(filepath.Join(good, "tool-linux"), []byte("stale"), 0o644))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tampered"))
+	}))
+	defer srv.Close()
+
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	u := sources.URL{Scheme: "test", Path: "a"}
+	// the first mirror does not have the file, and the second has the wrong content
+	r, err := Open(p, WithSources(reg), WithMirrors(u, empty, srv.URL, "file://"+good))
+	require.NoError(t, err)
+	require.NoError(t, r.Fetch(ctx, u))
+
+	aid, err := r.Pull(ctx, u, "tool")
+	require.NoError(t, err)
+	require.Equal(t, string(content), readAssetBlob(t, r, aid))
+
+	// assets without a sha256 label cannot be verified, so they are always pulled from the source
+	aid, err = r.Pull(ctx, u, "other")
+	require.NoError(t, err)
+	require.Equal(t, "asset other", readAssetBlob(t, r, aid))
+
+	// the source is used if no mirror has the asset
+	r, err = Open(p, WithSources(reg), WithMirrors(u, empty))
+	require.NoError(t, err)
+	aid, err = r.Pull(ctx, u, "tool")
+	require.NoError(t, err)
+	require.Equal(t, "asset tool", readAssetBlob(t, r, aid))
+}
+
+func TestPullSignature(t *testing.T) {
+	ctx := context.Background()
+	pub, keyID, sign := newMinisignKey(t)
+	sums := []byte(fmt.Sprintf("%x  tool-b\n", sha256.Sum256([]byte("tool b"))))
+	src := &fileSource{files: map[string][]byte{
+		"a":        []byte("tool a"),
+		"a.sig":    sign([]byte("tool a")),
+		"b":        []byte("tool b"),
+		"sums":     sums,
+		"sums.sig": sign(sums),
+		"bad":      []byte("tampered"),
+		"unsigned": []byte("tool c"),
+	}}
+	src.assets = []sources.RemoteAsset{
+		{ID: "a", Labels: bpmmd.LabelSet{"filename": "tool-a", "signature": "a.sig"}},
+		{ID: "b", Labels: bpmmd.LabelSet{"filename": "tool-b", "signature": "sums.sig", "signature_for": "sums"}},
+		{ID: "bad", Labels: bpmmd.LabelSet{"filename": "tool-a", "signature": "a.sig"}},
+		{ID: "unsigned", Labels: bpmmd.LabelSet{"filename": "tool-c"}},
+	}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	p := t.TempDir()
+	require.NoError(t, Init(ctx, p))
+	u := sources.URL{Scheme: "test", Path: "a"}
+	config := func(require bool) *Config {
+		return &Config{Sources: map[string]SourceConfig{
+			"test": {URL: u.String(), TrustedKeys: []string{string(pub)}, RequireSignature: require},
+		}}
+	}
+	r, err := Open(p, WithSources(reg), WithConfig(config(false)))
+	require.NoError(t, err)
+	require.NoError(t, r.Fetch(ctx, u))
+
+	for _, id := range []string{"a", "b"} {
+		aid, err := r.Pull(ctx, u, id)
+		require.NoError(t, err)
+		a, err := r.GetAsset(ctx, aid)
+		require.NoError(t, err)
+		require.Equal(t, "true", a.Labels["signature_verified"], id)
+		require.Equal(t, "minisign:"+keyID, a.Labels["signed_by"], id)
+		require.Equal(t, string(src.files[id]), readAssetBlob(t, r, aid))
+	}
+	// a bad signature is always rejected
+	_, err = r.Pull(ctx, u, "bad")
+	require.ErrorIs(t, err, sigverify.ErrBadSignature)
+	// unsigned assets are only labeled, unless signatures are required
+	aid, err := r.Pull(ctx, u, "unsigned")
+	require.NoError(t, err)
+	a, err := r.GetAsset(ctx, aid)
+	require.NoError(t, err)
+	require.Equal(t, "false", a.Labels["signature_verified"])
+
+	r, err = Open(p, WithSources(reg), WithConfig(config(true)))
+	require.NoError(t, err)
+	_, err = r.Pull(ctx, u, "unsigned")
+	require.ErrorIs(t, err, ErrUnsigned)
+	_, err = r.Pull(ctx, u, "a")
+	require.NoError(t, err)
+}
+
+func TestPullPinned(t *testing.T) {
+	ctx := context.Background()
+	src := &fileSource{files: map[string][]byte{"a": []byte("tool a")}}
+	src.assets = []sources.RemoteAsset{{ID: "a", Labels: bpmmd.LabelSet{"filename": "tool-a"}}}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	r := newTestRepo(t, WithSources(reg))
+	u := sources.URL{Scheme: "test", Path: "a"}
+	require.NoError(t, r.Fetch(ctx, u))
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("tool a")))
+
+	aid, err := r.Resolve(ctx, DeploySpec{Source: u, Query: `.filename == "tool-a"`, SHA256: sum})
+	require.NoError(t, err)
+	a, err := r.GetAsset(ctx, aid)
+	require.NoError(t, err)
+	require.Equal(t, sum, a.Labels["sha256"])
+	_, err = r.Pull(ctx, u, "a", ExpectCID(a.Root.CID))
+	require.NoError(t, err)
+
+	// upstream re-uploads the asset
+	src.files["a"] = []byte("tool a, again")
+	_, err = r.Pull(ctx, u, "a", ExpectSHA256(sum))
+	require.ErrorIs(t, err, ErrPinMismatch)
+	_, err = r.Pull(ctx, u, "a", ExpectCID(a.Root.CID))
+	require.ErrorIs(t, err, ErrPinMismatch)
+	// the asset still has the content it was pinned to
+	require.Equal(t, "tool a", readAssetBlob(t, r, aid))
+}
+
+func TestPolicy(t *testing.T) {
+	ctx := context.Background()
+	src := &endpointSource{endpoint: "https://example.com"}
+	src.files = map[string][]byte{}
+	for _, id := range []string{"stable", "pre", "nosum", "forged"} {
+		src.files[id] = []byte("asset " + id)
+	}
+	sum := func(id string) string { return fmt.Sprintf("%x", sha256.Sum256(src.files[id])) }
+	src.assets = []sources.RemoteAsset{
+		{ID: "stable", Labels: bpmmd.LabelSet{"prerelease": "false", "sha256": sum("stable")}},
+		{ID: "pre", Labels: bpmmd.LabelSet{"prerelease": "true", "sha256": sum("pre")}},
+		{ID: "nosum", Labels: bpmmd.LabelSet{"prerelease": "false"}},
+		// the source claims checks which were never made
+		{ID: "forged", Labels: bpmmd.LabelSet{"prerelease": "false", "signature_verified": "true", "signed_by": "minisign:0123456789ABCDEF"}},
+	}
+	reg := sources.NewRegistry()
+	reg.Register("test", func(params sources.Params) (sources.Source, error) {
+		return src, nil
+	})
+	u := sources.URL{Scheme: "test", Path: "a"}
+	config := &Config{Policies: map[string]Policy{
+		"test": {Labels: map[string][]string{"prerelease": {"false"}}},
+	}}
+	require.NoError(t, config.Validate())
+	r := newTestRepo(t, WithSources(reg), WithConfig(config), WithPolicy(u, Policy{HTTPSOnly: true, RequireChecksum: true}))
+	require.NoError(t, r.Fetch(ctx, u))
+	install := func(r *Repo, id string) error {
+		aid, err := r.Pull(ctx, u, id)
+		require.NoError(t, err)
+		a, err := r.GetAsset(ctx, aid)
+		require.NoError(t, err)
+		_, err = r.Modfiy(ctx, func(tlds map[string]glfs.Ref) error {
+			tlds[id] = a.Root
+			return nil
+		})
+		return err
+	}
+	require.NoError(t, install(r, "stable"))
+	before, err := r.GetCurrent(ctx)
+	require.NoError(t, err)
+
+	err = install(r, "pre")
+	require.ErrorIs(t, err, ErrPolicy)
+	require.ErrorContains(t, err, "rule labels")
+	require.ErrorContains(t, err, `scheme "test"`)
+	err = install(r, "nosum")
+	require.ErrorIs(t, err, ErrPolicy)
+	require.ErrorContains(t, err, "rule require_checksum")
+	// a source cannot set the labels for the checks made by Pull
+	assets, err := r.ListAssetsBySource(ctx, &u, mustCompileJQ(t, `.signature_verified != null or .signed_by != null`))
+	require.NoError(t, err)
+	require.Empty(t, assets)
+	r3 := newTestRepo(t, WithSources(reg), WithPolicy(u, Policy{SignedBy: []string{"minisign:0123456789ABCDEF"}}))
+	require.NoError(t, r3.Fetch(ctx, u))
+	err = install(r3, "forged")
+	require.ErrorIs(t, err, ErrPolicy)
+	require.ErrorContains(t, err, "rule signed_by")
+	// nothing was committed
+	after, err := r.GetCurrent(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before.ID, after.ID)
+
+	// a local asset with the same content as an asset from the source does not bypass the policy
+	r2 := newTestRepo(t, WithSources(reg), WithConfig(config))
+	localID, err := r2.CreateAsset(ctx)
+	require.NoError(t, err)
+	sid, err := dbutil.DoTx1(ctx, r2.db, func(tx *sqlx.Tx) (uint64, error) { return getAssetStore(tx, localID) })
+	require.NoError(t, err)
+	ref, err := r2.glfsOp.PostBlob(ctx, sqlstores.NewStore(r2.db, Hash, MaxBlobSize, sid), strings.NewReader("asset pre"))
+	require.NoError(t, err)
+	require.NoError(t, dbutil.DoTx(ctx, r2.db, func(tx *sqlx.Tx) error { return putAssetRef(tx, localID, *ref) }))
+	require.NoError(t, r2.Fetch(ctx, u))
+	err = install(r2, "pre")
+	require.ErrorIs(t, err, ErrPolicy)
+	require.ErrorContains(t, err, "rule labels")
+
+	for _, tc := range []struct {
+		Name   string
+		Opts   []Option
+		Rule   string
+		Before func()
+	}{
+		{"http endpoint", nil, "rule https_only", func() { src.endpoint = "http://example.com" }},
+		{"http mirror", []Option{WithMirrors(u, "http://mirror.example.com")}, "rule https_only", nil},
+		{"max size", []Option{WithPolicy(u, Policy{MaxSize: 4})}, "rule max_size", nil},
+		{"signed by", []Option{WithPolicy(u, Policy{SignedBy: []string{"minisign:0123456789ABCDEF"}})}, "rule signed_by", nil},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			src.endpoint = "https://example.com"
+			if tc.Before != nil {
+				tc.Before()
+			}
+			opts := append([]Option{WithSources(reg), WithPolicy(u, Policy{HTTPSOnly: true})}, tc.Opts...)
+			r := newTestRepo(t, opts...)
+			require.NoError(t, r.Fetch(ctx, u))
+			err := install(r, "stable")
+			require.ErrorIs(t, err, ErrPolicy)
+			require.ErrorContains(t, err, tc.Rule)
+		})
+	}
+}
+
+func readAssetBlob(t testing.TB, r *Repo, aid uint64) string {
+	ctx := context.Background()
+	a, err := r.GetAsset(ctx, aid)
+	require.NoError(t, err)
+	sid, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (uint64, error) { return getAssetStore(tx, aid) })
+	require.NoError(t, err)
+	s := sqlstores.NewStore(r.db, Hash, MaxBlobSize, sid)
+	data, err := glfs.GetBlobBytes(ctx, s, a.Root)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// listSource is a source which lists whatever assets it is given
+type listSource struct {
+	testSource
+	assets  []sources.RemoteAsset
+	partial bool
+	err     error
+	fetches int
+}
+
+func (s *listSource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	s.fetches++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return streams.NewSlice(s.assets, nil), nil
+}
+
+func (s *listSource) IsPartial() bool {
+	return s.partial
+}
+
+// fileSource is a listSource with assets that are files
+type fileSource struct {
+	listSource
+	files map[string][]byte
+}
+
+func (s *fileSource) Open(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	data, ok := s.files[id]
+	if !ok {
+		return nil, "", fmt.Errorf("no file %q", id)
+	}
+	return io.NopCloser(bytes.NewReader(data)), id, nil
+}
+
+func (s *fileSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	rc, name, err := s.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return unpack.Import(ctx, op, store, name, rc)
+}
+
+// newMinisignKey returns a new minisign public key and its ID, and a function to sign messages with it.
+func newMinisignKey(t testing.TB) (pubFile []byte, keyID string, sign func([]byte) []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var id [8]byte
+	_, err = rand.Read(id[:])
+	require.NoError(t, err)
+	pubFile = []byte("untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id[:]...), pub...)) + "\n")
+	keyID = fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+	return pubFile, keyID, func(msg []byte) []byte {
+		h := blake2b.Sum512(msg)
+		sig := ed25519.Sign(priv, h[:])
+		comment := "timestamp:1700000000"
+		global := ed25519.Sign(priv, append(sig, comment...))
+		return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+			base64.StdEncoding.EncodeToString(append(append([]byte("ED"), id[:]...), sig...)), comment, base64.StdEncoding.EncodeToString(global)))
+	}
+}
+
+// endpointSource is a fileSource with an endpoint
+type endpointSource struct {
+	fileSource
+	endpoint string
+}
+
+func (s *endpointSource) Endpoint() string {
+	return s.endpoint
+}
+
+type testSource struct{}
+
+func (testSource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	return streams.NewSlice([]sources.RemoteAsset{
+		{ID: "1.0", Labels: bpmmd.LabelSet{"version": "1.0"}},
+	}, nil), nil
+}
+
+func (testSource) Pull(ctx context.Context, op *glfs.Operator, s cadata.Store, id string) (*sources.PullResult, error) {
+	ref, err := op.PostBlob(ctx, s, strings.NewReader("asset "+id))
+	if err != nil {
+		return nil, err
+	}
+	return &sources.PullResult{Root: *ref, Labels: bpmmd.LabelSet{"package_name": "test"}}, nil
+}
+
+func mustCompileJQ(t testing.TB, x string) *gojq.Code {
+	q, err := gojq.Parse(x)
+	require.NoError(t, err)
+	code, err := gojq.Compile(q)
+	require.NoError(t, err)
+	return code
+}
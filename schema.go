@@ -75,6 +75,40 @@ var schema = func() *migrations.State {
 		PRIMARY KEY(blob_id, ref)
 	)`)
 
+	x = x.ApplyStmt(`CREATE TABLE source_cache (
+		scheme TEXT NOT NULL,
+		path TEXT NOT NULL,
+		k TEXT NOT NULL,
+		v BLOB NOT NULL,
+
+		PRIMARY KEY(scheme, path, k)
+	)`)
+
+	// generation is incremented by each fetch of a source, rows which were not seen by the latest complete fetch are gone.
+	x = x.ApplyStmt(`ALTER TABLE upstreams ADD COLUMN generation INTEGER NOT NULL DEFAULT 0`)
+	x = x.ApplyStmt(`ALTER TABLE upstreams ADD COLUMN gone_at TIMESTAMP`)
+
+	x = x.ApplyStmt(`CREATE TABLE source_status (
+		scheme TEXT NOT NULL,
+		path TEXT NOT NULL,
+		last_attempt TIMESTAMP NOT NULL,
+		last_success TIMESTAMP,
+		asset_count INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+
+		PRIMARY KEY(scheme, path)
+	)`)
+
+	// asset_verifications records what Pull checked itself about the file for an asset.
+	// Unlike labels, these cannot be set by sources.
+	x = x.ApplyStmt(`CREATE TABLE asset_verifications (
+		asset_id INTEGER NOT NULL REFERENCES assets(id),
+		sha256 TEXT NOT NULL DEFAULT '',
+		signed_by TEXT NOT NULL DEFAULT '',
+
+		PRIMARY KEY(asset_id)
+	)`)
+
 	return x
 }()
 
@@ -4,36 +4,160 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"io"
 	"path"
 	"strings"
 	"time"
 
 	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
 	"github.com/brendoncarroll/stdctx/logctx"
 	"github.com/itchyny/gojq"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/checksum"
 	"github.com/blobcache/bpm/internal/dbutil"
 	"github.com/blobcache/bpm/internal/sqlstores"
+	"github.com/blobcache/bpm/internal/unpack"
 	"github.com/blobcache/bpm/sources"
+	"github.com/blobcache/bpm/sources/apt"
+	"github.com/blobcache/bpm/sources/execsource"
 	"github.com/blobcache/bpm/sources/github"
+	"github.com/blobcache/bpm/sources/goproxy"
 	"github.com/blobcache/bpm/sources/httpscrape"
+	"github.com/blobcache/bpm/sources/npm"
+	"github.com/blobcache/bpm/sources/oci"
+	"github.com/blobcache/bpm/sources/pypi"
 )
 
-// MakeSource creates a new source from a URL
+func init() {
+	RegisterBuiltinSources(sources.DefaultRegistry)
+}
+
+// RegisterBuiltinSources registers the source types included with bpm in reg.
+func RegisterBuiltinSources(reg *sources.Registry) {
+	reg.Register("github", func(params sources.Params) (sources.Source, error) {
+		host, account, repo, err := github.ParsePath(params.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		opts := []github.Option{github.WithCache(params.Cache)}
+		if host != "" {
+			opts = append(opts, github.WithBaseURL(github.EnterpriseAPIURL(host)))
+		}
+		filterOpts, err := github.ParseOptions(params.Options)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, filterOpts...)
+		return github.NewGitHubSource(account, repo, opts...)
+	})
+	reg.Register("http", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		return httpscrape.NewHTTPScraper(params.URL.Path)
+	})
+	reg.Register("oci", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		host, name, ok := strings.Cut(params.URL.Path, "/")
+		if !ok {
+			return nil, errors.New("oci source must have the form oci:<host>/<name>")
+		}
+		return oci.NewOCISource("https://"+host, name)
+	})
+	reg.Register("goproxy", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		return goproxy.NewGoProxySource(goproxy.ProxyFromEnv(), params.URL.Path)
+	})
+	reg.Register("pypi", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		return pypi.NewPyPISource(pypi.IndexFromEnv(), params.URL.Path)
+	})
+	reg.Register("npm", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		return npm.NewNPMSource(npm.RegistryFromEnv(), params.URL.Path)
+	})
+	reg.Register("apt", func(params sources.Params) (sources.Source, error) {
+		if err := noOptions(params); err != nil {
+			return nil, err
+		}
+		repo, suite, component, arch, err := apt.ParsePath(params.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		return apt.NewAPTSource("https://"+repo, suite, component, arch)
+	})
+}
+
+// noOptions returns an error if any options were passed to a source which does not accept them.
+func noOptions(params sources.Params) error {
+	if len(params.Options) > 0 {
+		return fmt.Errorf("%s sources do not accept options", params.URL.Scheme)
+	}
+	return nil
+}
+
+// MakeSource creates a new source from a URL, using the sources.DefaultRegistry
 func MakeSource(u sources.URL) (sources.Source, error) {
-	switch u.Scheme {
-	case "github":
-		parts := strings.SplitN(u.Path, "/", 2)
-		return github.NewGitHubSource(parts[0], parts[1]), nil
-	case "http":
-		s, err := httpscrape.NewHTTPScraper(u.Path)
-		return s, err
-	default:
-		return nil, errors.New("unrecognized URL scheme")
+	return makeSource(sources.DefaultRegistry, sources.Params{URL: u})
+}
+
+// makeSource creates a source using reg.
+// If the scheme is not registered, a program named bpm-source-<scheme> on PATH is used instead.
+func makeSource(reg *sources.Registry, params sources.Params) (sources.Source, error) {
+	src, err := reg.Make(params)
+	if errors.Is(err, sources.ErrUnknownScheme) {
+		if program, err2 := execsource.Lookup(params.URL.Scheme); err2 == nil {
+			if err := noOptions(params); err != nil {
+				return nil, err
+			}
+			return execsource.New(program, params.URL), nil
+		}
 	}
+	return src, err
+}
+
+// makeSource creates the source for u, with a cache stored in the repo.
+// The options for u in the config are used, unless they are overridden by opts.
+func (r *Repo) makeSource(u sources.URL, opts map[string]string) (sources.Source, error) {
+	return makeSource(r.sources, sources.Params{
+		URL:     u,
+		Cache:   sourceCache{db: r.db, u: u},
+		Options: r.mergeSourceOptions(u, opts),
+	})
+}
+
+// sourceCache is a sources.Cache stored in the database
+type sourceCache struct {
+	db *sqlx.DB
+	u  sources.URL
+}
+
+func (c sourceCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var ret []byte
+	err := c.db.GetContext(ctx, &ret, `SELECT v FROM source_cache WHERE scheme = ? AND path = ? AND k = ?`, c.u.Scheme, c.u.Path, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return ret, err
+}
+
+func (c sourceCache) Put(ctx context.Context, key string, value []byte) error {
+	_, err := c.db.ExecContext(ctx, `INSERT INTO source_cache (scheme, path, k, v) VALUES (?, ?, ?, ?)
+		ON CONFLICT (scheme, path, k) DO UPDATE SET v = excluded.v`, c.u.Scheme, c.u.Path, key, value)
+	return err
 }
 
 // UpstreamURL uniquely identifies a remote asset
@@ -48,7 +172,34 @@ func (u UpstreamURL) String() string {
 
 // Fetch creates metadata-only assets for all of assets in the source.
 func (r *Repo) Fetch(ctx context.Context, srcURL sources.URL) error {
-	src, err := MakeSource(srcURL)
+	return r.FetchWithOptions(ctx, srcURL, nil)
+}
+
+// FetchWithOptions is like Fetch, but passes options to the source.
+// The options are specific to each kind of source, see sources.Params.
+func (r *Repo) FetchWithOptions(ctx context.Context, srcURL sources.URL, opts map[string]string) error {
+	if r.offline {
+		return ErrOffline
+	}
+	src, err := r.makeSource(srcURL, opts)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	fetchErr := r.fetch(ctx, srcURL, src)
+	if err := dbutil.DoTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		return putSourceStatus(tx, srcURL, start, fetchErr)
+	}); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+// fetch lists the assets in src, and marks any which are no longer listed as gone.
+func (r *Repo) fetch(ctx context.Context, srcURL sources.URL, src sources.Source) error {
+	gen, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (uint64, error) {
+		return nextGeneration(tx, srcURL)
+	})
 	if err != nil {
 		return err
 	}
@@ -57,24 +208,27 @@ func (r *Repo) Fetch(ctx context.Context, srcURL sources.URL) error {
 		return err
 	}
 
-	eg, ctx := errgroup.WithContext(ctx)
+	eg, ctx2 := errgroup.WithContext(ctx)
 	results := make(chan sources.RemoteAsset)
 	eg.Go(func() error {
 		defer close(results)
-		return streams.LoadChan(ctx, it, results)
+		return streams.LoadChan(ctx2, it, results)
 	})
 	eg.Go(func() error {
 		const batchSize = 1000
 		const timeout = 100 * time.Millisecond
 		it := streams.NewBatcher[sources.RemoteAsset](streams.Chan[sources.RemoteAsset](results), batchSize, timeout)
-		return streams.ForEach[[]sources.RemoteAsset](ctx, it, func(xs []sources.RemoteAsset) error {
-			return dbutil.DoTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		return streams.ForEach[[]sources.RemoteAsset](ctx2, it, func(xs []sources.RemoteAsset) error {
+			return dbutil.DoTx(ctx2, r.db, func(tx *sqlx.Tx) error {
 				for _, x := range xs {
 					assetID, err := getOrCreateUpstream(tx, srcURL.Scheme, srcURL.Path, x.ID)
 					if err != nil {
 						return err
 					}
-					if err := putLabelSet(tx, assetID, x.Labels); err != nil {
+					if err := markSeen(tx, srcURL, x.ID, assetID, gen); err != nil {
+						return err
+					}
+					if err := putLabelSet(tx, assetID, sourceLabels(x.Labels)); err != nil {
 						return err
 					}
 				}
@@ -82,35 +236,146 @@ func (r *Repo) Fetch(ctx context.Context, srcURL sources.URL) error {
 			})
 		})
 	})
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	// only a complete listing can show that an asset is gone
+	if ps, ok := src.(sources.PartialSource); ok && ps.IsPartial() {
+		return nil
+	}
+	gone, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) ([]uint64, error) {
+		return markGone(tx, srcURL, gen, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+	if len(gone) > 0 {
+		logctx.Infof(ctx, "%d assets from %v are gone upstream", len(gone), srcURL)
+		return r.warnDeployedGone(ctx, srcURL, gone)
+	}
+	return nil
 }
 
-func (r *Repo) FetchAll(ctx context.Context) error {
+// EnsureFresh fetches the source at u if its last successful fetch is older than its metadata TTL.
+// If the fetch fails, but the source has been fetched before, a warning is logged and the old metadata is used.
+// When the Repo is offline, the existing metadata is always used.
+func (r *Repo) EnsureFresh(ctx context.Context, u sources.URL) error {
+	ttl, ok := r.sourceTTLs[u]
+	if !ok {
+		ttl = r.ttl
+	}
+	if r.offline || ttl <= 0 {
+		return nil
+	}
+	st, err := r.GetSourceStatus(ctx, u)
+	if err != nil {
+		return err
+	}
+	if st != nil && time.Since(st.LastSuccess) < ttl {
+		return nil
+	}
+	logctx.Infof(ctx, "metadata for %v is stale, fetching", u)
+	if err := r.Fetch(ctx, u); err != nil {
+		if st == nil || st.LastSuccess.IsZero() {
+			return err
+		}
+		logctx.Warnf(ctx, "fetching %v: %v, using metadata from %v", u, err, st.LastSuccess)
+	}
+	return nil
+}
+
+// Resolve finds the single asset from spec.Source which matches spec.Query, and pulls it.
+// If spec pins the content of the asset, the pulled content must match, see ExpectCID and ExpectSHA256.
+// The source is fetched first if its metadata is stale.
+func (r *Repo) Resolve(ctx context.Context, spec DeploySpec) (uint64, error) {
+	if err := r.EnsureFresh(ctx, spec.Source); err != nil {
+		return 0, err
+	}
+	q, err := gojq.Parse(spec.Query)
+	if err != nil {
+		return 0, err
+	}
+	code, err := gojq.Compile(q)
+	if err != nil {
+		return 0, err
+	}
+	assets, err := r.ListAssetsBySource(ctx, &spec.Source, code)
+	if err != nil {
+		return 0, err
+	}
+	switch len(assets) {
+	case 0:
+		return 0, fmt.Errorf("no assets in %v match %q", spec.Source, spec.Query)
+	case 1:
+	default:
+		return 0, fmt.Errorf("%d assets in %v match %q, the query must match exactly one", len(assets), spec.Source, spec.Query)
+	}
+	return r.Pull(ctx, spec.Source, assets[0].Upstream.ID, spec.PullOptions()...)
+}
+
+// FetchAll fetches every source which has been fetched before.
+// A source which fails does not stop the others, the status of every source is returned,
+// along with an error for each one which failed.
+func (r *Repo) FetchAll(ctx context.Context) ([]SourceStatus, error) {
 	var rows []struct {
 		Scheme string `db:"scheme"`
 		Path   string `db:"path"`
 	}
-	if err := r.db.SelectContext(ctx, &rows, `SELECT distinct scheme, path FROM upstreams`); err != nil {
-		return err
+	if err := r.db.SelectContext(ctx, &rows, `SELECT scheme, path FROM upstreams
+		UNION SELECT scheme, path FROM source_status
+		ORDER BY scheme, path`); err != nil {
+		return nil, err
 	}
+	errs := make([]error, len(rows))
 	var eg errgroup.Group
 	eg.SetLimit(10)
-	for _, row := range rows {
+	for i, row := range rows {
+		i := i
 		u := sources.URL{
 			Scheme: row.Scheme,
 			Path:   row.Path,
 		}
 		logctx.Infof(ctx, "fetching asset metadata from %v", u)
 		eg.Go(func() error {
-			return r.Fetch(ctx, u)
+			if err := r.Fetch(ctx, u); err != nil {
+				logctx.Warnf(ctx, "fetching %v: %v", u, err)
+				errs[i] = fmt.Errorf("fetching %v: %w", u, err)
+			}
+			return nil
 		})
 	}
-	return eg.Wait()
+	eg.Wait()
+	ret := make([]SourceStatus, 0, len(rows))
+	for _, row := range rows {
+		st, err := r.GetSourceStatus(ctx, sources.URL{Scheme: row.Scheme, Path: row.Path})
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			ret = append(ret, *st)
+		}
+	}
+	return ret, errors.Join(errs...)
 }
 
-// Pull pulls the content for an asset from source
-func (r *Repo) Pull(ctx context.Context, u sources.URL, idstr string) (uint64, error) {
-	src, err := MakeSource(u)
+// Pull pulls the content for an asset from source.
+// Any labels which the source found in the content are added to the asset.
+// If the source has mirrors, they are tried first, see WithMirrors.
+// If the source has trusted keys, the asset's signature is checked before it is stored, see SourceConfig.TrustedKeys.
+// The content can be pinned with opts, and nothing is stored for the asset if it does not match.
+// When the Repo is offline, only assets which have already been pulled can be used.
+func (r *Repo) Pull(ctx context.Context, u sources.URL, idstr string, opts ...PullOption) (uint64, error) {
+	var pc pullConfig
+	for _, opt := range opts {
+		opt(&pc)
+	}
+	if pc.sha256 != "" && !checksum.IsSHA256(pc.sha256) {
+		return 0, fmt.Errorf("invalid sha256 %q", pc.sha256)
+	}
+	if r.offline {
+		return r.pullOffline(ctx, u, idstr, pc)
+	}
+	src, err := r.makeSource(u, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -125,20 +390,162 @@ func (r *Repo) Pull(ctx context.Context, u sources.URL, idstr string) (uint64, e
 		return 0, err
 	}
 	s := sqlstores.NewStore(r.db, Hash, MaxBlobSize, sid)
-	ref, err := src.Pull(ctx, &r.glfsOp, s, idstr)
+	labels, err := dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (LabelSet, error) { return getLabelSet(tx, aid) })
 	if err != nil {
 		return 0, err
 	}
-	if err := dbutil.DoTx(ctx, r.db, func(tx *sqlx.Tx) error { return putAssetRef(tx, aid, *ref) }); err != nil {
+	if pc.sha256 != "" {
+		if want := labels["sha256"]; want != "" && !strings.EqualFold(want, pc.sha256) {
+			return 0, fmt.Errorf("%v/%s: %w: source has sha256 %s, pinned %s", u, idstr, ErrPinMismatch, want, pc.sha256)
+		}
+	}
+	f, filename, err := r.openVerified(ctx, u, src, idstr, labels, pc.sha256)
+	if err != nil {
+		return 0, err
+	}
+	var v verification
+	if f != nil {
+		defer f.Close()
+		// openVerified only returns a file which matches the pin, or the sha256 label
+		v.SHA256 = strings.ToLower(labels["sha256"])
+		if pc.sha256 != "" {
+			v.SHA256 = strings.ToLower(pc.sha256)
+		}
+	}
+	var extraLabels LabelSet
+	if pol, ok := r.sigPolicies[u]; ok {
+		if extraLabels, err = r.checkSignature(ctx, src, pol, labels, f, filename); err != nil {
+			return 0, err
+		}
+		if extraLabels["signature_verified"] == "true" {
+			v.SignedBy = extraLabels["signed_by"]
+		}
+	}
+	var res *sources.PullResult
+	if f != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if res, err = unpack.Import(ctx, &r.glfsOp, s, path.Base(filename), f); err != nil {
+			return 0, err
+		}
+	} else if res, err = src.Pull(ctx, &r.glfsOp, s, idstr); err != nil {
+		return 0, err
+	}
+	if !pc.cid.IsZero() && res.Root.CID != pc.cid {
+		return 0, fmt.Errorf("%v/%s: %w: pulled cid %v, pinned %v", u, idstr, ErrPinMismatch, res.Root.CID, pc.cid)
+	}
+	if pc.sha256 != "" {
+		extraLabels = mergeLabels(extraLabels, LabelSet{"sha256": strings.ToLower(pc.sha256)})
+	}
+	labels = mergeLabels(sourceLabels(res.Labels), extraLabels)
+	if err := dbutil.DoTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		if err := putAssetRef(tx, aid, res.Root); err != nil {
+			return err
+		}
+		if err := putVerification(tx, aid, v); err != nil {
+			return err
+		}
+		return putLabelSet(tx, aid, labels)
+	}); err != nil {
 		return 0, err
 	}
 	return aid, nil
 }
 
+// ListOption is an option for ListAssetsBySource
+type ListOption func(*listConfig)
+
+type listConfig struct {
+	includeGone bool
+}
+
+// IncludeGone includes assets which are gone upstream in the results.
+func IncludeGone() ListOption {
+	return func(c *listConfig) {
+		c.includeGone = true
+	}
+}
+
+// mergeLabels returns a new LabelSet with the labels from a, overridden by b
+func mergeLabels(a, b LabelSet) LabelSet {
+	ret := make(LabelSet, len(a)+len(b))
+	for k, v := range a {
+		ret[k] = v
+	}
+	for k, v := range b {
+		ret[k] = v
+	}
+	return ret
+}
+
+// PullOption is an option for Pull
+type PullOption func(*pullConfig)
+
+type pullConfig struct {
+	cid    cadata.ID
+	sha256 string
+}
+
+// ExpectCID causes Pull to fail with ErrPinMismatch if the root of the pulled asset is not id.
+// Nothing is stored for the asset if it does not match.
+func ExpectCID(id cadata.ID) PullOption {
+	return func(c *pullConfig) {
+		c.cid = id
+	}
+}
+
+// ExpectSHA256 causes Pull to fail with ErrPinMismatch if the file for the asset, before it is unpacked, does not have the hex encoded sha256 hash sum.
+// The file is checked before it is imported, so the source must be able to provide it, see sources.FileSource.
+func ExpectSHA256(sum string) PullOption {
+	return func(c *pullConfig) {
+		c.sha256 = sum
+	}
+}
+
+// pullOffline returns the asset for an upstream, if it has already been pulled.
+// Pins are checked against the stored asset.
+func (r *Repo) pullOffline(ctx context.Context, u sources.URL, idstr string, pc pullConfig) (uint64, error) {
+	return dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (uint64, error) {
+		var aid uint64
+		err := tx.Get(&aid, `SELECT asset_id FROM upstreams WHERE scheme = ? AND path = ? AND remote_id = ?`, u.Scheme, u.Path, idstr)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%v/%s has not been pulled: %w", u, idstr, ErrOffline)
+		} else if err != nil {
+			return 0, err
+		}
+		ref, err := getAssetRef(tx, aid)
+		if err != nil {
+			return 0, err
+		}
+		if ref.Type == "" {
+			return 0, fmt.Errorf("%v/%s has not been pulled: %w", u, idstr, ErrOffline)
+		}
+		if !pc.cid.IsZero() && ref.CID != pc.cid {
+			return 0, fmt.Errorf("%v/%s: %w: have cid %v, pinned %v", u, idstr, ErrPinMismatch, ref.CID, pc.cid)
+		}
+		if pc.sha256 != "" {
+			v, err := getVerification(tx, aid)
+			if err != nil {
+				return 0, err
+			}
+			if have := v.SHA256; !strings.EqualFold(have, pc.sha256) {
+				return 0, fmt.Errorf("%v/%s: %w: have sha256 %q, pinned %s", u, idstr, ErrPinMismatch, have, pc.sha256)
+			}
+		}
+		return aid, nil
+	})
+}
+
 // Search searches locally cached remote assets for a source.
 // To search assets originating locally pass nil for srcURL
-func (r *Repo) ListAssetsBySource(ctx context.Context, srcURL *sources.URL, code *gojq.Code) ([]Asset, error) {
-	qstr := `SELECT assets.id FROM assets
+// Assets which are gone upstream are not included, unless IncludeGone is passed.
+func (r *Repo) ListAssetsBySource(ctx context.Context, srcURL *sources.URL, code *gojq.Code, opts ...ListOption) ([]Asset, error) {
+	var cfg listConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	qstr := `SELECT DISTINCT assets.id FROM assets
 		JOIN asset_labels ON asset_labels.asset_id = assets.id
 		JOIN upstreams ON upstreams.asset_id = assets.id
 	`
@@ -149,6 +556,9 @@ func (r *Repo) ListAssetsBySource(ctx context.Context, srcURL *sources.URL, code
 	} else {
 		qstr += " WHERE assets.upstream_id IS NULL"
 	}
+	if !cfg.includeGone {
+		qstr += " AND upstreams.gone_at IS NULL"
+	}
 	var fromDB []uint64
 	if err := r.db.SelectContext(ctx, &fromDB, qstr, args...); err != nil {
 		return nil, err
@@ -206,6 +616,79 @@ func getOrCreateUpstream(tx *sqlx.Tx, scheme, path, remoteID string) (ret uint64
 	return ret, err
 }
 
+// nextGeneration returns the generation for a new fetch of a source.
+func nextGeneration(tx *sqlx.Tx, u sources.URL) (ret uint64, _ error) {
+	err := tx.Get(&ret, `SELECT COALESCE(MAX(generation), 0) + 1 FROM upstreams WHERE scheme = ? AND path = ?`, u.Scheme, u.Path)
+	return ret, err
+}
+
+// markSeen records that a fetch with generation gen listed an upstream.
+// If the upstream was gone, it is restored.
+func markSeen(tx *sqlx.Tx, u sources.URL, remoteID string, aid, gen uint64) error {
+	if _, err := tx.Exec(`UPDATE upstreams SET generation = ?, gone_at = NULL WHERE scheme = ? AND path = ? AND remote_id = ?`, gen, u.Scheme, u.Path, remoteID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM asset_labels WHERE asset_id = ? AND k IN ('gone', 'gone_at')`, aid)
+	return err
+}
+
+// markGone marks the upstreams for a source which were listed by an earlier fetch, but not by the fetch with generation gen, as gone.
+// Upstreams which were pulled by ID but never listed have generation 0, and are left alone.
+// It returns the assets which are newly gone.
+func markGone(tx *sqlx.Tx, u sources.URL, gen uint64, now time.Time) ([]uint64, error) {
+	var aids []uint64
+	if err := tx.Select(&aids, `SELECT asset_id FROM upstreams
+		WHERE scheme = ? AND path = ? AND generation > 0 AND generation < ? AND gone_at IS NULL`, u.Scheme, u.Path, gen); err != nil {
+		return nil, err
+	}
+	labels := LabelSet{"gone": "true"}
+	labels.PutTAI64("gone_at", now)
+	for _, aid := range aids {
+		if _, err := tx.Exec(`UPDATE upstreams SET gone_at = ? WHERE asset_id = ?`, now, aid); err != nil {
+			return nil, err
+		}
+		if err := putLabelSet(tx, aid, labels); err != nil {
+			return nil, err
+		}
+	}
+	return aids, nil
+}
+
+// warnDeployedGone logs a warning for each TLD in the current deployment which came from one of the gone assets.
+func (r *Repo) warnDeployedGone(ctx context.Context, u sources.URL, gone []uint64) error {
+	commit, err := r.GetCurrent(ctx)
+	if err != nil || commit == nil {
+		return err
+	}
+	snap, err := r.GetSnapshot(ctx, commit.Snapshot)
+	if err != nil {
+		return err
+	}
+	isGone := map[uint64]bool{}
+	for _, aid := range gone {
+		isGone[aid] = true
+	}
+	return dbutil.DoTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		for p, root := range snap.TLDs {
+			aids, err := lookupAssetsByRoot(tx, root)
+			if err != nil {
+				return err
+			}
+			for _, aid := range aids {
+				if !isGone[aid] {
+					continue
+				}
+				up, err := lookupUpstream(tx, aid)
+				if err != nil {
+					return err
+				}
+				logctx.Warnf(ctx, "%s is deployed from %v, which is gone upstream", p, up)
+			}
+		}
+		return nil
+	})
+}
+
 func lookupUpstream(tx *sqlx.Tx, aid uint64) (*UpstreamURL, error) {
 	var row struct {
 		Scheme   string `db:"scheme"`
@@ -0,0 +1,269 @@
+// Package apt implements a Source for Debian APT repositories.
+package apt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/deb822"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+// maxIndexSize is the largest Release or Packages file which will be downloaded
+const maxIndexSize = 1 << 30
+
+var (
+	_ sources.Source         = &APTSource{}
+	_ sources.EndpointSource = &APTSource{}
+)
+
+// APTSource lists the binary packages for a single suite, component and architecture of a repository.
+type APTSource struct {
+	repo      url.URL
+	suite     string
+	component string
+	arch      string
+	hc        *http.Client
+}
+
+// NewAPTSource returns a source for the repository at repoURL e.g. https://deb.debian.org/debian
+func NewAPTSource(repoURL, suite, component, arch string) (*APTSource, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("apt: repository must be http or https, have %q", repoURL)
+	}
+	for _, x := range []string{suite, component, arch} {
+		if x == "" || strings.Contains(x, "/") {
+			return nil, fmt.Errorf("apt: invalid suite, component or architecture %q", x)
+		}
+	}
+	return &APTSource{
+		repo:      *u,
+		suite:     suite,
+		component: component,
+		arch:      arch,
+		hc:        http.DefaultClient,
+	}, nil
+}
+
+// ParsePath parses a path of the form <host>/<path>/<suite>/<component>/<arch>
+// e.g. deb.debian.org/debian/bookworm/main/amd64
+func ParsePath(x string) (repo, suite, component, arch string, _ error) {
+	parts := strings.Split(strings.Trim(x, "/"), "/")
+	if len(parts) < 4 {
+		return "", "", "", "", fmt.Errorf("apt: path must have the form <host>/<path>/<suite>/<component>/<arch>, have %q", x)
+	}
+	n := len(parts)
+	return strings.Join(parts[:n-3], "/"), parts[n-3], parts[n-2], parts[n-1], nil
+}
+
+// Endpoint implements sources.EndpointSource.
+func (s *APTSource) Endpoint() string {
+	return s.repo.String()
+}
+
+// Fetch lists the packages in the Packages index.
+func (s *APTSource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	pkgs, err := s.getPackages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var assets []sources.RemoteAsset
+	for _, p := range pkgs {
+		assets = append(assets, sources.RemoteAsset{
+			ID:     packageID(p),
+			Labels: packageLabels(p),
+		})
+	}
+	return streams.NewSlice(assets, nil), nil
+}
+
+// Pull downloads the package with id <name>_<version>_<arch>, checks it against the index,
+// and imports the contents of its data.tar
+func (s *APTSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	pkgs, err := s.getPackages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pkg deb822.Paragraph
+	for _, p := range pkgs {
+		if packageID(p) == id {
+			pkg = p
+			break
+		}
+	}
+	if pkg == nil {
+		return nil, fmt.Errorf("apt: no package %q in index", id)
+	}
+	var size int64
+	if _, err := fmt.Sscan(pkg["Size"], &size); err != nil {
+		return nil, fmt.Errorf("apt: package %q has invalid size: %w", id, err)
+	}
+	f, err := s.download(ctx, pkg["Filename"], IndexFile{SHA256: pkg["SHA256"], Size: size})
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	return unpack.Import(ctx, op, store, path.Base(pkg["Filename"]), f)
+}
+
+func packageID(p deb822.Paragraph) string {
+	return p["Package"] + "_" + p["Version"] + "_" + p["Architecture"]
+}
+
+func packageLabels(p deb822.Paragraph) bpmmd.LabelSet {
+	l := bpmmd.LabelSet{
+		"name":         p["Package"],
+		"version":      p["Version"],
+		"architecture": p["Architecture"],
+	}
+	for label, field := range map[string]string{
+		"depends":     "Depends",
+		"pre_depends": "Pre-Depends",
+		"section":     "Section",
+		"filename":    "Filename",
+		"sha256":      "SHA256",
+		"size":        "Size",
+		"source":      "Source",
+	} {
+		if v, ok := p[field]; ok {
+			l[label] = v
+		}
+	}
+	if desc, ok := p["Description"]; ok {
+		l["description"], _, _ = strings.Cut(desc, "\n")
+	}
+	return l
+}
+
+// getPackages downloads the Release file for the suite, and then the Packages index
+// listed in it, verifying the index against the checksum in the Release file.
+func (s *APTSource) getPackages(ctx context.Context) ([]deb822.Paragraph, error) {
+	relPath := path.Join("dists", s.suite, "Release")
+	rc, err := s.get(ctx, relPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readAll(rc, maxIndexSize)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var release deb822.Paragraph
+	if err := deb822.ReadParagraphs(bytes.NewReader(data), func(p deb822.Paragraph) error {
+		if release == nil {
+			release = p
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	files, err := parseChecksums(release["SHA256"])
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Join(s.component, "binary-"+s.arch)
+	for _, ext := range []string{".xz", ".gz", ""} {
+		idx, ok := files[path.Join(dir, "Packages"+ext)]
+		if !ok {
+			continue
+		}
+		f, err := s.download(ctx, path.Join("dists", s.suite, idx.Path), idx)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		r, err := unpack.Decompress(f)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		var ret []deb822.Paragraph
+		if err := deb822.ReadParagraphs(r, func(p deb822.Paragraph) error {
+			ret = append(ret, p)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("apt: Release for %s does not list a Packages index for %s", s.suite, dir)
+}
+
+// download writes the file at p, relative to the repository, to a temporary file and checks it against expected.
+// The returned file is positioned at the beginning.
+func (s *APTSource) download(ctx context.Context, p string, expected IndexFile) (*os.File, error) {
+	want, err := hex.DecodeString(expected.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("apt: invalid sha256 for %q", p)
+	}
+	rc, err := s.get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp("", "bpm-apt")
+	if err != nil {
+		return nil, err
+	}
+	if err := func() error {
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(rc, expected.Size+1))
+		if err != nil {
+			return err
+		}
+		if n != expected.Size {
+			return fmt.Errorf("apt: %s has size %d, expected %d", p, n, expected.Size)
+		}
+		if have := h.Sum(nil); !bytes.Equal(have, want) {
+			return fmt.Errorf("apt: sha256 mismatch for %s have %x want %x", p, have, want)
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		return err
+	}(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *APTSource) get(ctx context.Context, p string) (io.ReadCloser, error) {
+	u := s.repo
+	u.Path = path.Join(u.Path, p)
+	logctx.Infof(ctx, "downloading %v", u.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("apt: GET %s: %v", u.String(), res.Status)
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,244 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	repo.putPackage("hello", "2.10-3", testDeb(t, map[string]string{"./usr/bin/hello": "hello"}),
+		"Depends: libc6 (>= 2.34)",
+		"Description: example package based on GNU hello",
+		" The GNU hello program produces a familiar, friendly greeting.",
+		" .",
+		" It is an example of a GNU package.",
+	)
+	repo.putPackage("sl", "5.02-1", testDeb(t, map[string]string{"./usr/games/sl": "sl"}))
+	repo.publish()
+
+	src := repo.newSource(t)
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 100)
+	require.NoError(t, err)
+	require.Len(t, assets, 2)
+	require.Equal(t, "hello_2.10-3_amd64", assets[0].ID)
+	labels := assets[0].Labels
+	require.Equal(t, "hello", labels["name"])
+	require.Equal(t, "2.10-3", labels["version"])
+	require.Equal(t, "amd64", labels["architecture"])
+	require.Equal(t, "libc6 (>= 2.34)", labels["depends"])
+	require.Equal(t, "pool/main/h/hello/hello_2.10-3_amd64.deb", labels["filename"])
+	// only the synopsis of the description is used
+	require.Equal(t, "example package based on GNU hello", labels["description"])
+	require.Equal(t, "sl_5.02-1_amd64", assets[1].ID)
+}
+
+func TestFetchBadIndex(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	repo.putPackage("hello", "2.10-3", testDeb(t, map[string]string{"./usr/bin/hello": "hello"}))
+	repo.publish()
+	// the index is changed after the Release file was signed
+	repo.files["dists/stable/main/binary-amd64/Packages.gz"] = gzipData(t, []byte("Package: evil\nVersion: 1\nArchitecture: amd64\n"))
+
+	src := repo.newSource(t)
+	_, err := src.Fetch(ctx)
+	require.ErrorContains(t, err, "has size")
+
+	// an uncompressed index with the same size, but different content
+	delete(repo.files, "dists/stable/main/binary-amd64/Packages.gz")
+	good := repo.index()
+	repo.publishIndex(good)
+	repo.files["dists/stable/main/binary-amd64/Packages"] = bytes.Replace(good, []byte("hello"), []byte("evil!"), 1)
+	_, err = src.Fetch(ctx)
+	require.ErrorContains(t, err, "sha256 mismatch")
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	repo.putPackage("hello", "2.10-3", testDeb(t, map[string]string{"./usr/bin/hello": "#!/bin/sh\necho hello\n"}))
+	repo.publish()
+
+	src := repo.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "hello_2.10-3_amd64")
+	require.NoError(t, err)
+	ref, err := op.GetAtPath(ctx, s, res.Root, "usr/bin/hello")
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho hello\n", string(data))
+
+	_, err = src.Pull(ctx, &op, s, "hello_9.9_amd64")
+	require.ErrorContains(t, err, "no package")
+
+	// the package is replaced in the pool, but not the index
+	repo.files["pool/main/h/hello/hello_2.10-3_amd64.deb"] = testDeb(t, map[string]string{"./usr/bin/hello": "#!/bin/sh\necho evil\n"})
+	_, err = src.Pull(ctx, &op, s, "hello_2.10-3_amd64")
+	require.ErrorContains(t, err, "sha256 mismatch")
+}
+
+func TestParseChecksums(t *testing.T) {
+	files, err := parseChecksums("\n" +
+		" 0123 1234 main/binary-amd64/Packages\n" +
+		" 4567 567 main/binary-amd64/Packages.gz")
+	require.NoError(t, err)
+	require.Equal(t, map[string]IndexFile{
+		"main/binary-amd64/Packages":    {SHA256: "0123", Size: 1234, Path: "main/binary-amd64/Packages"},
+		"main/binary-amd64/Packages.gz": {SHA256: "4567", Size: 567, Path: "main/binary-amd64/Packages.gz"},
+	}, files)
+
+	_, err = parseChecksums(" 0123 main/binary-amd64/Packages")
+	require.Error(t, err)
+	_, err = parseChecksums(" 0123 big main/binary-amd64/Packages")
+	require.Error(t, err)
+}
+
+func TestParsePath(t *testing.T) {
+	repo, suite, component, arch, err := ParsePath("deb.debian.org/debian/bookworm/main/amd64")
+	require.NoError(t, err)
+	require.Equal(t, []string{"deb.debian.org/debian", "bookworm", "main", "amd64"}, []string{repo, suite, component, arch})
+	_, _, _, _, err = ParsePath("bookworm/main/amd64")
+	require.Error(t, err)
+}
+
+// testRepo is an in-process stand-in for an APT repository with one suite, component and architecture.
+type testRepo struct {
+	t   testing.TB
+	srv *httptest.Server
+
+	stanzas []string
+	files   map[string][]byte
+}
+
+func newTestRepo(t testing.TB) *testRepo {
+	r := &testRepo{
+		t:     t,
+		files: make(map[string][]byte),
+	}
+	r.srv = httptest.NewServer(r)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *testRepo) newSource(t testing.TB) *APTSource {
+	src, err := NewAPTSource(r.srv.URL+"/debian", "stable", "main", "amd64")
+	require.NoError(t, err)
+	return src
+}
+
+func (r *testRepo) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, ok := r.files[strings.TrimPrefix(req.URL.Path, "/debian/")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+// putPackage adds a package to the pool, and a stanza for it with extra fields to the index.
+func (r *testRepo) putPackage(name, version string, deb []byte, extra ...string) {
+	filename := fmt.Sprintf("pool/main/%c/%s/%s_%s_amd64.deb", name[0], name, name, version)
+	r.files[filename] = deb
+	fields := append([]string{
+		"Package: " + name,
+		"Version: " + version,
+		"Architecture: amd64",
+		"Filename: " + filename,
+		fmt.Sprintf("Size: %d", len(deb)),
+		fmt.Sprintf("SHA256: %x", sha256.Sum256(deb)),
+	}, extra...)
+	r.stanzas = append(r.stanzas, strings.Join(fields, "\n")+"\n")
+}
+
+// index returns the Packages index for the packages which have been put.
+func (r *testRepo) index() []byte {
+	return []byte("# generated for tests\n" + strings.Join(r.stanzas, "\n"))
+}
+
+// publish writes the index as Packages.gz, and a Release file listing it.
+func (r *testRepo) publish() {
+	data := gzipData(r.t, r.index())
+	r.files["dists/stable/main/binary-amd64/Packages.gz"] = data
+	r.writeRelease(map[string][]byte{"main/binary-amd64/Packages.gz": data})
+}
+
+// publishIndex writes a Release file listing data as the uncompressed Packages index, without writing the index.
+func (r *testRepo) publishIndex(data []byte) {
+	r.writeRelease(map[string][]byte{"main/binary-amd64/Packages": data})
+}
+
+func (r *testRepo) writeRelease(files map[string][]byte) {
+	var sb strings.Builder
+	sb.WriteString("Origin: Test\nSuite: stable\nComponents: main\nArchitectures: amd64\nSHA256:\n")
+	for p, data := range files {
+		fmt.Fprintf(&sb, " %x %d %s\n", sha256.Sum256(data), len(data), p)
+	}
+	r.files["dists/stable/Release"] = []byte(sb.String())
+}
+
+func testDeb(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar", testTar(t, map[string]string{"./control": "Package: test\n"})},
+		{"data.tar", testTar(t, files)},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.name, 0, 0, 0, 0o644, len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func testTar(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     int64(len(content)),
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipData(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
@@ -0,0 +1,48 @@
+package apt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// IndexFile is a file listed in a Release file
+type IndexFile struct {
+	SHA256 string
+	Size   int64
+	Path   string
+}
+
+// parseChecksums parses a multiline checksum field e.g. SHA256 from a Release file.
+func parseChecksums(x string) (map[string]IndexFile, error) {
+	ret := make(map[string]IndexFile)
+	for _, line := range strings.Split(x, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("apt: malformed checksum line %q", line)
+		}
+		var size int64
+		if _, err := fmt.Sscan(fields[1], &size); err != nil {
+			return nil, err
+		}
+		ret[fields[2]] = IndexFile{SHA256: fields[0], Size: size, Path: fields[2]}
+	}
+	return ret, nil
+}
+
+// readAll reads all of r, checking that it is no larger than max
+func readAll(r io.Reader, max int64) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("apt: file exceeds maximum size %d", max)
+	}
+	return buf.Bytes(), nil
+}
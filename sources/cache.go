@@ -0,0 +1,40 @@
+package sources
+
+import (
+	"context"
+	"sync"
+)
+
+// Cache is persistent key-value storage for a single Source.
+// Sources use it to avoid repeating work between fetches.
+type Cache interface {
+	// Get returns the value for key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value for key.
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+var _ Cache = &MemCache{}
+
+// MemCache is a Cache stored in memory.
+type MemCache struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func NewMemCache() *MemCache {
+	return &MemCache{m: make(map[string][]byte)}
+}
+
+func (c *MemCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.m[key]...), nil
+}
+
+func (c *MemCache) Put(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = append([]byte(nil), value...)
+	return nil
+}
@@ -0,0 +1,345 @@
+// Package execsource implements Sources backed by external programs.
+//
+// A program named bpm-source-<scheme> is started for each operation.
+// It is sent a single JSON Request on stdin, and writes JSON Messages to stdout, one per line.
+// See doc/40_Sources.md for a description of the protocol.
+package execsource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+// Prefix is prepended to a scheme to get the name of the program which implements it.
+const Prefix = "bpm-source-"
+
+// maxStderr is the amount of a program's stderr which is kept for error messages.
+const maxStderr = 4096
+
+var schemeRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*$`)
+
+// Lookup searches PATH for the program implementing scheme.
+func Lookup(scheme string) (string, error) {
+	if !schemeRe.MatchString(scheme) {
+		return "", fmt.Errorf("execsource: invalid scheme %q", scheme)
+	}
+	return exec.LookPath(Prefix + scheme)
+}
+
+// ListPrograms returns the programs on PATH which implement a scheme, keyed by scheme.
+// If a scheme is implemented in more than one directory, the first one on PATH is used.
+func ListPrograms() map[string]string {
+	ret := make(map[string]string)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, ent := range ents {
+			scheme, ok := strings.CutPrefix(ent.Name(), Prefix)
+			if !ok || !schemeRe.MatchString(scheme) {
+				continue
+			}
+			if _, exists := ret[scheme]; exists {
+				continue
+			}
+			if p, err := exec.LookPath(filepath.Join(dir, ent.Name())); err == nil {
+				ret[scheme] = p
+			}
+		}
+	}
+	return ret
+}
+
+// Request is written to the program's stdin.
+type Request struct {
+	// Op is either "fetch" or "pull"
+	Op     string `json:"op"`
+	Scheme string `json:"scheme"`
+	Path   string `json:"path"`
+	// ID is the asset to pull. It is only set for "pull".
+	ID string `json:"id,omitempty"`
+}
+
+// Message is a line written to the program's stdout.
+// Exactly one of the fields should be set.
+type Message struct {
+	// Asset is written by fetch, once per asset.
+	Asset *Asset `json:"asset,omitempty"`
+	// File is written by pull, once per file.
+	File *File `json:"file,omitempty"`
+	// Tar is written by pull to indicate that the rest of stdout is a tar archive.
+	Tar *struct{} `json:"tar,omitempty"`
+	// Error causes the operation to fail.
+	Error string `json:"error,omitempty"`
+}
+
+// Asset is a sources.RemoteAsset
+type Asset struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+}
+
+// File is a single file in the asset being pulled.
+type File struct {
+	Path string `json:"path"`
+	// Mode is the permission bits in octal e.g. "0755". The default is "0644".
+	Mode string `json:"mode,omitempty"`
+	// Data is the content of the file.
+	Data []byte `json:"data,omitempty"`
+	// Link is set for symlinks, and is the target of the link.
+	Link string `json:"link,omitempty"`
+}
+
+var _ sources.Source = &ExecSource{}
+
+// ExecSource is a Source implemented by an external program.
+type ExecSource struct {
+	program string
+	u       sources.URL
+}
+
+// New returns a source for u, which uses program to implement Fetch and Pull.
+func New(program string, u sources.URL) *ExecSource {
+	return &ExecSource{program: program, u: u}
+}
+
+// Fetch starts the program and returns an iterator over the assets it writes.
+func (s *ExecSource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	p, err := s.start(ctx, Request{Op: "fetch", Scheme: s.u.Scheme, Path: s.u.Path})
+	if err != nil {
+		return nil, err
+	}
+	return &assetIterator{p: p}, nil
+}
+
+type assetIterator struct {
+	p    *process
+	done bool
+	err  error
+}
+
+func (it *assetIterator) Next(ctx context.Context, dst *sources.RemoteAsset) error {
+	if it.done {
+		if it.err != nil {
+			return it.err
+		}
+		return streams.EOS()
+	}
+	err := func() error {
+		msg, err := it.p.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.Asset == nil {
+			return fmt.Errorf("execsource: %s: unexpected message during fetch", it.p.name())
+		}
+		*dst = sources.RemoteAsset{
+			ID:     msg.Asset.ID,
+			Labels: bpmmd.LabelSet(msg.Asset.Labels),
+		}
+		if dst.Labels == nil {
+			dst.Labels = bpmmd.LabelSet{}
+		}
+		return nil
+	}()
+	if err == nil {
+		return nil
+	}
+	it.done = true
+	if err == io.EOF {
+		it.err = it.p.wait()
+	} else {
+		it.p.kill()
+		it.err = err
+	}
+	if it.err != nil {
+		return it.err
+	}
+	return streams.EOS()
+}
+
+// Pull starts the program and imports the files or tar archive it writes.
+func (s *ExecSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	p, err := s.start(ctx, Request{Op: "pull", Scheme: s.u.Scheme, Path: s.u.Path, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.readPull(ctx, op, store, p)
+	if err != nil {
+		p.kill()
+		return nil, err
+	}
+	if err := p.wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *ExecSource) readPull(ctx context.Context, op *glfs.Operator, store cadata.Store, p *process) (*sources.PullResult, error) {
+	// files are checked in the same way as the entries of an archive
+	tb := unpack.NewTreeBuilder(op, store)
+	var files int
+	for {
+		msg, err := p.readMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case msg.Tar != nil:
+			if files > 0 {
+				return nil, fmt.Errorf("execsource: %s: tar must not follow files", p.name())
+			}
+			res, err := unpack.Import(ctx, op, store, "pull.tar", p.stdout)
+			if err != nil {
+				return nil, err
+			}
+			// drain anything after the end of the archive
+			if _, err := io.Copy(io.Discard, p.stdout); err != nil {
+				return nil, err
+			}
+			return res, nil
+		case msg.File != nil:
+			if err := putFile(ctx, tb, *msg.File); err != nil {
+				return nil, fmt.Errorf("execsource: %s: %w", p.name(), err)
+			}
+			files++
+		default:
+			return nil, fmt.Errorf("execsource: %s: unexpected message during pull", p.name())
+		}
+	}
+	ref, err := tb.Finish(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("execsource: %s: %w", p.name(), err)
+	}
+	return &sources.PullResult{Root: *ref}, nil
+}
+
+func putFile(ctx context.Context, tb *unpack.TreeBuilder, f File) error {
+	p := glfs.CleanPath(f.Path)
+	if p == "" || p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(f.Path, "/") {
+		return fmt.Errorf("%w: invalid path %q", unpack.ErrUnsafe, f.Path)
+	}
+	mode := os.FileMode(0o644)
+	if f.Mode != "" {
+		m, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q for %q", f.Mode, f.Path)
+		}
+		mode = os.FileMode(m).Perm()
+	}
+	if f.Link != "" {
+		return tb.PutSymlink(ctx, p, mode, f.Link)
+	}
+	return tb.PutFile(ctx, p, mode, bytes.NewReader(f.Data))
+}
+
+// process is a running instance of the program
+type process struct {
+	cmd    *exec.Cmd
+	stdout *bufio.Reader
+	stderr *limitedBuffer
+}
+
+func (s *ExecSource) start(ctx context.Context, req Request) (*process, error) {
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, s.program)
+	cmd.Stdin = bytes.NewReader(append(reqData, '\n'))
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &process{cmd: cmd, stdout: bufio.NewReader(stdout), stderr: stderr}, nil
+}
+
+func (p *process) name() string {
+	return filepath.Base(p.cmd.Path)
+}
+
+// readMessage reads the next line from stdout.
+// It returns io.EOF when stdout is closed, and an error if the message is an error.
+func (p *process) readMessage() (*Message, error) {
+	for {
+		line, err := p.stdout.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("execsource: %s: parsing message: %w", p.name(), err)
+		}
+		if msg.Error != "" {
+			return nil, fmt.Errorf("execsource: %s: %s", p.name(), msg.Error)
+		}
+		return &msg, nil
+	}
+}
+
+// wait waits for the program to exit, and returns an error including its stderr if it did not succeed.
+func (p *process) wait() error {
+	if err := p.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+			return fmt.Errorf("execsource: %s: %w: %s", p.name(), err, msg)
+		}
+		return fmt.Errorf("execsource: %s: %w", p.name(), err)
+	}
+	return nil
+}
+
+func (p *process) kill() {
+	if p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	p.cmd.Wait()
+}
+
+// limitedBuffer keeps the first max bytes written to it, and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Buffer.Len(); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.Buffer.Write(p[:n])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,170 @@
+package execsource
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+const stubEnv = "BPM_EXECSOURCE_STUB"
+
+// TestMain runs the test binary as a stub source program when stubEnv is set.
+func TestMain(m *testing.M) {
+	if os.Getenv(stubEnv) != "" {
+		os.Exit(runStub())
+	}
+	os.Exit(m.Run())
+}
+
+func runStub() int {
+	var req Request
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	switch {
+	case req.Op == "fetch":
+		for i := 0; i < 3; i++ {
+			enc.Encode(Message{Asset: &Asset{
+				ID:     fmt.Sprint(i),
+				Labels: map[string]string{"path": req.Path},
+			}})
+		}
+	case req.Op == "pull" && req.ID == "files":
+		enc.Encode(Message{File: &File{Path: "bin/tool", Mode: "0755", Data: []byte("#!/bin/sh\n")}})
+		enc.Encode(Message{File: &File{Path: "README", Data: []byte("hello")}})
+		enc.Encode(Message{File: &File{Path: "tool", Link: "bin/tool"}})
+	case req.Op == "pull" && req.ID == "tar":
+		enc.Encode(Message{Tar: &struct{}{}})
+		w.Flush()
+		tw := tar.NewWriter(os.Stdout)
+		tw.WriteHeader(&tar.Header{Name: "a/b.txt", Mode: 0o644, Size: 5, Typeflag: tar.TypeReg})
+		tw.Write([]byte("hello"))
+		tw.Close()
+	case req.Op == "pull" && req.ID == "escape":
+		enc.Encode(Message{File: &File{Path: "../../etc/passwd", Data: []byte("x")}})
+	case req.Op == "pull" && req.ID == "escape-link":
+		enc.Encode(Message{File: &File{Path: "bin/tool", Link: "../../usr/bin/sh"}})
+	case req.Op == "pull" && req.ID == "beneath-link":
+		enc.Encode(Message{File: &File{Path: "etc", Link: "bin"}})
+		enc.Encode(Message{File: &File{Path: "etc/passwd", Data: []byte("x")}})
+	case req.Op == "pull" && req.ID == "link-chain":
+		enc.Encode(Message{File: &File{Path: "d/up", Link: ".."}})
+		enc.Encode(Message{File: &File{Path: "esc", Link: "d/up/.."}})
+	case req.ID == "exit":
+		fmt.Fprintln(os.Stderr, "something went wrong")
+		return 3
+	default:
+		enc.Encode(Message{Error: "no such asset " + req.ID})
+	}
+	return 0
+}
+
+func setupStub(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink(exe, filepath.Join(dir, Prefix+"stub")))
+	t.Setenv("PATH", dir)
+	t.Setenv(stubEnv, "1")
+}
+
+func newStubSource(t *testing.T) *ExecSource {
+	setupStub(t)
+	program, err := Lookup("stub")
+	require.NoError(t, err)
+	return New(program, sources.URL{Scheme: "stub", Path: "example"})
+}
+
+func TestLookup(t *testing.T) {
+	setupStub(t)
+	_, err := Lookup("stub")
+	require.NoError(t, err)
+	_, err = Lookup("missing")
+	require.Error(t, err)
+	_, err = Lookup("../stub")
+	require.Error(t, err)
+	require.Contains(t, ListPrograms(), "stub")
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	s := newStubSource(t)
+	it, err := s.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 10)
+	require.NoError(t, err)
+	require.Len(t, assets, 3)
+	require.Equal(t, "2", assets[2].ID)
+	require.Equal(t, "example", assets[2].Labels["path"])
+}
+
+func TestPullFiles(t *testing.T) {
+	ctx := context.Background()
+	s := newStubSource(t)
+	op := glfs.NewOperator()
+	store := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := s.Pull(ctx, &op, store, "files")
+	require.NoError(t, err)
+	tree, err := op.GetTree(ctx, store, res.Root)
+	require.NoError(t, err)
+	ent := tree.Lookup("bin")
+	require.NotNil(t, ent)
+	ent = tree.Lookup("tool")
+	require.NotNil(t, ent)
+	require.True(t, ent.FileMode&os.ModeSymlink != 0)
+	data, err := op.GetBlobBytes(ctx, store, ent.Ref)
+	require.NoError(t, err)
+	require.Equal(t, "bin/tool", string(data))
+}
+
+func TestPullTar(t *testing.T) {
+	ctx := context.Background()
+	s := newStubSource(t)
+	op := glfs.NewOperator()
+	store := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := s.Pull(ctx, &op, store, "tar")
+	require.NoError(t, err)
+	bref, err := op.GetAtPath(ctx, store, res.Root, "a/b.txt")
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, store, *bref)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+}
+
+func TestPullErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newStubSource(t)
+	op := glfs.NewOperator()
+	store := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+
+	_, err := s.Pull(ctx, &op, store, "missing")
+	require.ErrorContains(t, err, "no such asset missing")
+	_, err = s.Pull(ctx, &op, store, "escape")
+	require.ErrorContains(t, err, "invalid path")
+	require.ErrorIs(t, err, unpack.ErrUnsafe)
+	_, err = s.Pull(ctx, &op, store, "escape-link")
+	require.ErrorIs(t, err, unpack.ErrUnsafe)
+	_, err = s.Pull(ctx, &op, store, "beneath-link")
+	require.ErrorIs(t, err, unpack.ErrUnsafe)
+	_, err = s.Pull(ctx, &op, store, "link-chain")
+	require.ErrorIs(t, err, unpack.ErrUnsafe)
+	_, err = s.Pull(ctx, &op, store, "exit")
+	require.ErrorContains(t, err, "something went wrong")
+}
@@ -0,0 +1,130 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/brendoncarroll/stdctx/logctx"
+	"github.com/google/go-github/v50/github"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+// maxRateLimitWaits is the number of times a request will wait for the rate limit to reset before failing.
+const maxRateLimitWaits = 3
+
+// cachedResponse is stored in the cache for each API response with an ETag.
+type cachedResponse struct {
+	ETag        string `json:"etag"`
+	Link        string `json:"link,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// etagTransport makes GET requests conditional on the ETag of the last response for the same URL.
+// If the server responds 304 Not Modified, the cached response is returned instead.
+// Conditional requests which return 304 do not count against the GitHub rate limit.
+type etagTransport struct {
+	base  http.RoundTripper
+	cache sources.Cache
+}
+
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+	ctx := req.Context()
+	key := "etag:" + req.URL.String()
+	var cached *cachedResponse
+	if data, err := t.cache.Get(ctx, key); err != nil {
+		return nil, err
+	} else if len(data) > 0 {
+		cached = &cachedResponse{}
+		if err := json.Unmarshal(data, cached); err != nil {
+			cached = nil
+		}
+	}
+	if cached != nil {
+		req = req.Clone(ctx)
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		res.Body.Close()
+		res.StatusCode = http.StatusOK
+		res.Status = "200 OK"
+		if cached.Link != "" {
+			res.Header.Set("Link", cached.Link)
+		}
+		if cached.ContentType != "" {
+			res.Header.Set("Content-Type", cached.ContentType)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(cached.Body))
+		res.ContentLength = int64(len(cached.Body))
+		return res, nil
+	case res.StatusCode == http.StatusOK && res.Header.Get("ETag") != "":
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(cachedResponse{
+			ETag:        res.Header.Get("ETag"),
+			Link:        res.Header.Get("Link"),
+			ContentType: res.Header.Get("Content-Type"),
+			Body:        body,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := t.cache.Put(ctx, key, data); err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		return res, nil
+	default:
+		return res, nil
+	}
+}
+
+// withRateLimit calls fn, and if it fails because of the rate limit, waits until the limit resets and calls it again.
+func withRateLimit[T any](ctx context.Context, fn func() (T, *github.Response, error)) (T, *github.Response, error) {
+	for i := 0; ; i++ {
+		x, res, err := fn()
+		if err == nil || i >= maxRateLimitWaits {
+			return x, res, err
+		}
+		var wait time.Duration
+		var rle *github.RateLimitError
+		var arle *github.AbuseRateLimitError
+		switch {
+		case errors.As(err, &rle):
+			wait = time.Until(rle.Rate.Reset.Time) + time.Second
+		case errors.As(err, &arle):
+			wait = arle.GetRetryAfter()
+			if wait == 0 {
+				wait = time.Minute
+			}
+		default:
+			return x, res, err
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		logctx.Warnf(ctx, "github rate limit exceeded, waiting %v", wait.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return x, res, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package github
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+
+	"github.com/blobcache/bpm/bpmmd"
+)
+
+// filter limits which releases, assets and tags are listed by Fetch.
+// The zero value lists everything.
+type filter struct {
+	maxReleases int
+	since       time.Time
+	tagPattern  string
+	goos        string
+	goarch      string
+}
+
+// WithMaxReleases limits Fetch to the n most recent releases, and the first n tags and branches.
+func WithMaxReleases(n int) Option {
+	return func(s *GitHubSource) {
+		s.filter.maxReleases = n
+	}
+}
+
+// WithSince limits Fetch to releases published at or after t, and tags and branches with commits made at or after t.
+func WithSince(t time.Time) Option {
+	return func(s *GitHubSource) {
+		s.filter.since = t
+	}
+}
+
+// WithTagPattern limits Fetch to releases and tags with names matching the glob pattern, as in path.Match.
+func WithTagPattern(pattern string) Option {
+	return func(s *GitHubSource) {
+		s.filter.tagPattern = pattern
+	}
+}
+
+// WithPlatform limits Fetch to release assets with filenames for the operating system and architecture.
+// Assets which do not name a platform are skipped.
+func WithPlatform(goos, goarch string) Option {
+	return func(s *GitHubSource) {
+		s.filter.goos = goos
+		s.filter.goarch = goarch
+	}
+}
+
+// IsZero returns true if the filter lists everything
+func (f filter) IsZero() bool {
+	return f == filter{}
+}
+
+// String returns a canonical form of the filter, used to key the cache.
+func (f filter) String() string {
+	var parts []string
+	if f.maxReleases > 0 {
+		parts = append(parts, "max_releases="+strconv.Itoa(f.maxReleases))
+	}
+	if !f.since.IsZero() {
+		parts = append(parts, "since="+f.since.UTC().Format(time.RFC3339))
+	}
+	if f.tagPattern != "" {
+		parts = append(parts, "tag_pattern="+f.tagPattern)
+	}
+	if f.goos != "" {
+		parts = append(parts, "platform="+f.goos+"/"+f.goarch)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func (f filter) matchTag(name string) bool {
+	if f.tagPattern == "" {
+		return true
+	}
+	ok, _ := path.Match(f.tagPattern, name)
+	return ok
+}
+
+// isBefore returns true if the release was published before the since time.
+// Releases are listed newest first, so no releases after it will match either.
+func (f filter) isBefore(rel *github.RepositoryRelease) bool {
+	if f.since.IsZero() {
+		return false
+	}
+	t := rel.GetPublishedAt().Time
+	if t.IsZero() {
+		t = rel.GetCreatedAt().Time
+	}
+	return t.Before(f.since)
+}
+
+// platformAliases maps names used in filenames to GOOS and GOARCH values
+var platformAliases = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"macos":   "darwin",
+}
+
+// matchAsset is called with the labels for an asset, after the platform has been guessed from its filename.
+func (f filter) matchAsset(l bpmmd.LabelSet) bool {
+	if f.goos == "" {
+		return true
+	}
+	normalize := func(x string) string {
+		if y, ok := platformAliases[x]; ok {
+			return y
+		}
+		return x
+	}
+	return normalize(l["os"]) == f.goos && normalize(l["arch"]) == f.goarch
+}
@@ -1,20 +1,22 @@
 package github
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blobcache/glfs"
-	"github.com/blobcache/glfs/glfstar"
-	"github.com/blobcache/glfs/glfszip"
 	"github.com/brendoncarroll/go-exp/streams"
 	"github.com/brendoncarroll/go-state/cadata"
 	"github.com/brendoncarroll/stdctx/logctx"
@@ -23,145 +25,374 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/checksum"
+	"github.com/blobcache/bpm/internal/sigverify"
+	"github.com/blobcache/bpm/internal/unpack"
 	"github.com/blobcache/bpm/sources"
 )
 
-var _ sources.Source = &GitHubSource{}
+var (
+	_ sources.PartialSource  = &GitHubSource{}
+	_ sources.FileSource     = &GitHubSource{}
+	_ sources.EndpointSource = &GitHubSource{}
+)
+
+// DefaultAPIURL is the root of the GitHub REST API
+const DefaultAPIURL = "https://api.github.com/"
 
 type GitHubSource struct {
 	account string
 	repo    string
+	apiURL  string
 
 	tokenSource oauth2.TokenSource
+	cache       sources.Cache
+	filter      filter
 }
 
-func NewGitHubSource(account, repo string) *GitHubSource {
-	var tokenSource oauth2.TokenSource
-	if v, ok := os.LookupEnv("GITHUB_TOKEN"); ok {
-		tokenSource = oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: v},
-		)
+// Option configures a GitHubSource
+type Option func(s *GitHubSource)
+
+// WithCache sets a cache used to make fetches incremental.
+// API responses are stored with their ETags, and the releases seen by the last fetch are remembered.
+func WithCache(c sources.Cache) Option {
+	return func(s *GitHubSource) {
+		s.cache = c
 	}
+}
 
-	return &GitHubSource{
+// WithBaseURL sets the root of the REST API, which is DefaultAPIURL by default.
+// All API requests, and downloads of tarballs, are made to this URL.
+func WithBaseURL(apiURL string) Option {
+	return func(s *GitHubSource) {
+		s.apiURL = apiURL
+	}
+}
+
+// WithTokenEnv sets the environment variable which the API token is read from, which is GITHUB_TOKEN by default.
+// If the variable is not set, requests are not authenticated.
+func WithTokenEnv(name string) Option {
+	return func(s *GitHubSource) {
+		s.tokenSource = tokenFromEnv(name)
+	}
+}
+
+// ParseOptions parses the options for a github source, as passed in sources.Params.
+//
+//   - max_releases=<n> is WithMaxReleases
+//   - since=<date> is WithSince, the date is either YYYY-MM-DD or RFC 3339
+//   - tag_pattern=<glob> is WithTagPattern
+//   - platform=<os>/<arch> is WithPlatform, or platform=current for the platform bpm is running on
+//   - token_env=<name> is WithTokenEnv
+//   - base_url=<url> is WithBaseURL
+func ParseOptions(m map[string]string) ([]Option, error) {
+	var ret []Option
+	for k, v := range m {
+		switch k {
+		case "max_releases":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("github: max_releases must be a positive integer, have %q", v)
+			}
+			ret = append(ret, WithMaxReleases(n))
+		case "since":
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				if t, err = time.Parse(time.RFC3339, v); err != nil {
+					return nil, fmt.Errorf("github: since must be a date, have %q", v)
+				}
+			}
+			ret = append(ret, WithSince(t))
+		case "tag_pattern":
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("github: invalid tag_pattern %q: %w", v, err)
+			}
+			ret = append(ret, WithTagPattern(v))
+		case "platform":
+			goos, goarch := runtime.GOOS, runtime.GOARCH
+			if v != "current" {
+				var ok bool
+				if goos, goarch, ok = strings.Cut(v, "/"); !ok || goos == "" || goarch == "" {
+					return nil, fmt.Errorf("github: platform must have the form <os>/<arch>, have %q", v)
+				}
+			}
+			ret = append(ret, WithPlatform(goos, goarch))
+		case "token_env":
+			if v == "" {
+				return nil, fmt.Errorf("github: token_env must not be empty")
+			}
+			ret = append(ret, WithTokenEnv(v))
+		case "base_url":
+			ret = append(ret, WithBaseURL(v))
+		default:
+			return nil, fmt.Errorf("github: unknown option %q", k)
+		}
+	}
+	return ret, nil
+}
+
+// EnterpriseAPIURL returns the root of the REST API for a GitHub Enterprise Server at host.
+func EnterpriseAPIURL(host string) string {
+	return "https://" + host + "/api/v3/"
+}
+
+// ParsePath parses a path of the form [<host>/]<account>/<repo>
+// host is empty if the path does not include it, or if it is github.com
+func ParsePath(x string) (host, account, repo string, _ error) {
+	parts := strings.Split(x, "/")
+	for _, part := range parts {
+		if part == "" {
+			return "", "", "", fmt.Errorf("github: invalid path %q", x)
+		}
+	}
+	switch len(parts) {
+	case 2:
+		return "", parts[0], parts[1], nil
+	case 3:
+		if parts[0] == "github.com" {
+			parts[0] = ""
+		}
+		return parts[0], parts[1], parts[2], nil
+	default:
+		return "", "", "", fmt.Errorf("github: path must have the form [<host>/]<account>/<repo>, have %q", x)
+	}
+}
+
+func NewGitHubSource(account, repo string, opts ...Option) (*GitHubSource, error) {
+	s := &GitHubSource{
 		account: account,
 		repo:    repo,
+		apiURL:  DefaultAPIURL,
 
-		tokenSource: tokenSource,
+		tokenSource: tokenFromEnv("GITHUB_TOKEN"),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	u, err := url.Parse(s.apiURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("github: base URL must be http or https, have %q", s.apiURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	s.apiURL = u.String()
+	return s, nil
 }
 
-func (s *GitHubSource) newHTTPClient(ctx context.Context) *http.Client {
-	if s.tokenSource == nil {
-		return http.DefaultClient
+// tokenFromEnv returns a token source for the token in the environment variable, or nil if it is not set.
+func tokenFromEnv(name string) oauth2.TokenSource {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return nil
 	}
-	return oauth2.NewClient(ctx, s.tokenSource)
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: v})
 }
 
+// newClient returns a client for the API, which uses the cache if there is one.
 func (s *GitHubSource) newClient(ctx context.Context) *github.Client {
-	return github.NewClient(s.newHTTPClient(ctx))
+	return s.newAPIClient(ctx, s.cache != nil)
+}
+
+// newDownloadClient returns a client for the API, which never uses the cache.
+// It is used for downloading content, which should not be stored in the cache.
+func (s *GitHubSource) newDownloadClient(ctx context.Context) *github.Client {
+	return s.newAPIClient(ctx, false)
+}
+
+func (s *GitHubSource) newAPIClient(ctx context.Context, cached bool) *github.Client {
+	var rt http.RoundTripper = http.DefaultTransport
+	if cached {
+		rt = &etagTransport{base: rt, cache: s.cache}
+	}
+	if s.tokenSource != nil {
+		rt = &oauth2.Transport{Source: s.tokenSource, Base: rt}
+	}
+	c := github.NewClient(&http.Client{Transport: rt})
+	// apiURL is checked in NewGitHubSource
+	c.BaseURL, _ = url.Parse(s.apiURL)
+	return c
+}
+
+// redirectClient follows the redirects from the API to the location of downloadable content.
+// The locations are pre-signed, so it does not send credentials, and it will not follow a redirect from https to http.
+var redirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("github: stopped after 10 redirects")
+		}
+		return checkRedirect(via[0].URL, req.URL)
+	},
+}
+
+func checkRedirect(from, to *url.URL) error {
+	if to.Scheme != "https" && (from.Scheme == "https" || to.Scheme != "http") {
+		return fmt.Errorf("github: refusing to follow redirect from %s to %s", from.Redacted(), to.Redacted())
+	}
+	return nil
 }
 
 const (
-	tagPrefix   = "git-"
-	assetPrefix = "ra-"
+	tagPrefix    = "git-"
+	assetPrefix  = "ra-"
+	branchPrefix = "branch-"
+	commitPrefix = "commit-"
 )
 
 // Pull writes the asset to the store, and returns the root
-func (s *GitHubSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, idstr string) (*glfs.Ref, error) {
-	client := s.newClient(ctx)
+// All downloads are made through the API with the same credentials as Fetch, so private repositories work the same as public ones.
+func (s *GitHubSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, idstr string) (*sources.PullResult, error) {
+	client := s.newDownloadClient(ctx)
 	switch {
 	case strings.HasPrefix(idstr, tagPrefix):
 		id := strings.TrimPrefix(idstr, tagPrefix)
-		u := fmt.Sprintf("https://api.github.com/repos/%s/%s/tarball/refs/tags/%s", s.account, s.repo, id)
-		rc, err := download(ctx, u)
+		rc, err := s.downloadTarball(ctx, client, "refs/tags/"+id)
 		if err != nil {
 			return nil, err
 		}
-		return importGzipTAR(ctx, op, store, rc)
+		defer rc.Close()
+		return unpack.Import(ctx, op, store, s.repo+"-"+id+".tar.gz", rc)
 
-	case strings.HasPrefix(idstr, assetPrefix):
-		id, err := strconv.ParseInt(strings.TrimPrefix(idstr, assetPrefix), 10, 64)
-		if err != nil {
-			return nil, err
+	case strings.HasPrefix(idstr, branchPrefix):
+		// the branch is resolved to a commit first, so the content is labeled with what was actually pulled
+		return s.pullCommit(ctx, op, store, client, "heads/"+strings.TrimPrefix(idstr, branchPrefix))
+
+	case strings.HasPrefix(idstr, commitPrefix):
+		sha := strings.TrimPrefix(idstr, commitPrefix)
+		if !shaRegexp.MatchString(sha) {
+			return nil, fmt.Errorf("github: invalid commit sha %q", sha)
 		}
-		ra, _, err := client.Repositories.GetReleaseAsset(ctx, s.account, s.repo, id)
+		return s.pullCommit(ctx, op, store, client, sha)
+
+	case strings.HasPrefix(idstr, assetPrefix):
+		rc, name, err := s.Open(ctx, idstr)
 		if err != nil {
 			return nil, err
 		}
-		u := ra.GetBrowserDownloadURL()
-		rc, err := download(ctx, u)
+		defer rc.Close()
+		id, _ := strconv.ParseInt(strings.TrimPrefix(idstr, assetPrefix), 10, 64)
+		want, err := s.getExpectedSHA256(ctx, id)
 		if err != nil {
 			return nil, err
 		}
-		defer rc.Close()
-		switch ra.GetContentType() {
-		case "application/zip":
-			return importZip(ctx, op, store, rc)
-		case "application/x-gtar":
-			return importGzipTAR(ctx, op, store, rc)
-		case "application/gzip":
-			r, err := gzip.NewReader(rc)
+		var r io.Reader = rc
+		// the content is verified before it is imported, if the release published a checksum for it
+		if want != "" {
+			vr, err := checksum.Verify(rc, want)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("github: verifying %s: %w", name, err)
 			}
-			defer r.Close()
-			return importBlob(ctx, op, store, rc)
-		default:
-			return importBlob(ctx, op, store, rc)
+			defer vr.Close()
+			r = vr
 		}
+		return unpack.Import(ctx, op, store, name, r)
 
 	default:
 		return nil, fmt.Errorf("bad id %q", idstr)
 	}
 }
 
-func importBlob(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*glfs.Ref, error) {
-	w := op.NewBlobWriter(ctx, s)
-	_, err := io.Copy(w, r)
+// Open implements sources.FileSource.
+// Only release assets are files, tags, branches and commits are archives made by GitHub.
+func (s *GitHubSource) Open(ctx context.Context, idstr string) (io.ReadCloser, string, error) {
+	if !strings.HasPrefix(idstr, assetPrefix) {
+		return nil, "", fmt.Errorf("github: %q is not a release asset: %w", idstr, sources.ErrNotFile)
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(idstr, assetPrefix), 10, 64)
+	if err != nil {
+		return nil, "", err
+	}
+	client := s.newDownloadClient(ctx)
+	ra, _, err := withRateLimit(ctx, func() (*github.ReleaseAsset, *github.Response, error) {
+		return client.Repositories.GetReleaseAsset(ctx, s.account, s.repo, id)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rc, err := s.downloadAsset(ctx, client, ra)
+	if err != nil {
+		return nil, "", err
+	}
+	return rc, ra.GetName(), nil
+}
+
+// shaRegexp matches full and abbreviated commit hashes
+var shaRegexp = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// pullCommit resolves ref to a commit, and imports a tarball of the repository at that commit.
+func (s *GitHubSource) pullCommit(ctx context.Context, op *glfs.Operator, store cadata.Store, client *github.Client, ref string) (*sources.PullResult, error) {
+	sha, _, err := withRateLimit(ctx, func() (string, *github.Response, error) {
+		return client.Repositories.GetCommitSHA1(ctx, s.account, s.repo, ref, "")
+	})
 	if err != nil {
 		return nil, err
 	}
-	return w.Finish(ctx)
+	rc, err := s.downloadTarball(ctx, client, sha)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	res, err := unpack.Import(ctx, op, store, s.repo+"-"+sha+".tar.gz", rc)
+	if err != nil {
+		return nil, err
+	}
+	res.Labels = bpmmd.LabelSet{"git_sha": sha}
+	return res, nil
 }
 
-func importGzipTAR(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*glfs.Ref, error) {
-	gr, err := gzip.NewReader(r)
+// downloadAsset downloads a release asset using the API endpoint with Accept: application/octet-stream
+// The API either responds with the content, or redirects to it.
+func (s *GitHubSource) downloadAsset(ctx context.Context, client *github.Client, ra *github.ReleaseAsset) (io.ReadCloser, error) {
+	logctx.Infof(ctx, "downloading %v", ra.GetBrowserDownloadURL())
+	rc, loc, err := client.Repositories.DownloadReleaseAsset(ctx, s.account, s.repo, ra.GetID(), nil)
 	if err != nil {
 		return nil, err
 	}
-	defer gr.Close()
-	tr := tar.NewReader(gr)
-	return glfstar.ReadTAR(ctx, op, s, tr)
+	if rc != nil {
+		return rc, nil
+	}
+	return s.followRedirect(ctx, loc)
 }
 
-func importZip(ctx context.Context, op *glfs.Operator, s cadata.Poster, r io.Reader) (*glfs.Ref, error) {
-	f, err := os.CreateTemp(os.TempDir(), "bpm-import-zip")
+// downloadTarball downloads a gzipped tarball of the repository at ref.
+func (s *GitHubSource) downloadTarball(ctx context.Context, client *github.Client, ref string) (io.ReadCloser, error) {
+	logctx.Infof(ctx, "downloading tarball of %s/%s at %s", s.account, s.repo, ref)
+	u, _, err := withRateLimit(ctx, func() (*url.URL, *github.Response, error) {
+		return client.Repositories.GetArchiveLink(ctx, s.account, s.repo, github.Tarball, &github.RepositoryContentGetOptions{Ref: ref}, false)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	defer os.Remove(f.Name())
-	size, err := io.Copy(f, r)
+	return s.followRedirect(ctx, u.String())
+}
+
+// followRedirect downloads the content at a location which the API redirected to.
+func (s *GitHubSource) followRedirect(ctx context.Context, loc string) (io.ReadCloser, error) {
+	from, err := url.Parse(s.apiURL)
 	if err != nil {
 		return nil, err
 	}
-	zr, err := zip.NewReader(f, size)
+	to, err := from.Parse(loc)
 	if err != nil {
 		return nil, err
 	}
-	return glfszip.Import(ctx, op, s, zr)
-}
-
-func download(ctx context.Context, target string) (io.ReadCloser, error) {
-	logctx.Infof(ctx, "downloading %v", target)
-	res, err := http.Get(target)
+	if err := checkRedirect(from, to); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, to.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := redirectClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	if res.StatusCode != http.StatusOK {
 		res.Body.Close()
-		return nil, fmt.Errorf("non-zero status code %v", res.Status)
+		return nil, fmt.Errorf("github: GET %s: %v", to.Redacted(), res.Status)
 	}
 	return res.Body, nil
 }
@@ -170,122 +401,499 @@ func (s *GitHubSource) Fetch(ctx context.Context) (sources.AssetIterator, error)
 	it1 := &relAssetIterator{
 		src: s,
 	}
-	it2 := &tagIterator{
-		src: s,
-	}
-	return streams.Concat[sources.RemoteAsset](it1, it2), nil
+	it2 := &pageIterator{list: s.listTags, max: s.filter.maxReleases}
+	it3 := &pageIterator{list: s.listBranches, max: s.filter.maxReleases}
+	return streams.Concat[sources.RemoteAsset](it1, it2, it3), nil
+}
+
+// releasesKey is the cache key for the releases seen by the last fetch.
+// It should be changed whenever the labels produced for release assets change.
+const releasesKey = "releases-v4"
+
+// knownRelease is a release listed by a previous fetch.
+type knownRelease struct {
+	ID     int64                 `json:"id"`
+	Assets []sources.RemoteAsset `json:"assets"`
 }
 
+// relAssetIterator lists the assets for each release, newest first.
+// Once a page contains a release seen by the previous fetch, it stops paging,
+// and the remaining releases are taken from the cache.
 type relAssetIterator struct {
 	src *GitHubSource
 
-	err         error
-	relNextPage int
-	results     []sources.RemoteAsset
+	started  bool
+	done     bool
+	known    []knownRelease
+	listed   []knownRelease
+	nextPage int
+	results  []sources.RemoteAsset
 }
 
 func (it *relAssetIterator) Next(ctx context.Context, r *sources.RemoteAsset) error {
-	if it.err != nil {
-		return it.err
+	for len(it.results) == 0 {
+		if it.done {
+			return streams.EOS()
+		}
+		if err := it.nextBatch(ctx); err != nil {
+			return err
+		}
 	}
-	if len(it.results) == 0 {
-		rels, err := it.listReleases(ctx, it.relNextPage)
+	*r, it.results = it.results[0], it.results[1:]
+	return nil
+}
+
+func (it *relAssetIterator) nextBatch(ctx context.Context) error {
+	if !it.started {
+		known, err := it.src.loadKnownReleases(ctx)
 		if err != nil {
 			return err
 		}
-		if len(rels) == 0 {
-			it.err = streams.EOS()
-			return it.err
+		it.known = known
+		it.nextPage = 1
+		it.started = true
+	}
+	rels, res, err := it.listReleases(ctx, it.nextPage)
+	if err != nil {
+		return err
+	}
+	isKnown := map[int64]bool{}
+	for _, kr := range it.known {
+		isKnown[kr.ID] = true
+	}
+	f := it.src.filter
+	var reachedKnown, reachedEnd bool
+	for _, rel := range rels {
+		if f.isBefore(rel) {
+			reachedEnd = true
+			break
+		}
+		if !f.matchTag(rel.GetTagName()) {
+			continue
 		}
-		var results []sources.RemoteAsset
-		for _, rel := range rels {
-			for _, ass := range rel.Assets {
-				labels := bpmmd.LabelSet{}
-				if err := addReleaseLabels(labels, rel); err != nil {
-					return err
-				}
-				if err := addAssetLabels(labels, ass); err != nil {
+		kr := knownRelease{ID: rel.GetID()}
+		sums, err := it.src.releaseChecksums(ctx, rel)
+		if err != nil {
+			return err
+		}
+		for _, ass := range rel.Assets {
+			labels := bpmmd.LabelSet{}
+			if err := addReleaseLabels(labels, rel); err != nil {
+				return err
+			}
+			if err := addAssetLabels(labels, ass); err != nil {
+				return err
+			}
+			fuzzSemver(labels)
+			fuzzArch(labels)
+			fuzzOS(labels)
+			if !f.matchAsset(labels) {
+				continue
+			}
+			if ps, ok := sums[ass.GetName()]; ok {
+				labels["sha256"] = ps.sha256
+				if err := it.src.putExpectedSHA256(ctx, ass.GetID(), ps.sha256); err != nil {
 					return err
 				}
-				fuzzSemver(labels)
-				fuzzArch(labels)
-				fuzzOS(labels)
-				results = append(results, sources.RemoteAsset{
-					ID:     assetPrefix + strconv.FormatInt(ass.GetID(), 10),
-					Labels: labels,
-				})
 			}
+			addSignatureLabels(labels, ass, rel, sums)
+			kr.Assets = append(kr.Assets, sources.RemoteAsset{
+				ID:     assetPrefix + strconv.FormatInt(ass.GetID(), 10),
+				Labels: labels,
+			})
+		}
+		it.listed = append(it.listed, kr)
+		it.results = append(it.results, kr.Assets...)
+		reachedKnown = reachedKnown || isKnown[kr.ID]
+		if it.isFull() {
+			reachedEnd = true
+			break
 		}
-		it.results = results
-		it.relNextPage++
 	}
-	*r, it.results = it.results[0], it.results[1:]
-	return nil
+	it.nextPage = res.NextPage
+	if reachedEnd {
+		it.nextPage = 0
+	}
+	if it.nextPage != 0 && !reachedKnown {
+		return nil
+	}
+	if it.nextPage != 0 {
+		logctx.Infof(ctx, "reached known releases for %s/%s, skipping remaining pages", it.src.account, it.src.repo)
+		isListed := map[int64]bool{}
+		for _, kr := range it.listed {
+			isListed[kr.ID] = true
+		}
+		// Releases are listed newest first, and the cache is in the same order.
+		// A cached release newer than the oldest one listed would have been listed if it still existed,
+		// so only the releases after it are taken from the cache, and deleted releases are not replayed.
+		oldest := -1
+		for i, kr := range it.known {
+			if isListed[kr.ID] {
+				oldest = i
+			}
+		}
+		for _, kr := range it.known[oldest+1:] {
+			if !it.isFull() {
+				it.listed = append(it.listed, kr)
+				it.results = append(it.results, kr.Assets...)
+			}
+		}
+	}
+	it.done = true
+	return it.src.saveKnownReleases(ctx, it.listed)
+}
+
+// isFull returns true if the maximum number of releases have been listed
+func (it *relAssetIterator) isFull() bool {
+	max := it.src.filter.maxReleases
+	return max > 0 && len(it.listed) >= max
 }
 
-func (it *relAssetIterator) listReleases(ctx context.Context, page int) ([]*github.RepositoryRelease, error) {
+func (it *relAssetIterator) listReleases(ctx context.Context, page int) ([]*github.RepositoryRelease, *github.Response, error) {
 	client := it.src.newClient(ctx)
-	rels, _, err := client.Repositories.ListReleases(ctx, it.src.account, it.src.repo, &github.ListOptions{
-		Page:    page,
-		PerPage: 100,
+	return withRateLimit(ctx, func() ([]*github.RepositoryRelease, *github.Response, error) {
+		return client.Repositories.ListReleases(ctx, it.src.account, it.src.repo, &github.ListOptions{
+			Page:    page,
+			PerPage: 100,
+		})
 	})
-	return rels, err
 }
 
-type tagIterator struct {
-	src *GitHubSource
+func (s *GitHubSource) loadKnownReleases(ctx context.Context) ([]knownRelease, error) {
+	if s.cache == nil {
+		return nil, nil
+	}
+	data, err := s.cache.Get(ctx, s.releasesKey())
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var ret []knownRelease
+	if err := json.Unmarshal(data, &ret); err != nil {
+		// the cache is only an optimization, a full fetch will replace it.
+		logctx.Warnf(ctx, "ignoring invalid release cache: %v", err)
+		return nil, nil
+	}
+	return ret, nil
+}
+
+func (s *GitHubSource) saveKnownReleases(ctx context.Context, krs []knownRelease) error {
+	if s.cache == nil {
+		return nil
+	}
+	data, err := json.Marshal(krs)
+	if err != nil {
+		return err
+	}
+	return s.cache.Put(ctx, s.releasesKey(), data)
+}
+
+// Endpoint implements sources.EndpointSource.
+// It returns the API URL, which release assets are also downloaded through.
+func (s *GitHubSource) Endpoint() string {
+	return s.apiURL
+}
+
+// IsPartial implements sources.PartialSource.
+// It returns true if Fetch has been limited by options.
+func (s *GitHubSource) IsPartial() bool {
+	return !s.filter.IsZero()
+}
+
+// publishedSum is a checksum published in a release, and the asset it was published in.
+type publishedSum struct {
+	sha256 string
+	from   *github.ReleaseAsset
+}
+
+// releaseChecksums returns the sha256 hashes published in the checksum files of a release, by filename.
+// Checksum files which cannot be downloaded are skipped with a warning.
+func (s *GitHubSource) releaseChecksums(ctx context.Context, rel *github.RepositoryRelease) (map[string]publishedSum, error) {
+	sums := make(map[string]publishedSum)
+	for _, ass := range rel.Assets {
+		name := ass.GetName()
+		target, isSidecar := checksum.SidecarTarget(name)
+		if !isSidecar && !checksum.IsSumsFile(name) {
+			continue
+		}
+		parsed, err := s.loadChecksumFile(ctx, ass)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logctx.Warnf(ctx, "github: reading checksums from %s: %v", name, err)
+			continue
+		}
+		if isSidecar {
+			if sum, ok := parsed[""]; ok {
+				sums[target] = publishedSum{sha256: sum, from: ass}
+			} else if sum, ok := parsed[target]; ok {
+				sums[target] = publishedSum{sha256: sum, from: ass}
+			}
+			continue
+		}
+		for filename, sum := range parsed {
+			sums[path.Base(filename)] = publishedSum{sha256: sum, from: ass}
+		}
+	}
+	return sums, nil
+}
+
+// addSignatureLabels labels an asset with a detached signature published alongside it in the release.
+// If the asset is not signed itself, but its checksum was published in a signed file, that signature is used,
+// and signature_for is the ID of the checksum file.
+func addSignatureLabels(l bpmmd.LabelSet, ass *github.ReleaseAsset, rel *github.RepositoryRelease, sums map[string]publishedSum) {
+	sigs := map[string]*github.ReleaseAsset{}
+	for _, x := range rel.Assets {
+		if target, ok := sigverify.IsSignatureFile(x.GetName()); ok {
+			sigs[target] = x
+		}
+	}
+	if sig, ok := sigs[ass.GetName()]; ok {
+		l["signature"] = assetPrefix + strconv.FormatInt(sig.GetID(), 10)
+		return
+	}
+	if ps, ok := sums[ass.GetName()]; ok {
+		if sig, ok := sigs[ps.from.GetName()]; ok {
+			l["signature"] = assetPrefix + strconv.FormatInt(sig.GetID(), 10)
+			l["signature_for"] = assetPrefix + strconv.FormatInt(ps.from.GetID(), 10)
+		}
+	}
+}
+
+// loadChecksumFile downloads and parses a checksum file.
+// Release assets cannot be changed, so the parsed checksums are cached by asset ID.
+func (s *GitHubSource) loadChecksumFile(ctx context.Context, ass *github.ReleaseAsset) (map[string]string, error) {
+	key := "sums/" + strconv.FormatInt(ass.GetID(), 10)
+	if s.cache != nil {
+		data, err := s.cache.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			var ret map[string]string
+			return ret, json.Unmarshal(data, &ret)
+		}
+	}
+	if ass.GetSize() > checksum.MaxFileSize {
+		return nil, fmt.Errorf("checksum file is larger than %d bytes", checksum.MaxFileSize)
+	}
+	rc, err := s.downloadAsset(ctx, s.newDownloadClient(ctx), ass)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, checksum.MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := checksum.Parse(data)
+	if s.cache != nil {
+		data, err := json.Marshal(ret)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.cache.Put(ctx, key, data); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// putExpectedSHA256 remembers the published checksum for a release asset, so that Pull can verify it.
+func (s *GitHubSource) putExpectedSHA256(ctx context.Context, assetID int64, sum string) error {
+	if s.cache == nil {
+		return nil
+	}
+	return s.cache.Put(ctx, "sha256/"+strconv.FormatInt(assetID, 10), []byte(sum))
+}
+
+// getExpectedSHA256 returns the published checksum for a release asset, or "" if there is none.
+func (s *GitHubSource) getExpectedSHA256(ctx context.Context, assetID int64) (string, error) {
+	if s.cache == nil {
+		return "", nil
+	}
+	data, err := s.cache.Get(ctx, "sha256/"+strconv.FormatInt(assetID, 10))
+	return string(data), err
+}
+
+// releasesKey returns the cache key for the releases seen by the last fetch with the same filter.
+func (s *GitHubSource) releasesKey() string {
+	if s.filter.IsZero() {
+		return releasesKey
+	}
+	return releasesKey + "?" + s.filter.String()
+}
+
+// pageIterator lists assets from each page of an API endpoint in turn
+type pageIterator struct {
+	list func(ctx context.Context, page int) ([]sources.RemoteAsset, *github.Response, error)
+	// max limits the number of assets listed, if it is greater than 0.
+	// No more pages are requested once it is reached.
+	max int
 
-	err      error
+	started  bool
 	nextPage int
+	listed   int
 	results  []sources.RemoteAsset
 }
 
-func (it *tagIterator) Next(ctx context.Context, dst *sources.RemoteAsset) error {
-	if it.err != nil {
-		return it.err
-	}
-	if len(it.results) == 0 {
-		tags, err := it.listTags(ctx, it.nextPage)
+func (it *pageIterator) Next(ctx context.Context, dst *sources.RemoteAsset) error {
+	for len(it.results) == 0 {
+		if it.started && it.nextPage == 0 {
+			return streams.EOS()
+		}
+		if !it.started {
+			it.nextPage = 1
+			it.started = true
+		}
+		results, res, err := it.list(ctx, it.nextPage)
 		if err != nil {
 			return err
 		}
-		if len(tags) == 0 {
-			it.err = streams.EOS()
-			return it.err
-		}
-		var results []sources.RemoteAsset
-		for _, tag := range tags {
-			labels := bpmmd.LabelSet{}
-			if err := addTagLabels(labels, tag); err != nil {
-				return err
-			}
-			fuzzSemver(labels)
-			fuzzArch(labels)
-			fuzzOS(labels)
-			results = append(results, sources.RemoteAsset{
-				ID:     tagPrefix + tag.GetName(),
-				Labels: labels,
-			})
+		it.nextPage = res.NextPage
+		if it.max > 0 && it.listed+len(results) >= it.max {
+			results = results[:it.max-it.listed]
+			it.nextPage = 0
 		}
 		it.results = results
-		it.nextPage++
+		it.listed += len(results)
 	}
 	*dst, it.results = it.results[0], it.results[1:]
 	return nil
 }
 
-func (s *tagIterator) listTags(ctx context.Context, page int) ([]*github.RepositoryTag, error) {
-	client := s.src.newClient(ctx)
-	tags, _, err := client.Repositories.ListTags(ctx, s.src.account, s.src.repo, &github.ListOptions{
-		Page:    page,
-		PerPage: 1000,
+func (s *GitHubSource) listTags(ctx context.Context, page int) ([]sources.RemoteAsset, *github.Response, error) {
+	client := s.newClient(ctx)
+	tags, res, err := withRateLimit(ctx, func() ([]*github.RepositoryTag, *github.Response, error) {
+		return client.Repositories.ListTags(ctx, s.account, s.repo, &github.ListOptions{
+			Page:    page,
+			PerPage: 100,
+		})
 	})
-	return tags, err
+	if err != nil {
+		return nil, nil, err
+	}
+	var ret []sources.RemoteAsset
+	for _, tag := range tags {
+		if !s.filter.matchTag(tag.GetName()) {
+			continue
+		}
+		if before, err := s.isBefore(ctx, tag.GetCommit().GetSHA()); err != nil {
+			return nil, nil, err
+		} else if before {
+			continue
+		}
+		labels := bpmmd.LabelSet{}
+		if err := addTagLabels(labels, tag); err != nil {
+			return nil, nil, err
+		}
+		fuzzSemver(labels)
+		fuzzArch(labels)
+		fuzzOS(labels)
+		ret = append(ret, sources.RemoteAsset{
+			ID:     tagPrefix + tag.GetName(),
+			Labels: labels,
+		})
+	}
+	return ret, res, nil
+}
+
+func (s *GitHubSource) listBranches(ctx context.Context, page int) ([]sources.RemoteAsset, *github.Response, error) {
+	client := s.newClient(ctx)
+	branches, res, err := withRateLimit(ctx, func() ([]*github.Branch, *github.Response, error) {
+		return client.Repositories.ListBranches(ctx, s.account, s.repo, &github.BranchListOptions{
+			ListOptions: github.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			},
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var ret []sources.RemoteAsset
+	for _, branch := range branches {
+		if before, err := s.isBefore(ctx, branch.GetCommit().GetSHA()); err != nil {
+			return nil, nil, err
+		} else if before {
+			continue
+		}
+		labels := bpmmd.LabelSet{}
+		addBranchLabels(labels, branch)
+		ret = append(ret, sources.RemoteAsset{
+			ID:     branchPrefix + branch.GetName(),
+			Labels: labels,
+		})
+	}
+	return ret, res, nil
+}
+
+// isBefore returns true if the commit sha was made before the since time of the filter.
+// Tags and branches are not listed in date order, so each commit has to be checked.
+func (s *GitHubSource) isBefore(ctx context.Context, sha string) (bool, error) {
+	if s.filter.since.IsZero() || sha == "" {
+		return false, nil
+	}
+	t, err := s.commitTime(ctx, sha)
+	if err != nil {
+		return false, err
+	}
+	return t.Before(s.filter.since), nil
+}
+
+// commitTime returns the time of the commit sha.
+// Commits never change, so the time is cached.
+func (s *GitHubSource) commitTime(ctx context.Context, sha string) (time.Time, error) {
+	key := "commit-time/" + sha
+	if s.cache != nil {
+		data, err := s.cache.Get(ctx, key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(data) > 0 {
+			var t time.Time
+			err := t.UnmarshalText(data)
+			return t, err
+		}
+	}
+	client := s.newClient(ctx)
+	commit, _, err := withRateLimit(ctx, func() (*github.Commit, *github.Response, error) {
+		return client.Git.GetCommit(ctx, s.account, s.repo, sha)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := commit.GetCommitter().GetDate().Time
+	if s.cache != nil {
+		data, err := t.MarshalText()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if err := s.cache.Put(ctx, key, data); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return t, nil
 }
 
 func addReleaseLabels(l bpmmd.LabelSet, rel *github.RepositoryRelease) error {
-	l["tag_name"] = semver.Canonical(*rel.TagName)
-	l["release_name"] = *rel.Name
+	// drafts can have no tag, and releases can have no name
+	if tag := semver.Canonical(rel.GetTagName()); tag != "" {
+		l["tag_name"] = tag
+	}
+	if name := rel.GetName(); name != "" {
+		l["release_name"] = name
+	}
+	l["release_id"] = strconv.FormatInt(rel.GetID(), 10)
+	l["prerelease"] = strconv.FormatBool(rel.GetPrerelease())
+	l["draft"] = strconv.FormatBool(rel.GetDraft())
+	addTimestamp(l, "created_at", rel.CreatedAt)
+	// drafts are not published
+	addTimestamp(l, "published_at", rel.PublishedAt)
+	addString(l, "release_body", rel.Body)
+	if author := rel.GetAuthor(); author != nil {
+		addString(l, "release_author", author.Login)
+	}
 	return nil
 }
 
@@ -294,7 +902,12 @@ func addAssetLabels(l bpmmd.LabelSet, ass *github.ReleaseAsset) error {
 	l["asset_id"] = strconv.Itoa(int(ass.GetID()))
 	l["node_id"] = ass.GetNodeID()
 	l["content_type"] = ass.GetContentType()
+	l["size"] = strconv.Itoa(ass.GetSize())
+	l["download_count"] = strconv.Itoa(ass.GetDownloadCount())
 	addString(l, "label", ass.Label)
+	if uploader := ass.GetUploader(); uploader != nil {
+		addString(l, "uploader", uploader.Login)
+	}
 	return nil
 }
 
@@ -306,12 +919,28 @@ func addTagLabels(l bpmmd.LabelSet, tag *github.RepositoryTag) error {
 	return nil
 }
 
+// addBranchLabels labels a branch with its head, which changes as commits are pushed.
+func addBranchLabels(l bpmmd.LabelSet, branch *github.Branch) {
+	l["git_branch"] = branch.GetName()
+	l["protected"] = strconv.FormatBool(branch.GetProtected())
+	if commit := branch.GetCommit(); commit != nil {
+		addString(l, "git_sha", commit.SHA)
+	}
+}
+
 func addString(l bpmmd.LabelSet, k string, x *string) {
 	if x != nil {
 		l[k] = *x
 	}
 }
 
+// addTimestamp sets k to the time x as TAI64, so it can be compared in queries
+func addTimestamp(l bpmmd.LabelSet, k string, x *github.Timestamp) {
+	if x != nil && !x.IsZero() {
+		l.PutTAI64(k, x.Time)
+	}
+}
+
 func fuzzSemver(l bpmmd.LabelSet) {
 	t, ok := l["tag_name"]
 	if !ok {
@@ -330,6 +959,7 @@ func fuzzArch(l bpmmd.LabelSet) {
 	}
 	for _, x := range []string{
 		"amd64",
+		"x86_64",
 		"arm64",
 		"aarch64",
 		"riscv",
@@ -348,6 +978,7 @@ func fuzzOS(l bpmmd.LabelSet) {
 	for _, x := range []string{
 		"linux",
 		"darwin",
+		"macos",
 		"windows",
 	} {
 		if strings.Contains(name, x) {
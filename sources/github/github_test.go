@@ -0,0 +1,718 @@
+package github
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/google/go-github/v50/github"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/internal/checksum"
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestParsePath(t *testing.T) {
+	tcs := []struct {
+		In                  string
+		Host, Account, Repo string
+		Err                 bool
+	}{
+		{In: "blobcache/bpm", Account: "blobcache", Repo: "bpm"},
+		{In: "github.com/blobcache/bpm", Account: "blobcache", Repo: "bpm"},
+		{In: "ghe.example.com/org/repo", Host: "ghe.example.com", Account: "org", Repo: "repo"},
+		{In: "blobcache", Err: true},
+		{In: "blobcache//bpm", Err: true},
+		{In: "a/b/c/d", Err: true},
+	}
+	for _, tc := range tcs {
+		host, account, repo, err := ParsePath(tc.In)
+		if tc.Err {
+			require.Error(t, err, tc.In)
+			continue
+		}
+		require.NoError(t, err, tc.In)
+		require.Equal(t, tc.Host, host)
+		require.Equal(t, tc.Account, account)
+		require.Equal(t, tc.Repo, repo)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 1; i <= 5; i++ {
+		srv.addRelease(fmt.Sprintf("v1.%d.0", i), map[string][]byte{
+			fmt.Sprintf("tool-linux-amd64-%d", i): []byte("binary"),
+		})
+	}
+	srv.addTag("v1.0.0")
+	cache := sources.NewMemCache()
+	src := srv.newSource(t, WithCache(cache))
+
+	assets := collect(t, src)
+	require.Len(t, assets, 6)
+	a := findAsset(t, assets, "tool-linux-amd64-5")
+	require.Equal(t, "v1.5.0", a.Labels["semver"])
+	require.Equal(t, "linux", a.Labels["os"])
+	require.Equal(t, "amd64", a.Labels["arch"])
+	require.Contains(t, idsOf(assets), "git-v1.0.0")
+	require.Equal(t, 0, srv.notModified)
+
+	// a second fetch should only fetch the first page, and it should not be modified.
+	srv.resetCounters()
+	require.Len(t, collect(t, src), 6)
+	require.Equal(t, 1, srv.countRequests("/releases"))
+	// releases, tags and branches
+	require.Equal(t, 3, srv.notModified)
+
+	// new releases are found, and the old ones are taken from the cache.
+	srv.addRelease("v1.6.0", map[string][]byte{"tool-linux-amd64-6": []byte("binary")})
+	srv.resetCounters()
+	assets = collect(t, src)
+	require.Len(t, assets, 7)
+	findAsset(t, assets, "tool-linux-amd64-6")
+	findAsset(t, assets, "tool-linux-amd64-1")
+	require.Equal(t, 1, srv.countRequests("/releases"))
+
+	// a deleted release is not taken from the cache, even though the first page has known releases.
+	srv.removeRelease("v1.6.0")
+	assets = collect(t, src)
+	require.Len(t, assets, 6)
+	require.NotContains(t, filenamesOf(assets), "tool-linux-amd64-6")
+	findAsset(t, assets, "tool-linux-amd64-1")
+}
+
+func TestReleaseLabels(t *testing.T) {
+	srv := newTestServer(t)
+	rel := srv.addRelease("v1.0.0", map[string][]byte{"tool-linux-amd64": []byte("binary")})
+	srv.addRelease("v1.1.0-rc1", map[string][]byte{"tool-linux-amd64-rc": []byte("binary")})
+	src := srv.newSource(t)
+
+	assets := collect(t, src)
+	a := findAsset(t, assets, "tool-linux-amd64")
+	require.Equal(t, "false", a.Labels["prerelease"])
+	require.Equal(t, "false", a.Labels["draft"])
+	require.Equal(t, "Changes in v1.0.0", a.Labels["release_body"])
+	require.Equal(t, "releaser", a.Labels["release_author"])
+	require.Equal(t, "6", a.Labels["size"])
+	require.Equal(t, "uploader", a.Labels["uploader"])
+	require.NotEmpty(t, a.Labels["download_count"])
+	published, err := a.Labels.Get("published_at").TAI64()
+	require.NoError(t, err)
+	require.Equal(t, rel.GetPublishedAt().Unix(), published.GoTime().Unix())
+
+	rc := findAsset(t, assets, "tool-linux-amd64-rc")
+	require.Equal(t, "true", rc.Labels["prerelease"])
+	require.Greater(t, rc.Labels["published_at"], a.Labels["published_at"])
+
+	// releases without a name are not labeled with one
+	unnamed := srv.addRelease("v1.2.0", map[string][]byte{"tool-linux-amd64-unnamed": []byte("binary")})
+	unnamed.Name = nil
+	assets = collect(t, src)
+	a = findAsset(t, assets, "tool-linux-amd64-unnamed")
+	require.Equal(t, "v1.2.0", a.Labels["tag_name"])
+	require.NotContains(t, a.Labels, "release_name")
+}
+
+func TestFetchFilter(t *testing.T) {
+	srv := newTestServer(t)
+	var rels []*github.RepositoryRelease
+	for i := 1; i <= 5; i++ {
+		rels = append(rels, srv.addRelease(fmt.Sprintf("v1.%d.0", i), map[string][]byte{
+			fmt.Sprintf("tool-linux-amd64-%d", i):  []byte("binary"),
+			fmt.Sprintf("tool-darwin-arm64-%d", i): []byte("binary"),
+		}))
+	}
+	srv.addRelease("nightly", map[string][]byte{"tool-linux-x86_64-nightly": []byte("binary")})
+	srv.addTag("v1.0.0")
+	srv.addTag("nightly")
+	srv.addTag("v0.9.0")
+	srv.addTag("v0.8.0")
+	srv.addTag("v0.7.0")
+
+	t.Run("MaxReleases", func(t *testing.T) {
+		srv.resetCounters()
+		src := srv.newSource(t, WithMaxReleases(2))
+		assets := collect(t, src)
+		require.ElementsMatch(t, []string{"tool-linux-x86_64-nightly", "tool-linux-amd64-5", "tool-darwin-arm64-5", "v1.0.0", "nightly"}, filenamesOf(assets))
+		require.Equal(t, 1, srv.countRequests("/releases"))
+		// tags are limited too, and later pages are not requested
+		require.Equal(t, 1, srv.countRequests("/tags"))
+	})
+	t.Run("Since", func(t *testing.T) {
+		src := srv.newSource(t, WithSince(rels[3].GetPublishedAt().Time))
+		assets := collect(t, src)
+		require.Contains(t, filenamesOf(assets), "tool-linux-amd64-4")
+		require.NotContains(t, filenamesOf(assets), "tool-linux-amd64-3")
+		// the tags were all made after the releases
+		require.Contains(t, idsOf(assets), "git-v0.7.0")
+
+		src = srv.newSource(t, WithSince(srv.commitTimes[srv.tags[3].GetCommit().GetSHA()]))
+		assets = collect(t, src)
+		require.NotContains(t, idsOf(assets), "git-v1.0.0")
+		require.Contains(t, idsOf(assets), "git-v0.8.0")
+		require.Contains(t, idsOf(assets), "git-v0.7.0")
+	})
+	t.Run("TagPattern", func(t *testing.T) {
+		src := srv.newSource(t, WithTagPattern("v1.*"))
+		assets := collect(t, src)
+		require.Len(t, assets, 11)
+		require.NotContains(t, idsOf(assets), "git-nightly")
+		require.NotContains(t, filenamesOf(assets), "tool-linux-x86_64-nightly")
+	})
+	t.Run("Platform", func(t *testing.T) {
+		src := srv.newSource(t, WithPlatform("linux", "amd64"))
+		assets := collect(t, src)
+		require.Contains(t, filenamesOf(assets), "tool-linux-x86_64-nightly")
+		require.Contains(t, filenamesOf(assets), "tool-linux-amd64-1")
+		require.NotContains(t, filenamesOf(assets), "tool-darwin-arm64-1")
+	})
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions(map[string]string{
+		"max_releases": "3",
+		"since":        "2023-01-02",
+		"tag_pattern":  "v*",
+		"platform":     "linux/amd64",
+	})
+	require.NoError(t, err)
+	var s GitHubSource
+	for _, opt := range opts {
+		opt(&s)
+	}
+	require.Equal(t, "max_releases=3&platform=linux/amd64&since=2023-01-02T00:00:00Z&tag_pattern=v*", s.filter.String())
+
+	for _, m := range []map[string]string{
+		{"max_releases": "0"},
+		{"since": "yesterday"},
+		{"tag_pattern": "["},
+		{"platform": "linux"},
+		{"unknown": "1"},
+	} {
+		_, err := ParseOptions(m)
+		require.Error(t, err, m)
+	}
+}
+
+func TestFetchRateLimit(t *testing.T) {
+	srv := newTestServer(t)
+	srv.addRelease("v1.0.0", map[string][]byte{"tool": []byte("binary")})
+	srv.rateLimited = 1
+	src := srv.newSource(t)
+	start := time.Now()
+	require.Len(t, collect(t, src), 1)
+	require.Greater(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestPullTag(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.addTag("v1.0.0")
+	src := srv.newSource(t)
+
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "git-v1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, "source of v1.0.0", readFile(t, &op, s, res.Root, "repo-v1.0.0/README"))
+}
+
+func TestPullAsset(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.addRelease("v1.0.0", map[string][]byte{"tool": []byte("binary")})
+	src := srv.newSource(t)
+
+	a := findAsset(t, collect(t, src), "tool")
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, a.ID)
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, res.Root)
+	require.NoError(t, err)
+	require.Equal(t, "binary", string(data))
+}
+
+func TestChecksums(t *testing.T) {
+	ctx := context.Background()
+	sum := func(x string) string {
+		h := sha256.Sum256([]byte(x))
+		return hex.EncodeToString(h[:])
+	}
+	srv := newTestServer(t)
+	srv.addRelease("v1.0.0", map[string][]byte{
+		"tool":               []byte("binary"),
+		"tool2":              []byte("tampered"),
+		"tool3":              []byte("binary3"),
+		"tool3.sha256":       []byte(sum("binary3") + "\n"),
+		"tool_checksums.txt": []byte(sum("binary") + "  tool\n" + sum("binary2") + "  tool2\n"),
+	})
+	src := srv.newSource(t, WithCache(sources.NewMemCache()))
+	assets := collect(t, src)
+	require.Equal(t, sum("binary"), findAsset(t, assets, "tool").Labels["sha256"])
+	require.Equal(t, sum("binary2"), findAsset(t, assets, "tool2").Labels["sha256"])
+	require.Equal(t, sum("binary3"), findAsset(t, assets, "tool3").Labels["sha256"])
+
+	// checksum files are only downloaded once
+	srv.resetCounters()
+	collect(t, src)
+	require.Equal(t, 0, srv.countRequests("/releases/assets/"))
+
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, findAsset(t, assets, "tool").ID)
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, res.Root)
+	require.NoError(t, err)
+	require.Equal(t, "binary", string(data))
+
+	_, err = src.Pull(ctx, &op, s, findAsset(t, assets, "tool2").ID)
+	require.ErrorIs(t, err, checksum.ErrMismatch)
+}
+
+func TestPullPrivate(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.token = "secret"
+	srv.addRelease("v1.0.0", map[string][]byte{"tool": []byte("binary")})
+	srv.addTag("v1.0.0")
+
+	// without a token, the repository is not visible.
+	src := srv.newSource(t)
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	_, err = streams.Collect[sources.RemoteAsset](ctx, it, 100)
+	require.Error(t, err)
+
+	t.Setenv("GITHUB_TOKEN", "secret")
+	src, err = NewGitHubSource("owner", "repo", WithBaseURL(srv.srv.URL+"/api/v3/"))
+	require.NoError(t, err)
+	a := findAsset(t, collect(t, src), "tool")
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, a.ID)
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, res.Root)
+	require.NoError(t, err)
+	require.Equal(t, "binary", string(data))
+
+	res, err = src.Pull(ctx, &op, s, "git-v1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, "source of v1.0.0", readFile(t, &op, s, res.Root, "repo-v1.0.0/README"))
+}
+
+func TestPullCommit(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	mainSHA := srv.addBranch("main", "source on main")
+	srv.addBranch("feature/x", "source on feature")
+	src := srv.newSource(t)
+
+	assets := collect(t, src)
+	require.Contains(t, idsOf(assets), "branch-main")
+	require.Contains(t, idsOf(assets), "branch-feature/x")
+	for _, a := range assets {
+		if a.ID == "branch-main" {
+			require.Equal(t, mainSHA, a.Labels["git_sha"])
+			require.Equal(t, "main", a.Labels["git_branch"])
+			require.Equal(t, "true", a.Labels["protected"])
+		}
+	}
+
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "branch-main")
+	require.NoError(t, err)
+	require.Equal(t, mainSHA, res.Labels["git_sha"])
+	require.Equal(t, "source on main", readFile(t, &op, s, res.Root, "owner-repo-"+mainSHA[:7]+"/README"))
+
+	// abbreviated hashes are resolved to the full hash
+	res, err = src.Pull(ctx, &op, s, "commit-"+mainSHA[:10])
+	require.NoError(t, err)
+	require.Equal(t, mainSHA, res.Labels["git_sha"])
+
+	_, err = src.Pull(ctx, &op, s, "commit-not-a-sha")
+	require.Error(t, err)
+	_, err = src.Pull(ctx, &op, s, "commit-"+strings.Repeat("0", 40))
+	require.Error(t, err)
+}
+
+func TestCheckRedirect(t *testing.T) {
+	parse := func(x string) *url.URL {
+		u, err := url.Parse(x)
+		require.NoError(t, err)
+		return u
+	}
+	require.NoError(t, checkRedirect(parse("https://api.github.com/"), parse("https://objects.githubusercontent.com/x")))
+	require.NoError(t, checkRedirect(parse("http://127.0.0.1/"), parse("http://127.0.0.1/x")))
+	require.Error(t, checkRedirect(parse("https://api.github.com/"), parse("http://example.com/x")))
+	require.Error(t, checkRedirect(parse("https://api.github.com/"), parse("file:///etc/passwd")))
+}
+
+// testServer is a stand-in for the GitHub REST API, serving a single repository.
+type testServer struct {
+	t   testing.TB
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	nextID    int64
+	releases  []*github.RepositoryRelease
+	tags      []*github.RepositoryTag
+	branches  []*github.Branch
+	assetData map[int64][]byte
+	// tarballs are keyed by the ref in the tarball URL
+	tarballs    map[string][]byte
+	commitTimes map[string]time.Time
+	requests    []string
+	notModified int
+	rateLimited int
+	// token, if set, is required for all API requests.
+	token string
+}
+
+func newTestServer(t testing.TB) *testServer {
+	ts := &testServer{
+		t:           t,
+		nextID:      1,
+		assetData:   make(map[int64][]byte),
+		tarballs:    make(map[string][]byte),
+		commitTimes: make(map[string]time.Time),
+	}
+	ts.srv = httptest.NewServer(http.HandlerFunc(ts.serveHTTP))
+	t.Cleanup(ts.srv.Close)
+	return ts
+}
+
+func (ts *testServer) newSource(t testing.TB, opts ...Option) *GitHubSource {
+	t.Setenv("GITHUB_TOKEN", "")
+	opts = append([]Option{WithBaseURL(ts.srv.URL + "/api/v3/")}, opts...)
+	src, err := NewGitHubSource("owner", "repo", opts...)
+	require.NoError(t, err)
+	return src
+}
+
+// addRelease adds a new release, which will be listed first.
+func (ts *testServer) addRelease(tag string, assets map[string][]byte) *github.RepositoryRelease {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	rel := &github.RepositoryRelease{
+		ID:          github.Int64(ts.nextID),
+		TagName:     github.String(tag),
+		Name:        github.String("Release " + tag),
+		Body:        github.String("Changes in " + tag),
+		Prerelease:  github.Bool(strings.Contains(tag, "-")),
+		Draft:       github.Bool(false),
+		CreatedAt:   &github.Timestamp{Time: time.Unix(1_600_000_000+ts.nextID, 0)},
+		PublishedAt: &github.Timestamp{Time: time.Unix(1_600_000_000+ts.nextID, 0)},
+		Author:      &github.User{Login: github.String("releaser")},
+	}
+	ts.nextID++
+	for name, data := range assets {
+		id := ts.nextID
+		ts.nextID++
+		ts.assetData[id] = data
+		rel.Assets = append(rel.Assets, &github.ReleaseAsset{
+			ID:                 github.Int64(id),
+			Name:               github.String(name),
+			Size:               github.Int(len(data)),
+			DownloadCount:      github.Int(int(id)),
+			Uploader:           &github.User{Login: github.String("uploader")},
+			ContentType:        github.String("application/octet-stream"),
+			URL:                github.String(fmt.Sprintf("%s/api/v3/repos/owner/repo/releases/assets/%d", ts.srv.URL, id)),
+			BrowserDownloadURL: github.String(fmt.Sprintf("%s/owner/repo/releases/download/%s/%s", ts.srv.URL, tag, name)),
+		})
+	}
+	ts.releases = append([]*github.RepositoryRelease{rel}, ts.releases...)
+	return rel
+}
+
+// removeRelease deletes the release with tag
+func (ts *testServer) removeRelease(tag string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for i, rel := range ts.releases {
+		if rel.GetTagName() == tag {
+			ts.releases = append(ts.releases[:i], ts.releases[i+1:]...)
+			return
+		}
+	}
+	ts.t.Fatalf("no release %q", tag)
+}
+
+func (ts *testServer) addTag(name string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	sha := fmt.Sprintf("%040x", len(ts.tags))
+	ts.tags = append(ts.tags, &github.RepositoryTag{
+		Name:   github.String(name),
+		Commit: &github.Commit{SHA: github.String(sha)},
+	})
+	ts.commitTimes[sha] = time.Unix(1_600_000_000+ts.nextID, 0)
+	ts.nextID++
+	ts.tarballs["refs/tags/"+name] = makeTarball(ts.t, "repo-"+name, map[string]string{"README": "source of " + name})
+}
+
+// addBranch adds a branch with a head commit, and returns the commit's sha
+func (ts *testServer) addBranch(name, content string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))[:40]
+	ts.branches = append(ts.branches, &github.Branch{
+		Name:      github.String(name),
+		Commit:    &github.RepositoryCommit{SHA: github.String(sha)},
+		Protected: github.Bool(name == "main"),
+	})
+	ts.tarballs[sha] = makeTarball(ts.t, "owner-repo-"+sha[:7], map[string]string{"README": content})
+	ts.commitTimes[sha] = time.Unix(1_600_000_000+ts.nextID, 0)
+	ts.nextID++
+	return sha
+}
+
+func (ts *testServer) resetCounters() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.requests = nil
+	ts.notModified = 0
+}
+
+func (ts *testServer) countRequests(substr string) (n int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, r := range ts.requests {
+		if strings.Contains(r, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (ts *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.requests = append(ts.requests, r.URL.Path)
+	if ts.rateLimited > 0 {
+		ts.rateLimited--
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+		return
+	}
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/api/") {
+		if ts.token != "" && r.Header.Get("Authorization") != "Bearer "+ts.token {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+	} else if r.Header.Get("Authorization") != "" {
+		ts.t.Errorf("credentials sent to %s", p)
+	}
+	switch {
+	case p == "/api/v3/repos/owner/repo/releases":
+		ts.servePage(w, r, ts.releases)
+	case p == "/api/v3/repos/owner/repo/tags":
+		ts.servePage(w, r, ts.tags)
+	case p == "/api/v3/repos/owner/repo/branches":
+		ts.servePage(w, r, ts.branches)
+	case strings.HasPrefix(p, "/api/v3/repos/owner/repo/git/commits/"):
+		sha := strings.TrimPrefix(p, "/api/v3/repos/owner/repo/git/commits/")
+		t, ok := ts.commitTimes[sha]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&github.Commit{
+			SHA:       github.String(sha),
+			Committer: &github.CommitAuthor{Date: &github.Timestamp{Time: t}},
+		})
+	case strings.HasPrefix(p, "/api/v3/repos/owner/repo/commits/"):
+		ref := strings.TrimPrefix(p, "/api/v3/repos/owner/repo/commits/")
+		for _, b := range ts.branches {
+			sha := b.GetCommit().GetSHA()
+			if ref == "heads/"+b.GetName() || strings.HasPrefix(sha, ref) {
+				fmt.Fprint(w, sha)
+				return
+			}
+		}
+		http.Error(w, `{"message": "No commit found"}`, http.StatusUnprocessableEntity)
+	case strings.HasPrefix(p, "/api/v3/repos/owner/repo/releases/assets/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(p, "/api/v3/repos/owner/repo/releases/assets/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ra := ts.findAsset(id)
+		if ra == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Accept") == "application/octet-stream" {
+			http.Redirect(w, r, fmt.Sprintf("/storage/assets/%d?signature=x", id), http.StatusFound)
+			return
+		}
+		json.NewEncoder(w).Encode(ra)
+	case strings.HasPrefix(p, "/api/v3/repos/owner/repo/tarball/"):
+		ref := strings.TrimPrefix(p, "/api/v3/repos/owner/repo/tarball/")
+		if _, ok := ts.tarballs[ref]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, ts.srv.URL+"/codeload/"+ref+"?token=x", http.StatusFound)
+	case strings.HasPrefix(p, "/codeload/"):
+		data, ok := ts.tarballs[strings.TrimPrefix(p, "/codeload/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case strings.HasPrefix(p, "/storage/assets/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(p, "/storage/assets/"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, ok := ts.assetData[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ts *testServer) findAsset(id int64) *github.ReleaseAsset {
+	for _, rel := range ts.releases {
+		for _, ra := range rel.Assets {
+			if ra.GetID() == id {
+				return ra
+			}
+		}
+	}
+	return nil
+}
+
+// servePage serves a page of xs, with the page size given by per_page, and responds 304 if the ETag matches.
+func (ts *testServer) servePage(w http.ResponseWriter, r *http.Request, xs any) {
+	data, err := json.Marshal(xs)
+	require.NoError(ts.t, err)
+	var all []json.RawMessage
+	require.NoError(ts.t, json.Unmarshal(data, &all))
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	// use small pages so that paging is exercised.
+	const perPage = 2
+	start := (page - 1) * perPage
+	end := start + perPage
+	if start > len(all) {
+		start = len(all)
+	}
+	if end > len(all) {
+		end = len(all)
+	}
+	if end < len(all) {
+		next := *r.URL
+		q := next.Query()
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, ts.srv.URL, next.RequestURI()))
+	}
+	body, err := json.Marshal(all[start:end])
+	require.NoError(ts.t, err)
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	if r.Header.Get("If-None-Match") == etag {
+		ts.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func makeTarball(t testing.TB, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     prefix + "/" + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func collect(t testing.TB, src *GitHubSource) []sources.RemoteAsset {
+	ctx := context.Background()
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 1000)
+	require.NoError(t, err)
+	return assets
+}
+
+func findAsset(t testing.TB, assets []sources.RemoteAsset, filename string) sources.RemoteAsset {
+	for _, a := range assets {
+		if a.Labels["filename"] == filename {
+			return a
+		}
+	}
+	t.Fatalf("no asset with filename %q", filename)
+	return sources.RemoteAsset{}
+}
+
+func filenamesOf(assets []sources.RemoteAsset) (ret []string) {
+	for _, a := range assets {
+		if name, ok := a.Labels["filename"]; ok {
+			ret = append(ret, name)
+		} else {
+			ret = append(ret, strings.TrimPrefix(a.ID, tagPrefix))
+		}
+	}
+	return ret
+}
+
+func idsOf(assets []sources.RemoteAsset) (ret []string) {
+	for _, a := range assets {
+		ret = append(ret, a.ID)
+	}
+	return ret
+}
+
+func readFile(t testing.TB, op *glfs.Operator, s cadata.Store, root glfs.Ref, p string) string {
+	ctx := context.Background()
+	ref, err := op.GetAtPath(ctx, s, root, p)
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	return string(data)
+}
@@ -0,0 +1,212 @@
+// Package goproxy implements a Source for Go modules, using the GOPROXY protocol.
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+// DefaultProxy is used when GOPROXY does not contain a proxy URL.
+const DefaultProxy = "https://proxy.golang.org"
+
+var (
+	_ sources.Source         = &GoProxySource{}
+	_ sources.EndpointSource = &GoProxySource{}
+)
+
+// GoProxySource lists the versions of a single module.
+type GoProxySource struct {
+	proxy   url.URL
+	modPath string
+	hc      *http.Client
+}
+
+// NewGoProxySource returns a source for the module at modPath, served by the proxy at proxyURL.
+func NewGoProxySource(proxyURL, modPath string) (*GoProxySource, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("goproxy: proxy must be http or https, have %q", proxyURL)
+	}
+	if err := module.CheckPath(modPath); err != nil {
+		return nil, err
+	}
+	return &GoProxySource{
+		proxy:   *u,
+		modPath: modPath,
+		hc:      http.DefaultClient,
+	}, nil
+}
+
+// ProxyFromEnv returns the first proxy URL in the GOPROXY environment variable,
+// or DefaultProxy if there is none.
+func ProxyFromEnv() string {
+	for _, x := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(r rune) bool {
+		return r == ',' || r == '|'
+	}) {
+		if strings.HasPrefix(x, "https://") || strings.HasPrefix(x, "http://") {
+			return x
+		}
+	}
+	return DefaultProxy
+}
+
+// Endpoint implements sources.EndpointSource.
+func (s *GoProxySource) Endpoint() string {
+	return s.proxy.String()
+}
+
+// Fetch lists the versions of the module, and retrieves info for each.
+func (s *GoProxySource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	u, err := s.url("list")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var versions []string
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		// lines may contain additional fields after the version.
+		fields := strings.Fields(sc.Text())
+		if len(fields) > 0 {
+			versions = append(versions, fields[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	semver.Sort(versions)
+	return &versionIterator{src: s, versions: versions}, nil
+}
+
+// Pull downloads the module zip for the version id, and imports its contents
+// with the module@version/ prefix removed.
+func (s *GoProxySource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	u, err := s.url(id + ".zip")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return unpack.Import(ctx, op, store, id+".zip", rc, unpack.StripPrefix(s.modPath+"@"+id+"/"))
+}
+
+// Info is the response to a .info request
+type Info struct {
+	Version string    `json:"Version"`
+	Time    time.Time `json:"Time"`
+}
+
+func (s *GoProxySource) getInfo(ctx context.Context, version string) (*Info, error) {
+	u, err := s.url(version + ".info")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var info Info
+	if err := json.NewDecoder(rc).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// url returns the URL for a file beneath the @v directory for the module.
+func (s *GoProxySource) url(name string) (string, error) {
+	escPath, err := module.EscapePath(s.modPath)
+	if err != nil {
+		return "", err
+	}
+	if name != "list" {
+		ext := path.Ext(name)
+		escVersion, err := module.EscapeVersion(strings.TrimSuffix(name, ext))
+		if err != nil {
+			return "", err
+		}
+		name = escVersion + ext
+	}
+	u := s.proxy
+	u.Path = path.Join(u.Path, escPath, "@v", name)
+	return u.String(), nil
+}
+
+func (s *GoProxySource) get(ctx context.Context, u string) (io.ReadCloser, error) {
+	logctx.Infof(ctx, "downloading %v", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("goproxy: GET %s: %v", u, res.Status)
+	}
+	return res.Body, nil
+}
+
+type versionIterator struct {
+	src      *GoProxySource
+	versions []string
+}
+
+func (it *versionIterator) Next(ctx context.Context, dst *sources.RemoteAsset) error {
+	if len(it.versions) == 0 {
+		return streams.EOS()
+	}
+	info, err := it.src.getInfo(ctx, it.versions[0])
+	if err != nil {
+		return err
+	}
+	it.versions = it.versions[1:]
+	labels := bpmmd.LabelSet{
+		"module":  it.src.modPath,
+		"version": info.Version,
+	}
+	if sv := semver.Canonical(info.Version); sv != "" {
+		labels["semver"] = sv
+	}
+	if pre := semver.Prerelease(info.Version); pre != "" {
+		labels["prerelease"] = pre
+	}
+	labels.PutTAI64("time", info.Time)
+	*dst = sources.RemoteAsset{
+		ID:     info.Version,
+		Labels: labels,
+	}
+	return nil
+}
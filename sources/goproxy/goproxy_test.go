@@ -0,0 +1,187 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProxy(t, "github.com/BurntSushi/toml")
+	p.putVersion("v1.2.0", nil)
+	p.putVersion("v1.10.0", nil)
+	p.putVersion("v1.3.0-RC1", nil)
+
+	src := p.newSource(t)
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 100)
+	require.NoError(t, err)
+	require.Len(t, assets, 3)
+	// sorted by semver
+	require.Equal(t, "v1.2.0", assets[0].ID)
+	require.Equal(t, "v1.3.0-RC1", assets[1].ID)
+	require.Equal(t, "-RC1", assets[1].Labels["prerelease"])
+	require.Equal(t, "v1.10.0", assets[2].ID)
+	require.Equal(t, "github.com/BurntSushi/toml", assets[2].Labels["module"])
+	require.Equal(t, "v1.10.0", assets[2].Labels["semver"])
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProxy(t, "github.com/BurntSushi/toml")
+	p.putVersion("v1.3.0-RC1", map[string]string{
+		"go.mod":            "module github.com/BurntSushi/toml\n",
+		"decode.go":         "package toml\n",
+		"internal/tz.go":    "package internal\n",
+		"cmd/tomlv/main.go": "package main\n",
+	})
+
+	src := p.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "v1.3.0-RC1")
+	require.NoError(t, err)
+	// the module@version/ prefix is removed
+	tree, err := op.GetTree(ctx, s, res.Root)
+	require.NoError(t, err)
+	var names []string
+	for _, ent := range tree.Entries {
+		names = append(names, ent.Name)
+	}
+	require.ElementsMatch(t, []string{"go.mod", "decode.go", "internal", "cmd"}, names)
+	ref, err := op.GetAtPath(ctx, s, res.Root, "cmd/tomlv/main.go")
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n", string(data))
+
+	_, err = src.Pull(ctx, &op, s, "v2.0.0")
+	require.ErrorContains(t, err, "404")
+}
+
+func TestURL(t *testing.T) {
+	src, err := NewGoProxySource("https://proxy.example.com/go/", "github.com/BurntSushi/toml")
+	require.NoError(t, err)
+	// upper case letters in the module path and version are escaped
+	for name, want := range map[string]string{
+		"list":           "/go/github.com/!burnt!sushi/toml/@v/list",
+		"v1.3.0-RC1.zip": "/go/github.com/!burnt!sushi/toml/@v/v1.3.0-!r!c1.zip",
+		"v1.2.0.info":    "/go/github.com/!burnt!sushi/toml/@v/v1.2.0.info",
+	} {
+		x, err := src.url(name)
+		require.NoError(t, err)
+		u, err := url.Parse(x)
+		require.NoError(t, err)
+		require.Equal(t, "proxy.example.com", u.Host)
+		require.Equal(t, want, u.Path)
+	}
+
+	_, err = NewGoProxySource("https://proxy.example.com", "not a module")
+	require.Error(t, err)
+}
+
+func TestProxyFromEnv(t *testing.T) {
+	t.Setenv("GOPROXY", "direct")
+	require.Equal(t, DefaultProxy, ProxyFromEnv())
+	t.Setenv("GOPROXY", "off|https://a.example.com,https://b.example.com")
+	require.Equal(t, "https://a.example.com", ProxyFromEnv())
+}
+
+// testProxy is an in-process stand-in for a module proxy serving a single module.
+// It only serves escaped paths, as a real proxy would.
+type testProxy struct {
+	t       testing.TB
+	modPath string
+	srv     *httptest.Server
+
+	versions []string
+	zips     map[string][]byte
+}
+
+func newTestProxy(t testing.TB, modPath string) *testProxy {
+	p := &testProxy{
+		t:       t,
+		modPath: modPath,
+		zips:    make(map[string][]byte),
+	}
+	p.srv = httptest.NewServer(p)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *testProxy) newSource(t testing.TB) *GoProxySource {
+	src, err := NewGoProxySource(p.srv.URL, p.modPath)
+	require.NoError(t, err)
+	return src
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, ok := strings.CutPrefix(req.URL.Path, "/"+escape(p.modPath)+"/@v/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if name == "list" {
+		// versions are not sorted, and may be followed by other fields
+		for _, v := range p.versions {
+			fmt.Fprintf(w, "%s extra\n", v)
+		}
+		return
+	}
+	for _, v := range p.versions {
+		switch name {
+		case escape(v) + ".info":
+			json.NewEncoder(w).Encode(Info{Version: v, Time: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)})
+			return
+		case escape(v) + ".zip":
+			w.Write(p.zips[v])
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// putVersion adds version v of the module, with files at the root of the module
+func (p *testProxy) putVersion(v string, files map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(p.modPath + "@" + v + "/" + name)
+		require.NoError(p.t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(p.t, err)
+	}
+	require.NoError(p.t, zw.Close())
+	p.versions = append(p.versions, v)
+	p.zips[v] = buf.Bytes()
+}
+
+// escape replaces upper case letters with ! and the lower case letter
+func escape(x string) string {
+	var sb strings.Builder
+	for _, r := range x {
+		if 'A' <= r && r <= 'Z' {
+			sb.WriteRune('!')
+			r += 'a' - 'A'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -2,6 +2,7 @@ package httpscrape
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
 	"path"
@@ -10,12 +11,16 @@ import (
 	"github.com/blobcache/glfs"
 	"github.com/brendoncarroll/go-exp/streams"
 	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
 	"github.com/gocolly/colly/v2"
 
 	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
 	"github.com/blobcache/bpm/sources"
 )
 
+var _ sources.EndpointSource = &HTTPScraper{}
+
 type HTTPScraper struct {
 	target url.URL
 }
@@ -29,6 +34,11 @@ func NewHTTPScraper(target string) (*HTTPScraper, error) {
 	return &HTTPScraper{target: *u}, nil
 }
 
+// Endpoint implements sources.EndpointSource.
+func (s *HTTPScraper) Endpoint() string {
+	return s.target.String()
+}
+
 func (s *HTTPScraper) Fetch(ctx context.Context) (sources.AssetIterator, error) {
 	hc := http.DefaultClient
 	resp, err := hc.Get(s.target.String())
@@ -61,16 +71,22 @@ func (s *HTTPScraper) Fetch(ctx context.Context) (sources.AssetIterator, error)
 	return streams.NewSlice(assets, nil), nil
 }
 
-func (s *HTTPScraper) Pull(ctx context.Context, fsop *glfs.Operator, src cadata.Store, id string) (*glfs.Ref, error) {
+func (s *HTTPScraper) Pull(ctx context.Context, fsop *glfs.Operator, src cadata.Store, id string) (*sources.PullResult, error) {
 	u2 := s.target
 	u2.Path = path.Join(u2.Path, id)
 
-	switch {
-	case strings.HasSuffix(u2.Path, ".tar.gz"):
-		panic("not implemented")
-	case strings.HasSuffix(u2.Path, ".zip"):
-		panic("not implemented")
-	default:
-		return nil, nil
+	logctx.Infof(ctx, "downloading %v", u2.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u2.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("httpscrape: GET %s: %v", u2.String(), resp.Status)
 	}
+	return unpack.Import(ctx, fsop, src, path.Base(u2.Path), resp.Body)
 }
@@ -0,0 +1,291 @@
+// Package npm implements a Source for packages in an npm registry.
+package npm
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
+	"golang.org/x/mod/semver"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+// DefaultRegistry is used if NPM_CONFIG_REGISTRY is not set.
+const DefaultRegistry = "https://registry.npmjs.org/"
+
+var (
+	_ sources.Source         = &NPMSource{}
+	_ sources.EndpointSource = &NPMSource{}
+)
+
+// NPMSource lists the versions of a single package.
+type NPMSource struct {
+	registry url.URL
+	name     string
+	hc       *http.Client
+}
+
+// NewNPMSource returns a source for the package name, which may be scoped e.g. @scope/name
+func NewNPMSource(registryURL, name string) (*NPMSource, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("npm: registry must be http or https, have %q", registryURL)
+	}
+	if name == "" || strings.Count(name, "/") > 1 || (strings.Contains(name, "/") && !strings.HasPrefix(name, "@")) {
+		return nil, fmt.Errorf("npm: invalid package name %q", name)
+	}
+	return &NPMSource{
+		registry: *u,
+		name:     name,
+		hc:       http.DefaultClient,
+	}, nil
+}
+
+// RegistryFromEnv returns the value of NPM_CONFIG_REGISTRY, or DefaultRegistry if it is not set.
+func RegistryFromEnv() string {
+	if v, ok := os.LookupEnv("NPM_CONFIG_REGISTRY"); ok && v != "" {
+		return v
+	}
+	return DefaultRegistry
+}
+
+// Endpoint implements sources.EndpointSource.
+func (s *NPMSource) Endpoint() string {
+	return s.registry.String()
+}
+
+// Fetch lists every version of the package in the registry.
+func (s *NPMSource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	doc, err := s.getPackument(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tagsByVersion := map[string][]string{}
+	for tag, v := range doc.DistTags {
+		tagsByVersion[v] = append(tagsByVersion[v], tag)
+	}
+	var assets []sources.RemoteAsset
+	for v, pv := range doc.Versions {
+		labels := bpmmd.LabelSet{
+			"name":    doc.Name,
+			"version": v,
+			"tarball": pv.Dist.Tarball,
+		}
+		if sv := semver.Canonical("v" + v); sv != "" {
+			labels["semver"] = sv
+		}
+		if tags := tagsByVersion[v]; len(tags) > 0 {
+			sort.Strings(tags)
+			labels["dist_tags"] = strings.Join(tags, ",")
+		}
+		if pv.Dist.Integrity != "" {
+			labels["integrity"] = pv.Dist.Integrity
+		}
+		if pv.Dist.Shasum != "" {
+			labels["shasum"] = pv.Dist.Shasum
+		}
+		if pv.Deprecated != "" {
+			labels["deprecated"] = pv.Deprecated
+		}
+		if t, ok := doc.Time[v]; ok {
+			labels.PutTAI64("time", t)
+		}
+		assets = append(assets, sources.RemoteAsset{
+			ID:     v,
+			Labels: labels,
+		})
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return semver.Compare("v"+assets[i].ID, "v"+assets[j].ID) < 0
+	})
+	return streams.NewSlice(assets, nil), nil
+}
+
+// Pull downloads the tarball for the version id, verifies its integrity,
+// and imports its contents with the leading package/ directory removed.
+func (s *NPMSource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	doc, err := s.getPackument(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pv, ok := doc.Versions[id]
+	if !ok {
+		return nil, fmt.Errorf("npm: package %q has no version %q", s.name, id)
+	}
+	integrity := pv.Dist.Integrity
+	if integrity == "" && pv.Dist.Shasum != "" {
+		// older packages only publish a sha1 hex digest.
+		sum, err := hex.DecodeString(pv.Dist.Shasum)
+		if err != nil {
+			return nil, err
+		}
+		integrity = "sha1-" + base64.StdEncoding.EncodeToString(sum)
+	}
+	f, err := s.download(ctx, pv.Dist.Tarball, integrity)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// the package is in a top level directory, which is usually package/
+	return unpack.Import(ctx, op, store, path.Base(pv.Dist.Tarball), f, unpack.StripComponents(1))
+}
+
+// Packument is the registry document for a package.
+type Packument struct {
+	Name     string
+	DistTags map[string]string
+	Versions map[string]PackageVersion
+	// Time maps versions to the time they were published
+	Time map[string]time.Time
+}
+
+type PackageVersion struct {
+	Version    string `json:"version"`
+	Deprecated string `json:"deprecated,omitempty"`
+	Dist       struct {
+		Tarball   string `json:"tarball"`
+		Integrity string `json:"integrity"`
+		Shasum    string `json:"shasum"`
+	} `json:"dist"`
+}
+
+func (s *NPMSource) getPackument(ctx context.Context) (*Packument, error) {
+	u := strings.TrimSuffix(s.registry.String(), "/") + "/" + url.PathEscape(s.name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("npm: GET %s: %v", u, res.Status)
+	}
+	var raw struct {
+		Name     string                     `json:"name"`
+		DistTags map[string]string          `json:"dist-tags"`
+		Versions map[string]PackageVersion  `json:"versions"`
+		Time     map[string]json.RawMessage `json:"time"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	doc := Packument{
+		Name:     raw.Name,
+		DistTags: raw.DistTags,
+		Versions: raw.Versions,
+		Time:     make(map[string]time.Time),
+	}
+	// time also contains entries which are not timestamps, such as "unpublished"
+	for k, data := range raw.Time {
+		var t time.Time
+		if err := json.Unmarshal(data, &t); err == nil {
+			doc.Time[k] = t
+		}
+	}
+	return &doc, nil
+}
+
+// download writes the file at u to a temporary file, and checks it against the SRI string integrity.
+// The returned file is positioned at the beginning.
+func (s *NPMSource) download(ctx context.Context, u string, integrity string) (*os.File, error) {
+	h, want, err := parseIntegrity(integrity)
+	if err != nil {
+		return nil, err
+	}
+	logctx.Infof(ctx, "downloading %v", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("npm: GET %s: %v", u, res.Status)
+	}
+	f, err := os.CreateTemp("", "bpm-npm")
+	if err != nil {
+		return nil, err
+	}
+	if err := func() error {
+		if _, err := io.Copy(io.MultiWriter(f, h), res.Body); err != nil {
+			return err
+		}
+		if have := h.Sum(nil); string(have) != string(want) {
+			return fmt.Errorf("npm: integrity mismatch for %s have %s want %s", u, base64.StdEncoding.EncodeToString(have), integrity)
+		}
+		_, err := f.Seek(0, io.SeekStart)
+		return err
+	}(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseIntegrity parses a Subresource Integrity string, and returns a hash for the strongest algorithm in it.
+func parseIntegrity(x string) (hash.Hash, []byte, error) {
+	algs := []struct {
+		name string
+		new  func() hash.Hash
+	}{
+		{"sha512", sha512.New},
+		{"sha384", sha512.New384},
+		{"sha256", sha256.New},
+		{"sha1", sha1.New},
+	}
+	hashes := map[string]string{}
+	for _, field := range strings.Fields(x) {
+		alg, b64, ok := strings.Cut(field, "-")
+		if !ok {
+			continue
+		}
+		// options may follow a '?'
+		b64, _, _ = strings.Cut(b64, "?")
+		hashes[alg] = b64
+	}
+	for _, alg := range algs {
+		b64, ok := hashes[alg.name]
+		if !ok {
+			continue
+		}
+		want, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, nil, err
+		}
+		return alg.new(), want, nil
+	}
+	return nil, nil, fmt.Errorf("npm: no supported hash in integrity %q", x)
+}
@@ -0,0 +1,199 @@
+package npm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "@tools/hello")
+	reg.putVersion("1.10.0", testTarball(t, map[string]string{"package/index.js": "v1.10"}))
+	reg.putVersion("1.2.0", testTarball(t, map[string]string{"package/index.js": "v1.2"}))
+	reg.distTags["latest"] = "1.10.0"
+	reg.distTags["stable"] = "1.10.0"
+
+	src := reg.newSource(t)
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 100)
+	require.NoError(t, err)
+	require.Len(t, assets, 2)
+	// sorted by semver, not lexically
+	require.Equal(t, "1.2.0", assets[0].ID)
+	require.Equal(t, "1.10.0", assets[1].ID)
+	require.Equal(t, "v1.10.0", assets[1].Labels["semver"])
+	require.Equal(t, "latest,stable", assets[1].Labels["dist_tags"])
+	require.Equal(t, "@tools/hello", assets[1].Labels["name"])
+	require.NotEmpty(t, assets[1].Labels["integrity"])
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "hello")
+	reg.putVersion("1.0.0", testTarball(t, map[string]string{
+		"package/package.json": `{"name": "hello"}`,
+		"package/bin/hello.js": "console.log('hello')",
+	}))
+
+	src := reg.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "1.0.0")
+	require.NoError(t, err)
+	// the package/ directory is removed
+	ref, err := op.GetAtPath(ctx, s, res.Root, "bin/hello.js")
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	require.Equal(t, "console.log('hello')", string(data))
+
+	_, err = src.Pull(ctx, &op, s, "2.0.0")
+	require.ErrorContains(t, err, "no version")
+}
+
+func TestPullIntegrityMismatch(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "hello")
+	reg.putVersion("1.0.0", testTarball(t, map[string]string{"package/index.js": "hello"}))
+	// the tarball is replaced after it was published
+	reg.tarballs["1.0.0"] = testTarball(t, map[string]string{"package/index.js": "evil"})
+
+	src := reg.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	_, err := src.Pull(ctx, &op, s, "1.0.0")
+	require.ErrorContains(t, err, "integrity mismatch")
+
+	// packages with only a shasum are checked against it
+	reg.putVersion("0.1.0", testTarball(t, map[string]string{"package/index.js": "old"}))
+	pv := reg.versions["0.1.0"]
+	pv.Dist.Integrity = ""
+	reg.versions["0.1.0"] = pv
+	reg.tarballs["0.1.0"] = testTarball(t, map[string]string{"package/index.js": "evil"})
+	_, err = src.Pull(ctx, &op, s, "0.1.0")
+	require.ErrorContains(t, err, "integrity mismatch")
+}
+
+func TestParseIntegrity(t *testing.T) {
+	data := []byte("hello")
+	sum512 := sha512.Sum512(data)
+	sum1 := sha1.Sum(data)
+	// the strongest hash is used
+	x := "sha1-" + base64.StdEncoding.EncodeToString(sum1[:]) + " sha512-" + base64.StdEncoding.EncodeToString(sum512[:]) + "?opt"
+	h, want, err := parseIntegrity(x)
+	require.NoError(t, err)
+	h.Write(data)
+	require.Equal(t, want, h.Sum(nil))
+	require.Equal(t, sum512[:], want)
+
+	_, _, err = parseIntegrity("md5-AAAA")
+	require.Error(t, err)
+	_, _, err = parseIntegrity("")
+	require.Error(t, err)
+}
+
+// testRegistry is an in-process stand-in for an npm registry with a single package.
+type testRegistry struct {
+	t    testing.TB
+	name string
+	srv  *httptest.Server
+
+	distTags map[string]string
+	versions map[string]PackageVersion
+	tarballs map[string][]byte
+}
+
+func newTestRegistry(t testing.TB, name string) *testRegistry {
+	r := &testRegistry{
+		t:    t,
+		name: name,
+
+		distTags: make(map[string]string),
+		versions: make(map[string]PackageVersion),
+		tarballs: make(map[string][]byte),
+	}
+	r.srv = httptest.NewServer(r)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *testRegistry) newSource(t testing.TB) *NPMSource {
+	src, err := NewNPMSource(r.srv.URL, r.name)
+	require.NoError(t, err)
+	return src
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := req.URL.EscapedPath()
+	if v, ok := strings.CutPrefix(p, "/tarballs/"); ok {
+		data, ok := r.tarballs[strings.TrimSuffix(v, ".tgz")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	// scoped names have their / escaped
+	if p != "/"+strings.ReplaceAll(r.name, "/", "%2F") {
+		http.NotFound(w, req)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":      r.name,
+		"dist-tags": r.distTags,
+		"versions":  r.versions,
+		"time":      map[string]string{"created": "2023-01-01T00:00:00Z", "unpublished": "x"},
+	})
+}
+
+// putVersion publishes the tarball as version v, with its integrity and shasum
+func (r *testRegistry) putVersion(v string, tarball []byte) {
+	sum512 := sha512.Sum512(tarball)
+	sum1 := sha1.Sum(tarball)
+	var pv PackageVersion
+	pv.Version = v
+	pv.Dist.Tarball = r.srv.URL + "/tarballs/" + v + ".tgz"
+	pv.Dist.Integrity = "sha512-" + base64.StdEncoding.EncodeToString(sum512[:])
+	pv.Dist.Shasum = hex.EncodeToString(sum1[:])
+	r.versions[v] = pv
+	r.tarballs[v] = tarball
+}
+
+func testTarball(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
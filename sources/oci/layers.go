@@ -0,0 +1,151 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-state/cadata"
+
+	"github.com/blobcache/bpm/internal/unpack"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// flattener applies image layers in order, producing a single tree.
+type flattener struct {
+	ents map[string]glfs.TreeEntry
+}
+
+func newFlattener() *flattener {
+	return &flattener{ents: make(map[string]glfs.TreeEntry)}
+}
+
+// readTAR applies the layer in tr on top of the layers already read.
+func (fl *flattener) readTAR(ctx context.Context, op *glfs.Operator, s cadata.Poster, tr *tar.Reader) error {
+	// whiteouts only hide entries from lower layers, regardless of their order in this layer.
+	added := map[string]struct{}{}
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := unpack.CheckName(th.Name); err != nil {
+			return err
+		}
+		p := glfs.CleanPath(th.Name)
+		if p == "" {
+			continue
+		}
+		dir, base := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case base == whiteoutOpaque:
+			fl.deleteChildren(dir, added)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			fl.delete(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), added)
+			continue
+		}
+		mode := os.FileMode(th.Mode).Perm()
+		var ref *glfs.Ref
+		switch th.Typeflag {
+		case tar.TypeDir:
+			// replacing a file with a directory
+			if ent, exists := fl.ents[p]; exists && ent.Ref.Type == glfs.TypeTree {
+				continue
+			}
+			ref, err = op.PostTree(ctx, s, glfs.Tree{})
+			mode |= os.ModeDir
+		case tar.TypeSymlink:
+			target, err2 := unpack.LinkTarget(p, th.Linkname)
+			if err2 != nil {
+				return err2
+			}
+			ref, err = op.PostBlob(ctx, s, strings.NewReader(target))
+			mode |= os.ModeSymlink
+		case tar.TypeLink:
+			if err := unpack.CheckName(th.Linkname); err != nil {
+				return err
+			}
+			target, ok := fl.ents[glfs.CleanPath(th.Linkname)]
+			if !ok {
+				return fmt.Errorf("oci: hard link %q to missing file %q", th.Name, th.Linkname)
+			}
+			ref, mode = &target.Ref, target.FileMode
+		case tar.TypeReg:
+			ref, err = op.PostBlob(ctx, s, tr)
+		case tar.TypeChar, tar.TypeBlock:
+			return fmt.Errorf("%w: %q is a device", unpack.ErrUnsafe, th.Name)
+		default:
+			// fifos etc. cannot be represented
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fl.delete(p, nil)
+		fl.ents[p] = glfs.TreeEntry{Name: p, FileMode: mode, Ref: *ref}
+		added[p] = struct{}{}
+	}
+}
+
+// delete removes p and its children, except for those in keep
+func (fl *flattener) delete(p string, keep map[string]struct{}) {
+	if _, exists := keep[p]; !exists {
+		delete(fl.ents, p)
+	}
+	fl.deleteChildren(p, keep)
+}
+
+// deleteChildren removes the children of p, except for those in keep
+func (fl *flattener) deleteChildren(p string, keep map[string]struct{}) {
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	for k := range fl.ents {
+		if _, exists := keep[k]; exists {
+			continue
+		}
+		if strings.HasPrefix(k, prefix) && k != p {
+			delete(fl.ents, k)
+		}
+	}
+}
+
+func (fl *flattener) finish(ctx context.Context, op *glfs.Operator, s cadata.Poster) (*glfs.Ref, error) {
+	// directories are implied by their children, only keep the empty ones.
+	nonEmpty := map[string]struct{}{}
+	for k := range fl.ents {
+		for dir := path.Dir(k); dir != "."; dir = path.Dir(dir) {
+			// an entry under a symlink would be written wherever the symlink points
+			if ent, exists := fl.ents[dir]; exists && ent.Ref.Type != glfs.TypeTree {
+				return nil, fmt.Errorf("%w: %q is inside of %q, which is not a directory", unpack.ErrUnsafe, k, dir)
+			}
+			nonEmpty[dir] = struct{}{}
+		}
+	}
+	ents := make([]glfs.TreeEntry, 0, len(fl.ents))
+	for k, ent := range fl.ents {
+		if _, exists := nonEmpty[k]; exists {
+			continue
+		}
+		ents = append(ents, ent)
+	}
+	if len(ents) == 0 {
+		return op.PostTree(ctx, s, glfs.Tree{})
+	}
+	return op.PostTreeFromEntries(ctx, s, ents)
+}
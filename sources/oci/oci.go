@@ -0,0 +1,472 @@
+// Package oci implements a Source for registries speaking the OCI distribution API.
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
+	"golang.org/x/mod/semver"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerV2      = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var (
+	_ sources.Source         = &OCISource{}
+	_ sources.EndpointSource = &OCISource{}
+)
+
+// OCISource lists the tags of a repository in an OCI registry.
+// Pulling a tag flattens the layers of the image into a single tree.
+type OCISource struct {
+	endpoint url.URL
+	name     string
+	hc       *http.Client
+
+	username, password string
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewOCISource returns a source for the repository name, in the registry at endpoint.
+// endpoint should include the scheme e.g. https://ghcr.io
+func NewOCISource(endpoint, name string) (*OCISource, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("oci: endpoint must be http or https, have %q", u.Scheme)
+	}
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return nil, errors.New("oci: empty repository name")
+	}
+	return &OCISource{
+		endpoint: *u,
+		name:     name,
+		hc:       http.DefaultClient,
+
+		username: os.Getenv("OCI_USERNAME"),
+		password: os.Getenv("OCI_PASSWORD"),
+	}, nil
+}
+
+// Endpoint implements sources.EndpointSource.
+func (s *OCISource) Endpoint() string {
+	return s.endpoint.String()
+}
+
+// Fetch lists all the tags in the repository.
+func (s *OCISource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	var assets []sources.RemoteAsset
+	next := s.url("tags", "list")
+	for next != "" {
+		var page struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		res, err := s.get(ctx, next, "application/json")
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range page.Tags {
+			labels := bpmmd.LabelSet{
+				"tag": tag,
+			}
+			if sv := semver.Canonical(tag); sv != "" {
+				labels["semver"] = sv
+			} else if sv := semver.Canonical("v" + tag); sv != "" {
+				labels["semver"] = sv
+			}
+			assets = append(assets, sources.RemoteAsset{
+				ID:     tag,
+				Labels: labels,
+			})
+		}
+		if next, err = s.nextPage(res); err != nil {
+			return nil, err
+		}
+	}
+	return streams.NewSlice(assets, nil), nil
+}
+
+// Pull pulls the image referred to by id, which is a tag or digest.
+// If the reference is to an index, the manifest for the current platform is used.
+func (s *OCISource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	m, err := s.getManifest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.isIndex() {
+		desc, err := m.selectPlatform(runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return nil, err
+		}
+		if m, err = s.getManifest(ctx, desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Layers) == 0 {
+		return nil, fmt.Errorf("oci: manifest for %q has no layers", id)
+	}
+	fl := newFlattener()
+	for _, layer := range m.Layers {
+		if err := s.applyLayer(ctx, op, store, fl, layer); err != nil {
+			return nil, err
+		}
+	}
+	ref, err := fl.finish(ctx, op, store)
+	if err != nil {
+		return nil, err
+	}
+	return &sources.PullResult{Root: *ref}, nil
+}
+
+// Descriptor refers to content in the registry.
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is either an image manifest or an index of manifests.
+type Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+
+	// Manifests is set for indexes
+	Manifests []Descriptor `json:"manifests,omitempty"`
+	// Config and Layers are set for image manifests
+	Config *Descriptor  `json:"config,omitempty"`
+	Layers []Descriptor `json:"layers,omitempty"`
+}
+
+func (m *Manifest) isIndex() bool {
+	switch m.MediaType {
+	case MediaTypeImageIndex, MediaTypeDockerList:
+		return true
+	}
+	return m.MediaType == "" && len(m.Manifests) > 0
+}
+
+func (m *Manifest) selectPlatform(goos, goarch string) (*Descriptor, error) {
+	for _, desc := range m.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS == goos && desc.Platform.Architecture == goarch {
+			desc := desc
+			return &desc, nil
+		}
+	}
+	return nil, fmt.Errorf("oci: index has no manifest for %s/%s", goos, goarch)
+}
+
+func (s *OCISource) getManifest(ctx context.Context, ref string) (*Manifest, error) {
+	accept := strings.Join([]string{
+		MediaTypeImageIndex,
+		MediaTypeImageManifest,
+		MediaTypeDockerList,
+		MediaTypeDockerV2,
+	}, ", ")
+	res, err := s.get(ctx, s.url("manifests", ref), accept)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		if err := checkDigest(ref, data); err != nil {
+			return nil, err
+		}
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = res.Header.Get("Content-Type")
+	}
+	return &m, nil
+}
+
+// applyLayer streams a layer from the registry into fl, verifying its digest along the way.
+func (s *OCISource) applyLayer(ctx context.Context, op *glfs.Operator, store cadata.Poster, fl *flattener, desc Descriptor) error {
+	logctx.Infof(ctx, "pulling layer %s", desc.Digest)
+	res, err := s.get(ctx, s.url("blobs", desc.Digest), "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	vr, err := newVerifier(res.Body, desc.Digest)
+	if err != nil {
+		return err
+	}
+	// layers are detected from their content, so mislabeled or zstd layers work too.
+	r, err := unpack.Decompress(vr)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := fl.readTAR(ctx, op, store, tar.NewReader(r)); err != nil {
+		return err
+	}
+	// the tar reader may stop before the end of the stream
+	if _, err := io.Copy(io.Discard, vr); err != nil {
+		return err
+	}
+	if desc.Size > 0 && vr.n != desc.Size {
+		return fmt.Errorf("oci: layer %s has size %d, expected %d", desc.Digest, vr.n, desc.Size)
+	}
+	return vr.Verify()
+}
+
+func (s *OCISource) url(parts ...string) string {
+	u := s.endpoint
+	u.Path = path.Join(append([]string{u.Path, "v2", s.name}, parts...)...)
+	return u.String()
+}
+
+// nextPage returns the URL of the next page from the Link header, or "" if there is none.
+func (s *OCISource) nextPage(res *http.Response) (string, error) {
+	link := res.Header.Get("Link")
+	if link == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(link, ",") {
+		if !strings.Contains(part, `rel="next"`) {
+			continue
+		}
+		start, end := strings.Index(part, "<"), strings.Index(part, ">")
+		if start < 0 || end < start {
+			return "", fmt.Errorf("oci: malformed Link header %q", link)
+		}
+		next, err := url.Parse(part[start+1 : end])
+		if err != nil {
+			return "", err
+		}
+		return res.Request.URL.ResolveReference(next).String(), nil
+	}
+	return "", nil
+}
+
+// get performs a GET request, authenticating with the registry if necessary.
+func (s *OCISource) get(ctx context.Context, u string, accept string) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		s.mu.Lock()
+		token := s.token
+		s.mu.Unlock()
+		switch {
+		case token != "":
+			req.Header.Set("Authorization", "Bearer "+token)
+		case s.username != "":
+			req.SetBasicAuth(s.username, s.password)
+		}
+		return s.hc.Do(req)
+	}
+	res, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		if err := s.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if res, err = do(); err != nil {
+			return nil, err
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("oci: GET %s: %v", u, res.Status)
+	}
+	return res, nil
+}
+
+// authenticate obtains a bearer token according to a WWW-Authenticate challenge.
+func (s *OCISource) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		return fmt.Errorf("oci: unsupported auth challenge %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("oci: bad realm in auth challenge %q", challenge)
+	}
+	q := realm.Query()
+	if v, ok := params["service"]; ok {
+		q.Set("service", v)
+	}
+	if v, ok := params["scope"]; ok {
+		q.Set("scope", v)
+	}
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oci: token request: %v", res.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return err
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return errors.New("oci: token response did not contain a token")
+	}
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header of the form
+// Bearer realm="https://auth.example.com/token",service="example.com",scope="repository:a/b:pull"
+func parseChallenge(x string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(x), " ")
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		k, v, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(v, `"`) {
+			end := strings.Index(v[1:], `"`)
+			if end < 0 {
+				break
+			}
+			params[strings.TrimSpace(k)] = v[1 : end+1]
+			rest = v[end+2:]
+		} else {
+			v, rest, _ = strings.Cut(v, ",")
+			params[strings.TrimSpace(k)] = v
+		}
+	}
+	return scheme, params
+}
+
+// verifier computes the digest of everything read through it.
+type verifier struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+	n    int64
+}
+
+func newVerifier(r io.Reader, digest string) (*verifier, error) {
+	want, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &verifier{r: r, h: sha256.New(), want: want}, nil
+}
+
+func (v *verifier) Read(buf []byte) (int, error) {
+	n, err := v.r.Read(buf)
+	v.h.Write(buf[:n])
+	v.n += int64(n)
+	return n, err
+}
+
+// Verify returns an error if the data read so far does not match the expected digest
+func (v *verifier) Verify() error {
+	if have := v.h.Sum(nil); string(have) != string(v.want) {
+		return fmt.Errorf("oci: digest mismatch have sha256:%x want sha256:%x", have, v.want)
+	}
+	return nil
+}
+
+func parseDigest(x string) ([]byte, error) {
+	alg, hexStr, ok := strings.Cut(x, ":")
+	if !ok || alg != "sha256" {
+		return nil, fmt.Errorf("oci: unsupported digest %q", x)
+	}
+	data, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != sha256.Size {
+		return nil, fmt.Errorf("oci: invalid digest %q", x)
+	}
+	return data, nil
+}
+
+func checkDigest(digest string, data []byte) error {
+	want, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	if have := sha256.Sum256(data); string(have[:]) != string(want) {
+		return fmt.Errorf("oci: digest mismatch have sha256:%x want %s", have, digest)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "tools/hello")
+	reg.putImage("v1.0.0", testLayer(t, map[string]string{"hello": "v1"}))
+	reg.putImage("v1.1.0", testLayer(t, map[string]string{"hello": "v1.1"}))
+	reg.putImage("latest", testLayer(t, map[string]string{"hello": "v1.1"}))
+
+	src := reg.newSource(t)
+	it, err := src.Fetch(ctx)
+	require.NoError(t, err)
+	assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 100)
+	require.NoError(t, err)
+	require.Len(t, assets, 3)
+	for _, a := range assets {
+		if a.ID == "v1.1.0" {
+			require.Equal(t, "v1.1.0", a.Labels["semver"])
+		}
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "tools/hello")
+	reg.putIndex("v1.0.0",
+		testLayer(t, map[string]string{
+			"bin/hello":     "hello world",
+			"etc/removed":   "x",
+			"opaque/a":      "x",
+			"share/doc.txt": "docs",
+		}),
+		testLayer(t, map[string]string{
+			"bin/hello":           "hello world 2",
+			"etc/.wh.removed":     "",
+			"opaque/.wh..wh..opq": "",
+			"opaque/b":            "y",
+		}),
+	)
+	src := reg.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "v1.0.0")
+	require.NoError(t, err)
+
+	readFile := func(p string) string {
+		ref, err := op.GetAtPath(ctx, s, res.Root, p)
+		require.NoError(t, err)
+		data, err := op.GetBlobBytes(ctx, s, *ref)
+		require.NoError(t, err)
+		return string(data)
+	}
+	require.Equal(t, "hello world 2", readFile("bin/hello"))
+	require.Equal(t, "docs", readFile("share/doc.txt"))
+	require.Equal(t, "y", readFile("opaque/b"))
+	_, err = op.GetAtPath(ctx, s, res.Root, "etc/removed")
+	require.Error(t, err)
+	_, err = op.GetAtPath(ctx, s, res.Root, "opaque/a")
+	require.Error(t, err)
+}
+
+// TestPullWhiteoutOrder checks that whiteouts only hide entries from lower layers,
+// even when they come after an entry with the same path in their own layer.
+func TestPullWhiteoutOrder(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "tools/hello")
+	reg.putIndex("v1.0.0",
+		testLayer(t, map[string]string{
+			"etc/conf": "lower",
+			"opaque/a": "lower",
+			"opaque/b": "lower",
+		}),
+		testLayerOrdered(t, [][2]string{
+			{"etc/conf", "upper"},
+			{"etc/.wh.conf", ""},
+			{"tmp/scratch", "upper"},
+			{"tmp/.wh.scratch", ""},
+			{"opaque/b", "upper"},
+			{"opaque/.wh..wh..opq", ""},
+		}),
+	)
+	src := reg.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "v1.0.0")
+	require.NoError(t, err)
+
+	readFile := func(p string) string {
+		ref, err := op.GetAtPath(ctx, s, res.Root, p)
+		require.NoError(t, err)
+		data, err := op.GetBlobBytes(ctx, s, *ref)
+		require.NoError(t, err)
+		return string(data)
+	}
+	// the lower entries are hidden, and the entries from the same layer as the whiteouts are kept
+	require.Equal(t, "upper", readFile("etc/conf"))
+	require.Equal(t, "upper", readFile("tmp/scratch"))
+	require.Equal(t, "upper", readFile("opaque/b"))
+	_, err = op.GetAtPath(ctx, s, res.Root, "opaque/a")
+	require.Error(t, err)
+}
+
+func TestPullBadDigest(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, "tools/hello")
+	layer := testLayer(t, map[string]string{"hello": "hello world"})
+	digest := reg.putImage("v1.0.0", layer)
+	// corrupt the layer after the manifest has been created
+	reg.blobs[digest] = testLayer(t, map[string]string{"hello": "hello w0rld"})
+
+	src := reg.newSource(t)
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	_, err := src.Pull(ctx, &op, s, "v1.0.0")
+	require.ErrorContains(t, err, "digest mismatch")
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull"`)
+	require.Equal(t, "Bearer", scheme)
+	require.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull",
+	}, params)
+}
+
+// testRegistry is an in-process stand-in for an OCI registry, which requires token auth.
+type testRegistry struct {
+	t     testing.TB
+	name  string
+	srv   *httptest.Server
+	token string
+
+	tags      []string
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func newTestRegistry(t testing.TB, name string) *testRegistry {
+	r := &testRegistry{
+		t:     t,
+		name:  name,
+		token: "test-token",
+
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+	}
+	r.srv = httptest.NewServer(r)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *testRegistry) newSource(t testing.TB) *OCISource {
+	src, err := NewOCISource(r.srv.URL, r.name)
+	require.NoError(t, err)
+	return src
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("scope") != "repository:"+r.name+":pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, r.srv.URL, r.name))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/"+r.name+"/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	kind, ref, _ := strings.Cut(rest, "/")
+	switch kind {
+	case "tags":
+		json.NewEncoder(w).Encode(map[string]any{"name": r.name, "tags": r.tags})
+	case "manifests":
+		data, ok := r.manifests[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		var m Manifest
+		json.Unmarshal(data, &m)
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Write(data)
+	case "blobs":
+		data, ok := r.blobs[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *testRegistry) putBlob(data []byte) Descriptor {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.blobs[digest] = data
+	return Descriptor{Digest: digest, Size: int64(len(data))}
+}
+
+func (r *testRegistry) putManifest(tag string, m Manifest) Descriptor {
+	data, err := json.Marshal(m)
+	require.NoError(r.t, err)
+	desc := r.putBlob(data)
+	desc.MediaType = m.MediaType
+	r.manifests[desc.Digest] = data
+	if tag != "" {
+		r.manifests[tag] = data
+		r.tags = append(r.tags, tag)
+	}
+	return desc
+}
+
+// putImage creates a single layer image and returns the digest of the layer
+func (r *testRegistry) putImage(tag string, layer []byte) string {
+	desc := r.putBlob(layer)
+	desc.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	config := r.putBlob([]byte("{}"))
+	config.MediaType = "application/vnd.oci.image.config.v1+json"
+	r.putManifest(tag, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		Config:        &config,
+		Layers:        []Descriptor{desc},
+	})
+	return desc.Digest
+}
+
+// putIndex creates an index with an image for the current platform
+func (r *testRegistry) putIndex(tag string, layers ...[]byte) {
+	config := r.putBlob([]byte("{}"))
+	config.MediaType = "application/vnd.oci.image.config.v1+json"
+	m := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		Config:        &config,
+	}
+	for _, layer := range layers {
+		desc := r.putBlob(layer)
+		desc.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+		m.Layers = append(m.Layers, desc)
+	}
+	desc := r.putManifest("", m)
+	desc.Platform = &Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	r.putManifest(tag, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageIndex,
+		Manifests:     []Descriptor{desc},
+	})
+}
+
+func testLayer(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// testLayerOrdered is like testLayer, but writes the files in order
+func testLayerOrdered(t testing.TB, files [][2]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		name, content := f[0], f[1]
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
@@ -0,0 +1,368 @@
+// Package pypi implements a Source for Python packages using the simple repository API.
+package pypi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/brendoncarroll/stdctx/logctx"
+	"golang.org/x/net/html"
+
+	"github.com/blobcache/bpm/bpmmd"
+	"github.com/blobcache/bpm/internal/unpack"
+	"github.com/blobcache/bpm/sources"
+)
+
+// DefaultIndex is used if PIP_INDEX_URL is not set.
+const DefaultIndex = "https://pypi.org/simple/"
+
+const (
+	contentTypeJSON = "application/vnd.pypi.simple.v1+json"
+	contentTypeHTML = "application/vnd.pypi.simple.v1+html"
+)
+
+var (
+	_ sources.Source         = &PyPISource{}
+	_ sources.EndpointSource = &PyPISource{}
+)
+
+// PyPISource lists the files for a single project in a package index.
+type PyPISource struct {
+	index   url.URL
+	project string
+	hc      *http.Client
+}
+
+// NewPyPISource returns a source for project in the index at indexURL.
+func NewPyPISource(indexURL, project string) (*PyPISource, error) {
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("pypi: index must be http or https, have %q", indexURL)
+	}
+	if project == "" {
+		return nil, fmt.Errorf("pypi: empty project name")
+	}
+	return &PyPISource{
+		index:   *u,
+		project: Normalize(project),
+		hc:      http.DefaultClient,
+	}, nil
+}
+
+// IndexFromEnv returns the value of PIP_INDEX_URL, or DefaultIndex if it is not set.
+func IndexFromEnv() string {
+	if v, ok := os.LookupEnv("PIP_INDEX_URL"); ok && v != "" {
+		return v
+	}
+	return DefaultIndex
+}
+
+// Endpoint implements sources.EndpointSource.
+func (s *PyPISource) Endpoint() string {
+	return s.index.String()
+}
+
+// Fetch lists the files for the project.
+func (s *PyPISource) Fetch(ctx context.Context) (sources.AssetIterator, error) {
+	files, err := s.listFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var assets []sources.RemoteAsset
+	for _, f := range files {
+		assets = append(assets, sources.RemoteAsset{
+			ID:     f.Filename,
+			Labels: f.labels(),
+		})
+	}
+	return streams.NewSlice(assets, nil), nil
+}
+
+// Pull downloads the file with filename id, verifies it against the sha256 from the index,
+// and imports the contents of the wheel or sdist.
+func (s *PyPISource) Pull(ctx context.Context, op *glfs.Operator, store cadata.Store, id string) (*sources.PullResult, error) {
+	files, err := s.listFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var file *File
+	for i := range files {
+		if files[i].Filename == id {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		return nil, fmt.Errorf("pypi: project %q has no file %q", s.project, id)
+	}
+	want, ok := file.Hashes["sha256"]
+	if !ok {
+		return nil, fmt.Errorf("pypi: index does not publish a sha256 for %q", id)
+	}
+	f, err := s.download(ctx, file.URL, want)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	return unpack.Import(ctx, op, store, id, f)
+}
+
+// download writes the file at u to a temporary file, and checks that its sha256 is wantHex.
+// The returned file is positioned at the beginning.
+func (s *PyPISource) download(ctx context.Context, u string, wantHex string) (*os.File, error) {
+	want, err := hex.DecodeString(wantHex)
+	if err != nil {
+		return nil, err
+	}
+	logctx.Infof(ctx, "downloading %v", u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pypi: GET %s: %v", u, res.Status)
+	}
+	f, err := os.CreateTemp("", "bpm-pypi")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), res.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if have := h.Sum(nil); string(have) != string(want) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("pypi: sha256 mismatch for %s have %x want %x", u, have, want)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// File is a file listed in the index for a project.
+type File struct {
+	Filename       string            `json:"filename"`
+	URL            string            `json:"url"`
+	Hashes         map[string]string `json:"hashes"`
+	RequiresPython string            `json:"requires-python,omitempty"`
+	// Yanked is false, true, or a string giving the reason.
+	Yanked     any        `json:"yanked,omitempty"`
+	UploadTime *time.Time `json:"upload-time,omitempty"`
+}
+
+func (f *File) labels() bpmmd.LabelSet {
+	l := bpmmd.LabelSet{
+		"filename": f.Filename,
+	}
+	if wf, err := ParseWheelFilename(f.Filename); err == nil {
+		l["packagetype"] = "bdist_wheel"
+		l["version"] = wf.Version
+		l["python_tag"] = wf.PythonTag
+		l["abi_tag"] = wf.ABITag
+		l["platform_tag"] = wf.PlatformTag
+	} else if version, ok := sdistVersion(f.Filename); ok {
+		l["packagetype"] = "sdist"
+		l["version"] = version
+	}
+	for alg, h := range f.Hashes {
+		if alg == "sha256" {
+			l["sha256"] = h
+		} else {
+			l["hash_"+alg] = h
+		}
+	}
+	if f.RequiresPython != "" {
+		l["requires_python"] = f.RequiresPython
+	}
+	switch x := f.Yanked.(type) {
+	case bool:
+		if x {
+			l["yanked"] = "true"
+		}
+	case string:
+		l["yanked"] = "true"
+		l["yanked_reason"] = x
+	}
+	if f.UploadTime != nil {
+		l.PutTAI64("upload_time", *f.UploadTime)
+	}
+	return l
+}
+
+// listFiles retrieves the project page from the index, using the JSON API if the index supports it.
+func (s *PyPISource) listFiles(ctx context.Context) ([]File, error) {
+	u := s.index.JoinPath(s.project + "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", contentTypeJSON+", "+contentTypeHTML+";q=0.2, text/html;q=0.1")
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pypi: GET %s: %v", u, res.Status)
+	}
+	var files []File
+	if strings.HasPrefix(res.Header.Get("Content-Type"), contentTypeJSON) {
+		var page struct {
+			Files []File `json:"files"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			return nil, err
+		}
+		files = page.Files
+	} else {
+		if files, err = parseHTMLPage(res.Body); err != nil {
+			return nil, err
+		}
+	}
+	// URLs may be relative to the project page
+	base := res.Request.URL
+	for i := range files {
+		fu, err := url.Parse(files[i].URL)
+		if err != nil {
+			return nil, err
+		}
+		files[i].URL = base.ResolveReference(fu).String()
+	}
+	return files, nil
+}
+
+// parseHTMLPage parses a project page in the format from PEP 503.
+func parseHTMLPage(r io.Reader) ([]File, error) {
+	var files []File
+	z := html.NewTokenizer(r)
+	var cur *File
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return files, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken:
+			tok := z.Token()
+			if tok.Data != "a" {
+				continue
+			}
+			cur = &File{Hashes: map[string]string{}}
+			for _, attr := range tok.Attr {
+				switch attr.Key {
+				case "href":
+					href, frag, _ := strings.Cut(attr.Val, "#")
+					cur.URL = href
+					if alg, h, ok := strings.Cut(frag, "="); ok {
+						cur.Hashes[alg] = h
+					}
+				case "data-requires-python":
+					cur.RequiresPython = attr.Val
+				case "data-yanked":
+					if attr.Val == "" {
+						cur.Yanked = true
+					} else {
+						cur.Yanked = attr.Val
+					}
+				}
+			}
+		case html.TextToken:
+			if cur != nil {
+				cur.Filename += strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			if cur != nil && z.Token().Data == "a" {
+				if cur.Filename != "" && cur.URL != "" {
+					files = append(files, *cur)
+				}
+				cur = nil
+			}
+		}
+	}
+}
+
+var normalizeRe = regexp.MustCompile(`[-_.]+`)
+
+// Normalize normalizes a project name according to PEP 503
+func Normalize(name string) string {
+	return strings.ToLower(normalizeRe.ReplaceAllString(name, "-"))
+}
+
+// WheelFilename is a parsed wheel filename, as defined in PEP 427.
+type WheelFilename struct {
+	Distribution string
+	Version      string
+	BuildTag     string
+	PythonTag    string
+	ABITag       string
+	PlatformTag  string
+}
+
+// ParseWheelFilename parses {distribution}-{version}(-{build tag})?-{python tag}-{abi tag}-{platform tag}.whl
+func ParseWheelFilename(x string) (*WheelFilename, error) {
+	stem, ok := strings.CutSuffix(x, ".whl")
+	if !ok {
+		return nil, fmt.Errorf("pypi: %q is not a wheel", x)
+	}
+	parts := strings.Split(stem, "-")
+	var wf WheelFilename
+	switch len(parts) {
+	case 5:
+	case 6:
+		wf.BuildTag = parts[2]
+		parts = append(parts[:2], parts[3:]...)
+	default:
+		return nil, fmt.Errorf("pypi: malformed wheel filename %q", x)
+	}
+	wf.Distribution = parts[0]
+	wf.Version = parts[1]
+	wf.PythonTag = parts[2]
+	wf.ABITag = parts[3]
+	wf.PlatformTag = parts[4]
+	return &wf, nil
+}
+
+// sdistVersion returns the version from a source distribution filename
+func sdistVersion(x string) (string, bool) {
+	var stem string
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		if s, ok := strings.CutSuffix(x, ext); ok {
+			stem = s
+			break
+		}
+	}
+	i := strings.LastIndex(stem, "-")
+	if i < 0 {
+		return "", false
+	}
+	return stem[i+1:], true
+}
@@ -0,0 +1,242 @@
+package pypi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blobcache/glfs"
+	"github.com/brendoncarroll/go-exp/streams"
+	"github.com/brendoncarroll/go-state/cadata"
+	"github.com/stretchr/testify/require"
+
+	"github.com/blobcache/bpm/sources"
+)
+
+func TestFetch(t *testing.T) {
+	for _, format := range []string{"json", "html"} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			ctx := context.Background()
+			idx := newTestIndex(t, "my-tool", format)
+			idx.putFile("my_tool-1.0-py3-none-any.whl", testWheel(t, map[string]string{"my_tool/__init__.py": ""}))
+			idx.putFile("my_tool-1.0.tar.gz", []byte("sdist"))
+			idx.files[1].Yanked = "broken"
+
+			src := idx.newSource(t, "My_Tool")
+			it, err := src.Fetch(ctx)
+			require.NoError(t, err)
+			assets, err := streams.Collect[sources.RemoteAsset](ctx, it, 100)
+			require.NoError(t, err)
+			require.Len(t, assets, 2)
+
+			whl := assets[0].Labels
+			require.Equal(t, "my_tool-1.0-py3-none-any.whl", assets[0].ID)
+			require.Equal(t, "bdist_wheel", whl["packagetype"])
+			require.Equal(t, "1.0", whl["version"])
+			require.Equal(t, "py3", whl["python_tag"])
+			require.Equal(t, idx.files[0].Hashes["sha256"], whl["sha256"])
+			require.Equal(t, ">=3.8", whl["requires_python"])
+
+			sdist := assets[1].Labels
+			require.Equal(t, "sdist", sdist["packagetype"])
+			require.Equal(t, "1.0", sdist["version"])
+			require.Equal(t, "true", sdist["yanked"])
+			require.Equal(t, "broken", sdist["yanked_reason"])
+		})
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	idx := newTestIndex(t, "my-tool", "html")
+	idx.putFile("my_tool-1.0-py3-none-any.whl", testWheel(t, map[string]string{"my_tool/__init__.py": "VERSION = '1.0'"}))
+
+	src := idx.newSource(t, "my-tool")
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	res, err := src.Pull(ctx, &op, s, "my_tool-1.0-py3-none-any.whl")
+	require.NoError(t, err)
+	ref, err := op.GetAtPath(ctx, s, res.Root, "my_tool/__init__.py")
+	require.NoError(t, err)
+	data, err := op.GetBlobBytes(ctx, s, *ref)
+	require.NoError(t, err)
+	require.Equal(t, "VERSION = '1.0'", string(data))
+
+	_, err = src.Pull(ctx, &op, s, "my_tool-2.0-py3-none-any.whl")
+	require.ErrorContains(t, err, "has no file")
+}
+
+func TestPullBadHash(t *testing.T) {
+	ctx := context.Background()
+	idx := newTestIndex(t, "my-tool", "json")
+	idx.putFile("my_tool-1.0-py3-none-any.whl", testWheel(t, map[string]string{"my_tool/__init__.py": ""}))
+	// the file is replaced after it was uploaded
+	idx.data["my_tool-1.0-py3-none-any.whl"] = testWheel(t, map[string]string{"my_tool/__init__.py": "evil"})
+
+	src := idx.newSource(t, "my-tool")
+	op := glfs.NewOperator()
+	s := cadata.NewMem(cadata.DefaultHash, glfs.DefaultBlockSize)
+	_, err := src.Pull(ctx, &op, s, "my_tool-1.0-py3-none-any.whl")
+	require.ErrorContains(t, err, "sha256 mismatch")
+
+	// files without a sha256 are not pulled
+	delete(idx.files[0].Hashes, "sha256")
+	_, err = src.Pull(ctx, &op, s, "my_tool-1.0-py3-none-any.whl")
+	require.ErrorContains(t, err, "does not publish a sha256")
+}
+
+func TestParseWheelFilename(t *testing.T) {
+	wf, err := ParseWheelFilename("numpy-1.26.0-cp311-cp311-manylinux_2_17_x86_64.whl")
+	require.NoError(t, err)
+	require.Equal(t, WheelFilename{
+		Distribution: "numpy",
+		Version:      "1.26.0",
+		PythonTag:    "cp311",
+		ABITag:       "cp311",
+		PlatformTag:  "manylinux_2_17_x86_64",
+	}, *wf)
+
+	wf, err = ParseWheelFilename("tool-2.0-1b-py3-none-any.whl")
+	require.NoError(t, err)
+	require.Equal(t, WheelFilename{
+		Distribution: "tool",
+		Version:      "2.0",
+		BuildTag:     "1b",
+		PythonTag:    "py3",
+		ABITag:       "none",
+		PlatformTag:  "any",
+	}, *wf)
+
+	for _, x := range []string{"tool-2.0.tar.gz", "tool-2.0-any.whl", "a-b-c-d-e-f-g.whl"} {
+		_, err := ParseWheelFilename(x)
+		require.Error(t, err, x)
+	}
+}
+
+func TestSdistVersion(t *testing.T) {
+	for x, want := range map[string]string{
+		"tool-1.0.tar.gz":         "1.0",
+		"my-tool-2.0rc1.zip":      "2.0rc1",
+		"my_tool-0.1.dev0.tar.gz": "0.1.dev0",
+	} {
+		v, ok := sdistVersion(x)
+		require.True(t, ok, x)
+		require.Equal(t, want, v, x)
+	}
+	for _, x := range []string{"tool.tar.gz", "tool-1.0.whl", "README"} {
+		_, ok := sdistVersion(x)
+		require.False(t, ok, x)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	require.Equal(t, "my-tool", Normalize("My_Tool"))
+	require.Equal(t, "a-b", Normalize("a.-_b"))
+}
+
+// testIndex is an in-process stand-in for a package index with a single project.
+// It serves the project page as JSON or PEP 503 HTML, depending on format.
+type testIndex struct {
+	t       testing.TB
+	project string
+	format  string
+	srv     *httptest.Server
+
+	files []File
+	data  map[string][]byte
+}
+
+func newTestIndex(t testing.TB, project, format string) *testIndex {
+	idx := &testIndex{
+		t:       t,
+		project: project,
+		format:  format,
+		data:    make(map[string][]byte),
+	}
+	idx.srv = httptest.NewServer(idx)
+	t.Cleanup(idx.srv.Close)
+	return idx
+}
+
+func (idx *testIndex) newSource(t testing.TB, project string) *PyPISource {
+	src, err := NewPyPISource(idx.srv.URL+"/simple/", project)
+	require.NoError(t, err)
+	return src
+}
+
+func (idx *testIndex) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if name, ok := strings.CutPrefix(req.URL.Path, "/files/"); ok {
+		data, ok := idx.data[name]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	if req.URL.Path != "/simple/"+idx.project+"/" {
+		http.NotFound(w, req)
+		return
+	}
+	switch idx.format {
+	case "json":
+		if !strings.Contains(req.Header.Get("Accept"), contentTypeJSON) {
+			http.Error(w, "json not accepted", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(map[string]any{"files": idx.files})
+	default:
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintln(w, "<!DOCTYPE html><html><body>")
+		for _, f := range idx.files {
+			attrs := ""
+			if f.RequiresPython != "" {
+				attrs += fmt.Sprintf(` data-requires-python="%s"`, strings.ReplaceAll(f.RequiresPython, ">", "&gt;"))
+			}
+			if reason, ok := f.Yanked.(string); ok {
+				attrs += fmt.Sprintf(` data-yanked="%s"`, reason)
+			}
+			href := f.URL
+			if h, ok := f.Hashes["sha256"]; ok {
+				href += "#sha256=" + h
+			}
+			fmt.Fprintf(w, "<a href=\"%s\"%s>%s</a><br/>\n", href, attrs, f.Filename)
+		}
+		fmt.Fprintln(w, "</body></html>")
+	}
+}
+
+// putFile adds a file to the project, with a URL relative to the project page.
+func (idx *testIndex) putFile(filename string, data []byte) {
+	sum := sha256.Sum256(data)
+	idx.files = append(idx.files, File{
+		Filename:       filename,
+		URL:            "../../files/" + filename,
+		Hashes:         map[string]string{"sha256": hex.EncodeToString(sum[:])},
+		RequiresPython: ">=3.8",
+	})
+	idx.data[filename] = data
+}
+
+func testWheel(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
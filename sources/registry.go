@@ -0,0 +1,93 @@
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownScheme is returned by Registry.Make when no Factory is registered for a URL's scheme.
+var ErrUnknownScheme = errors.New("unrecognized URL scheme")
+
+// Params are passed to a Factory to create a Source.
+type Params struct {
+	URL URL
+	// Cache is persistent storage for the source, it may be nil.
+	Cache Cache
+	// Options configure the source, they are specific to each scheme.
+	// Factories should return an error for options they do not recognize.
+	Options map[string]string
+}
+
+// Factory creates a Source
+type Factory func(params Params) (Source, error)
+
+// Registry maps URL schemes to the Factory used to create Sources for that scheme.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]Factory
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+// Register makes a Factory available for scheme.
+// It panics if scheme is already registered, or if f is nil.
+func (r *Registry) Register(scheme string, f Factory) {
+	if f == nil {
+		panic("sources: Register factory is nil")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.factories[scheme]; exists {
+		panic(fmt.Sprintf("sources: Register called twice for scheme %q", scheme))
+	}
+	r.factories[scheme] = f
+}
+
+// Make creates a Source for params.URL using the Factory registered for its scheme.
+func (r *Registry) Make(params Params) (Source, error) {
+	r.mu.RLock()
+	f, exists := r.factories[params.URL.Scheme]
+	r.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownScheme, params.URL.Scheme)
+	}
+	return f(params)
+}
+
+// Schemes returns the registered schemes in sorted order.
+func (r *Registry) Schemes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]string, 0, len(r.factories))
+	for scheme := range r.factories {
+		ret = append(ret, scheme)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Clone returns a new Registry containing the same factories as r.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r2 := NewRegistry()
+	for scheme, f := range r.factories {
+		r2.factories[scheme] = f
+	}
+	return r2
+}
+
+// DefaultRegistry is the Registry used by Register.
+// The bpm package registers the built in source types here.
+var DefaultRegistry = NewRegistry()
+
+// Register makes a Factory available for scheme in the DefaultRegistry.
+// It panics if scheme is already registered, or if f is nil.
+func Register(scheme string, f Factory) {
+	DefaultRegistry.Register(scheme, f)
+}
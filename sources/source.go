@@ -3,6 +3,7 @@ package sources
 import (
 	"context"
 	"errors"
+	"io"
 	"strings"
 
 	"github.com/blobcache/glfs"
@@ -16,9 +17,45 @@ import (
 type Source interface {
 	// Fetch returns an iterator for all the assets in the source
 	Fetch(ctx context.Context) (AssetIterator, error)
-	Pull(ctx context.Context, op *glfs.Operator, s cadata.Store, id string) (*glfs.Ref, error)
+	// Pull downloads the content of the asset with id into s
+	Pull(ctx context.Context, op *glfs.Operator, s cadata.Store, id string) (*PullResult, error)
 }
 
+// PullResult is the content of a pulled asset
+type PullResult struct {
+	Root glfs.Ref
+	// Labels are added to the labels from Fetch.
+	// They are for metadata which is only available in the content, such as the control file of a package.
+	Labels bpmmd.LabelSet
+}
+
+// PartialSource is implemented by sources which can be configured to list only some of their assets.
+// Assets which are not listed by a partial fetch are not marked as gone.
+type PartialSource interface {
+	Source
+	// IsPartial returns true if Fetch will not list every asset in the source.
+	IsPartial() bool
+}
+
+// FileSource is implemented by sources with assets which are single files, that Pull unpacks.
+// It allows files to be verified before they are unpacked, and related files, such as signatures, to be downloaded.
+type FileSource interface {
+	Source
+	// Open returns the file for the asset with id, before it is unpacked, and its filename.
+	// Open returns an error wrapping ErrNotFile for assets which are not single files.
+	Open(ctx context.Context, id string) (io.ReadCloser, string, error)
+}
+
+// EndpointSource is implemented by sources which list and download assets from a single base URL.
+type EndpointSource interface {
+	Source
+	// Endpoint returns the base URL of the source.
+	Endpoint() string
+}
+
+// ErrNotFile is returned by FileSource.Open for assets which are not single files
+var ErrNotFile = errors.New("sources: asset is not a file")
+
 type RemoteAsset struct {
 	ID     string
 	Labels bpmmd.LabelSet
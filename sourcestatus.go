@@ -0,0 +1,97 @@
+package bpm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/blobcache/bpm/internal/dbutil"
+	"github.com/blobcache/bpm/sources"
+)
+
+// SourceStatus is the outcome of the fetches from a source
+type SourceStatus struct {
+	URL sources.URL `json:"url"`
+
+	LastAttempt time.Time `json:"last_attempt"`
+	// LastSuccess is zero if the source has never been fetched successfully.
+	LastSuccess time.Time `json:"last_success"`
+	// AssetCount is the number of assets from the source which are not gone.
+	AssetCount int `json:"asset_count"`
+	// LastError is the error from the last attempt, or empty if it succeeded.
+	LastError string `json:"last_error"`
+}
+
+// GetSourceStatus returns the status of the source at u, or nil if it has never been fetched.
+func (r *Repo) GetSourceStatus(ctx context.Context, u sources.URL) (*SourceStatus, error) {
+	return dbutil.DoTx1(ctx, r.db, func(tx *sqlx.Tx) (*SourceStatus, error) {
+		var row sourceStatusRow
+		err := tx.Get(&row, `SELECT * FROM source_status WHERE scheme = ? AND path = ?`, u.Scheme, u.Path)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return row.toStatus(), nil
+	})
+}
+
+// ListSourceStatus returns the status of every source which has been fetched, ordered by URL.
+func (r *Repo) ListSourceStatus(ctx context.Context) ([]SourceStatus, error) {
+	var rows []sourceStatusRow
+	if err := r.db.SelectContext(ctx, &rows, `SELECT * FROM source_status ORDER BY scheme, path`); err != nil {
+		return nil, err
+	}
+	ret := make([]SourceStatus, len(rows))
+	for i := range rows {
+		ret[i] = *rows[i].toStatus()
+	}
+	return ret, nil
+}
+
+// putSourceStatus records the outcome of a fetch from u which started at attempt.
+// The last success is kept if the fetch failed.
+func putSourceStatus(tx *sqlx.Tx, u sources.URL, attempt time.Time, fetchErr error) error {
+	var count int
+	if err := tx.Get(&count, `SELECT count(*) FROM upstreams WHERE scheme = ? AND path = ? AND gone_at IS NULL`, u.Scheme, u.Path); err != nil {
+		return err
+	}
+	var success sql.NullTime
+	var errStr string
+	if fetchErr == nil {
+		success = sql.NullTime{Time: time.Now(), Valid: true}
+	} else {
+		errStr = fetchErr.Error()
+	}
+	_, err := tx.Exec(`INSERT INTO source_status (scheme, path, last_attempt, last_success, asset_count, last_error)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (scheme, path) DO UPDATE SET
+			last_attempt = excluded.last_attempt,
+			last_success = COALESCE(excluded.last_success, last_success),
+			asset_count = excluded.asset_count,
+			last_error = excluded.last_error`,
+		u.Scheme, u.Path, attempt, success, count, errStr)
+	return err
+}
+
+type sourceStatusRow struct {
+	Scheme      string       `db:"scheme"`
+	Path        string       `db:"path"`
+	LastAttempt time.Time    `db:"last_attempt"`
+	LastSuccess sql.NullTime `db:"last_success"`
+	AssetCount  int          `db:"asset_count"`
+	LastError   string       `db:"last_error"`
+}
+
+func (row sourceStatusRow) toStatus() *SourceStatus {
+	return &SourceStatus{
+		URL:         sources.URL{Scheme: row.Scheme, Path: row.Path},
+		LastAttempt: row.LastAttempt,
+		LastSuccess: row.LastSuccess.Time,
+		AssetCount:  row.AssetCount,
+		LastError:   row.LastError,
+	}
+}
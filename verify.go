@@ -0,0 +1,185 @@
+package bpm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/brendoncarroll/stdctx/logctx"
+	"golang.org/x/exp/slices"
+
+	"github.com/blobcache/bpm/internal/checksum"
+	"github.com/blobcache/bpm/internal/sigverify"
+	"github.com/blobcache/bpm/sources"
+)
+
+// ErrUnsigned is returned when an asset must be signed, but no signature for it could be checked.
+var ErrUnsigned = errors.New("bpm: asset is not signed")
+
+// sigPolicy is the signature policy for a source
+type sigPolicy struct {
+	keys []sigverify.Key
+	// require rejects assets without a valid signature from one of keys.
+	require bool
+}
+
+// reservedLabels are set by Pull from its own checks, and are removed from the labels given by sources.
+var reservedLabels = []string{"signature_verified", "signed_by"}
+
+// sourceLabels returns the labels from a source without the reserved labels
+func sourceLabels(ls LabelSet) LabelSet {
+	ret := make(LabelSet, len(ls))
+	for k, v := range ls {
+		if !slices.Contains(reservedLabels, k) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// parseTrustedKeys parses the trusted keys for a source, as in SourceConfig.TrustedKeys
+func parseTrustedKeys(xs []string) ([]sigverify.Key, error) {
+	var keys []sigverify.Key
+	for _, x := range xs {
+		data := []byte(x)
+		if filepath.IsAbs(x) {
+			var err error
+			if data, err = os.ReadFile(x); err != nil {
+				return nil, err
+			}
+		}
+		k, err := sigverify.ParseKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// openVerified opens the file for an asset, from a mirror, or from the source if it is a sources.FileSource and the file needs to be checked.
+// The file must match pinnedSHA256 if it is set, and otherwise the sha256 label if the asset has one.
+// The file needs to be checked if it is pinned, the source has trusted keys, or a policy for the source requires a checksum.
+// The file and its name are returned, or nil if the asset should be pulled from the source instead.
+func (r *Repo) openVerified(ctx context.Context, u sources.URL, src sources.Source, idstr string, labels LabelSet, pinnedSHA256 string) (io.ReadSeekCloser, string, error) {
+	if pinnedSHA256 != "" {
+		labels = mergeLabels(labels, LabelSet{"sha256": pinnedSHA256})
+	}
+	if f, filename := r.openFromMirrors(ctx, u, idstr, labels); f != nil {
+		return f, filename, nil
+	}
+	_, hasPolicy := r.sigPolicies[u]
+	needSum := labels["sha256"] != "" && r.requiresChecksum(u)
+	if !hasPolicy && !needSum && pinnedSHA256 == "" {
+		return nil, "", nil
+	}
+	notFile := func() (io.ReadSeekCloser, string, error) {
+		if pinnedSHA256 != "" {
+			return nil, "", fmt.Errorf("%v/%s: the sha256 pin cannot be checked: %w", u, idstr, sources.ErrNotFile)
+		}
+		return nil, "", nil
+	}
+	fs, ok := src.(sources.FileSource)
+	if !ok {
+		return notFile()
+	}
+	rc, filename, err := fs.Open(ctx, idstr)
+	if errors.Is(err, sources.ErrNotFile) {
+		return notFile()
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	f, err := checksum.Verify(rc, labels["sha256"])
+	if errors.Is(err, checksum.ErrMismatch) && pinnedSHA256 != "" {
+		return nil, "", fmt.Errorf("%s: %w: %w", filename, ErrPinMismatch, err)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", filename, err)
+	}
+	return f, filename, nil
+}
+
+// checkSignature checks the signature of the file f for an asset with labels, against the keys in pol.
+// The signature is found by the signature label, which is the id of the signature file in src.
+// If the signature_for label is set, the signature is over that file instead, which must be a checksum file listing f by its filename label.
+//
+// A bad signature is always an error.
+// A missing, untrusted, or uncheckable signature is an error only if pol requires signatures,
+// otherwise the asset is labeled signature_verified=false.
+func (r *Repo) checkSignature(ctx context.Context, src sources.Source, pol sigPolicy, labels LabelSet, f io.ReadSeeker, filename string) (LabelSet, error) {
+	reject := func(err error) (LabelSet, error) {
+		if pol.require || errors.Is(err, sigverify.ErrBadSignature) {
+			return nil, fmt.Errorf("verifying signature of %s: %w", filename, err)
+		}
+		logctx.Warnf(ctx, "%s: %v", filename, err)
+		return LabelSet{"signature_verified": "false"}, nil
+	}
+	sigID := labels["signature"]
+	if sigID == "" {
+		return reject(ErrUnsigned)
+	}
+	fs, ok := src.(sources.FileSource)
+	if !ok || f == nil {
+		return reject(fmt.Errorf("%w: the source cannot provide the signed file", ErrUnsigned))
+	}
+	sig, err := readSourceFile(ctx, fs, sigID, sigverify.MaxSignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	var key sigverify.Key
+	if sumsID := labels["signature_for"]; sumsID != "" {
+		sums, err := readSourceFile(ctx, fs, sumsID, checksum.MaxFileSize)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = sigverify.Verify(pol.keys, bytes.NewReader(sums), sig); err != nil {
+			return reject(err)
+		}
+		have, err := checksum.SHA256(f)
+		if err != nil {
+			return nil, err
+		}
+		name := labels["filename"]
+		if name == "" {
+			name = filename
+		}
+		name = path.Base(name)
+		want, ok := checksum.Parse(sums)[name]
+		if !ok {
+			return reject(fmt.Errorf("%w: %s is not listed in the signed checksums", ErrUnsigned, name))
+		}
+		if have != want {
+			return nil, fmt.Errorf("%s: %w: have %s, signed %s", filename, checksum.ErrMismatch, have, want)
+		}
+	} else {
+		if key, err = sigverify.Verify(pol.keys, f, sig); err != nil {
+			return reject(err)
+		}
+	}
+	return LabelSet{
+		"signature_verified": "true",
+		"signed_by":          fmt.Sprintf("%s:%s", key.Kind(), key.ID()),
+	}, nil
+}
+
+// readSourceFile reads the file for the asset id from fs, which must be at most max bytes.
+func readSourceFile(ctx context.Context, fs sources.FileSource, id string, max int64) ([]byte, error) {
+	rc, name, err := fs.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, max)
+	}
+	return data, nil
+}